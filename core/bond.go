@@ -0,0 +1,546 @@
+package core
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+	"io"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/injoyai/base/safe"
+	"github.com/injoyai/logs"
+)
+
+// DefaultBondBuffer 默认缓存的已发送未确认的数据长度,超过后写入阻塞,直到对端确认
+const DefaultBondBuffer = 8 << 20
+
+// 握手结果
+const (
+	bondNew     byte = 0x00 // bondNew 新的绑定会话
+	bondJoined  byte = 0x01 // bondJoined 加入了已有的绑定会话
+	bondUnknown byte = 0x02 // bondUnknown 绑定会话不存在(已关闭)
+)
+
+// bondMagic 客户端握手的标识
+var bondMagic = []byte("BND1")
+
+// bondMaxPending 提前到达的记录最多领先已交付数据的长度,
+// 发送方未确认的数据不会超过 DefaultBondBuffer,超过时说明对端异常,关闭会话
+const bondMaxPending = DefaultBondBuffer + resumeMaxRecord
+
+// DialBond 建立多条连接并绑定成一条逻辑连接
+// dials 中每个函数建立一条底层连接,可以使用不同的传输方式或网卡,
+// 数据按记录分配到排队最少的连接上,对端按编号重新排序,
+// 某条连接断开后,它上面未确认的数据会通过其他连接重新发送,并在后台重连,
+// 所有连接都断开时关闭并返回 ErrBond,服务端需要使用 BondServer 接受连接
+// 会话密钥以明文在每条连接上传输,只有连接已经加密(PSK、TLS)时才是保密的,
+// 否则能看到握手的第三方可以加入会话
+func DialBond(dials ...func() (io.ReadWriteCloser, error)) (*BondConn, error) {
+	if len(dials) == 0 {
+		return nil, ErrBond
+	}
+	c, err := dials[0]()
+	if err != nil {
+		return nil, err
+	}
+	b := newBondConn()
+	if err := b.join(c); err != nil {
+		c.Close()
+		return nil, err
+	}
+	go b.keepalive()
+	go b.runCarrier(dials[0], b.add(c))
+	for _, dial := range dials[1:] {
+		go b.runCarrier(dial, nil)
+	}
+	return b, nil
+}
+
+// NewBondServer 创建一个绑定连接的服务端
+func NewBondServer() *BondServer {
+	return &BondServer{sessions: make(map[[16]byte]*BondConn)}
+}
+
+// BondServer 绑定连接的服务端,按会话标识把客户端的多条连接绑定到一起
+type BondServer struct {
+	mu       sync.Mutex
+	sessions map[[16]byte]*BondConn
+}
+
+// Accept 读取客户端的握手
+// 新的会话返回绑定后的连接,加入已有的会话时,连接会加入已有的会话,
+// 阻塞直到这个连接断开,返回 nil,nil,会话不存在(已关闭)或密钥不一致时返回 ErrBond
+// 加入会话需要会话标识和创建会话时分配的密钥,只知道会话标识不能加入
+func (this *BondServer) Accept(c io.ReadWriteCloser) (*BondConn, error) {
+	hello := make([]byte, len(bondMagic)+32)
+	if _, err := io.ReadFull(c, hello); err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(hello[:len(bondMagic)], bondMagic) {
+		return nil, ErrBond
+	}
+	var id, secret [16]byte
+	copy(id[:], hello[len(bondMagic):])
+	copy(secret[:], hello[len(bondMagic)+16:])
+
+	if id == ([16]byte{}) {
+		b := newBondConn()
+		rand.Read(b.id[:])
+		rand.Read(b.secret[:])
+		this.mu.Lock()
+		this.sessions[b.id] = b
+		this.mu.Unlock()
+		b.onClose = func() {
+			this.mu.Lock()
+			delete(this.sessions, b.id)
+			this.mu.Unlock()
+		}
+		if _, err := c.Write(b.hello(bondNew)); err != nil {
+			b.CloseWithErr(err)
+			return nil, err
+		}
+		go b.keepalive()
+		go b.serve(b.add(c))
+		return b, nil
+	}
+
+	this.mu.Lock()
+	b := this.sessions[id]
+	this.mu.Unlock()
+	if b == nil || b.Closed() || subtle.ConstantTimeCompare(secret[:], b.secret[:]) != 1 {
+		c.Write(append([]byte{bondUnknown}, make([]byte, 32)...))
+		return nil, ErrBond
+	}
+	if _, err := c.Write(b.hello(bondJoined)); err != nil {
+		return nil, err
+	}
+	b.serve(b.add(c))
+	return nil, nil
+}
+
+// Len 获取绑定会话的数量
+func (this *BondServer) Len() int {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	return len(this.sessions)
+}
+
+// bondRecord 已发送未确认的数据记录,via 为负责发送的连接
+type bondRecord struct {
+	seq  uint64
+	data []byte
+	via  *bondCarrier
+}
+
+// bondCarrier 绑定的一条底层连接,每条连接有单独的发送协程,慢的连接不会阻塞其他连接
+type bondCarrier struct {
+	rw       io.ReadWriteCloser
+	wMu      sync.Mutex    // wMu 保证写入的记录完整
+	queue    []*bondRecord // queue 等待发送的记录,由 BondConn.mu 保护
+	queued   int           // queued 等待发送的数据长度,由 BondConn.mu 保护
+	signal   chan struct{}
+	lastRecv atomic.Int64 // lastRecv 最后一次收到数据的时间(纳秒)
+	blocked  atomic.Bool  // blocked 读取协程是否正在等待交付数据(上层读取慢),此时没有读取连接,不判断心跳
+}
+
+// stale 连接是否长时间没有收到数据,等待交付数据时不判断
+func (this *bondCarrier) stale() bool {
+	return !this.blocked.Load() && time.Since(time.Unix(0, this.lastRecv.Load())) > resumeKeepalive*resumeDeadTimes
+}
+
+func newBondConn() *BondConn {
+	pr, pw := io.Pipe()
+	b := &BondConn{
+		Closer:  safe.NewCloser(),
+		changed: make(chan struct{}, 1),
+		pending: make(map[uint64][]byte),
+		ackNow:  make(chan struct{}, 1),
+		pr:      pr,
+		pw:      pw,
+	}
+	b.SetCloseFunc(func(err error) error {
+		b.mu.Lock()
+		carriers := b.carriers
+		b.carriers = nil
+		b.mu.Unlock()
+		for _, c := range carriers {
+			// 写入可能阻塞在已经断开的连接上,拿不到锁时不通知对端
+			if c.wMu.TryLock() {
+				c.rw.Write([]byte{resumeClose})
+				c.wMu.Unlock()
+			}
+			c.rw.Close()
+			signal(c.signal)
+		}
+		b.pw.CloseWithError(err)
+		if b.onClose != nil {
+			b.onClose()
+		}
+		return nil
+	})
+	return b
+}
+
+// BondConn 多条连接绑定成的一条逻辑连接,实现了 io.ReadWriteCloser,可以作为隧道的底层连接
+// 记录格式和 ResumeConn 一致,发送的数据按字节编号,缓存到对端确认为止
+type BondConn struct {
+	*safe.Closer
+	id      [16]byte // id 会话标识,由服务端分配
+	secret  [16]byte // secret 会话密钥,由服务端分配,加入会话时需要和会话标识一起发送
+	onClose func()   // onClose 会话关闭时从服务端移除
+
+	mu       sync.Mutex     // mu 保护下面的字段和连接的发送队列
+	carriers []*bondCarrier // carriers 当前的底层连接
+	records  []*bondRecord  // records 已发送未确认的记录,按编号排序
+	sent     uint64         // sent 下一条记录的编号
+	buffered int            // buffered 未确认的数据长度
+	changed  chan struct{}  // changed 对端确认或有新的连接时通知等待的写入
+
+	rMu      sync.Mutex        // rMu 保证按编号顺序交付数据
+	pending  map[uint64][]byte // pending 提前到达的记录,由 rMu 保护
+	waiting  int               // waiting 提前到达的记录的总长度,由 rMu 保护
+	received atomic.Uint64     // received 已按顺序收到的数据长度
+	ackNow   chan struct{}     // ackNow 通知心跳协程立即发送确认
+	pr       *io.PipeReader
+	pw       *io.PipeWriter
+}
+
+// Read 读取对端发送的数据,已经按编号排序
+func (this *BondConn) Read(p []byte) (int, error) {
+	return this.pr.Read(p)
+}
+
+// Write 发送数据,数据分配到排队最少的连接上
+// 未确认的数据超过 DefaultBondBuffer 或没有可用的连接时阻塞
+func (this *BondConn) Write(p []byte) (int, error) {
+	total := len(p)
+	for len(p) > 0 {
+		n := min(len(p), resumeMaxRecord)
+		if err := this.writeRecord(p[:n]); err != nil {
+			return total - len(p), err
+		}
+		p = p[n:]
+	}
+	return total, nil
+}
+
+// Carriers 获取当前可用的连接数量
+func (this *BondConn) Carriers() int {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	return len(this.carriers)
+}
+
+// writeRecord 缓存一条数据记录,交给排队最少的连接发送
+func (this *BondConn) writeRecord(p []byte) error {
+	this.mu.Lock()
+	for this.buffered > 0 && this.buffered+len(p) > DefaultBondBuffer || len(this.carriers) == 0 {
+		this.mu.Unlock()
+		select {
+		case <-this.changed:
+		case <-this.Done():
+			return this.Err()
+		}
+		this.mu.Lock()
+	}
+	defer this.mu.Unlock()
+	if this.Closed() {
+		return this.Err()
+	}
+	r := &bondRecord{seq: this.sent, data: bytes.Clone(p)}
+	this.sent += uint64(len(p))
+	this.buffered += len(p)
+	this.records = append(this.records, r)
+	this.enqueue(r)
+	return nil
+}
+
+// enqueue 把记录分配给排队最少的连接,调用方需持有锁,且至少有一条连接
+func (this *BondConn) enqueue(r *bondRecord) {
+	c := slices.MinFunc(this.carriers, func(a, b *bondCarrier) int { return a.queued - b.queued })
+	r.via = c
+	c.queue = append(c.queue, r)
+	c.queued += len(r.data)
+	signal(c.signal)
+}
+
+// add 添加一条底层连接,启动发送协程
+func (this *BondConn) add(rw io.ReadWriteCloser) *bondCarrier {
+	c := &bondCarrier{rw: rw, signal: make(chan struct{}, 1)}
+	c.lastRecv.Store(time.Now().UnixNano())
+	this.mu.Lock()
+	this.carriers = append(this.carriers, c)
+	this.mu.Unlock()
+	signal(this.changed)
+	go this.runSender(c)
+	return c
+}
+
+// remove 移除断开的连接,它上面未确认的记录交给其他连接重新发送
+// 没有剩余的连接时关闭会话
+func (this *BondConn) remove(c *bondCarrier, err error) {
+	c.rw.Close()
+	signal(c.signal)
+	this.mu.Lock()
+	i := slices.Index(this.carriers, c)
+	if i < 0 {
+		this.mu.Unlock()
+		return
+	}
+	this.carriers = slices.Delete(this.carriers, i, i+1)
+	if len(this.carriers) == 0 {
+		this.mu.Unlock()
+		this.CloseWithErr(ErrBond)
+		return
+	}
+	for _, r := range this.records {
+		if r.via == c {
+			this.enqueue(r)
+		}
+	}
+	n := len(this.carriers)
+	this.mu.Unlock()
+	logs.Tracef("[绑定] 连接断开,剩余%d条: %v\n", n, err)
+}
+
+// runSender 连接的发送协程,按顺序发送分配给它的记录
+func (this *BondConn) runSender(c *bondCarrier) {
+	for {
+		select {
+		case <-c.signal:
+		case <-this.Done():
+			return
+		}
+		this.mu.Lock()
+		if !slices.Contains(this.carriers, c) {
+			this.mu.Unlock()
+			return
+		}
+		queue := c.queue
+		c.queue = nil
+		this.mu.Unlock()
+		for _, r := range queue {
+			c.wMu.Lock()
+			err := writeResumeData(c.rw, r.seq, r.data)
+			c.wMu.Unlock()
+			if err != nil {
+				// 记录仍然缓存,由读取协程移除连接后重新分配
+				c.rw.Close()
+				return
+			}
+			// 写入完成后才减少排队长度,写入慢的连接分配到的数据更少
+			this.mu.Lock()
+			c.queued -= len(r.data)
+			this.mu.Unlock()
+		}
+	}
+}
+
+// join 客户端握手,第一条连接创建会话,之后的连接加入会话
+func (this *BondConn) join(c io.ReadWriteCloser) error {
+	hello := append(bytes.Clone(bondMagic), this.id[:]...)
+	if _, err := c.Write(append(hello, this.secret[:]...)); err != nil {
+		return err
+	}
+	res := make([]byte, 1+32)
+	if _, err := io.ReadFull(c, res); err != nil {
+		return err
+	}
+	if res[0] == bondUnknown {
+		return ErrBond
+	}
+	copy(this.id[:], res[1:17])
+	copy(this.secret[:], res[17:])
+	return nil
+}
+
+// hello 服务端握手的响应,包含会话标识和密钥
+func (this *BondConn) hello(result byte) []byte {
+	bs := append([]byte{result}, this.id[:]...)
+	return append(bs, this.secret[:]...)
+}
+
+// runCarrier 客户端维护一条连接,断开后重连并重新加入会话,直到会话关闭
+func (this *BondConn) runCarrier(dial func() (io.ReadWriteCloser, error), c *bondCarrier) {
+	wait := time.Millisecond * 100
+	for !this.Closed() {
+		if c == nil {
+			rw, err := dial()
+			if err == nil {
+				if err = this.join(rw); err != nil {
+					rw.Close()
+				}
+			}
+			switch {
+			case err == nil:
+				wait = time.Millisecond * 100
+				c = this.add(rw)
+			case errors.Is(err, ErrBond):
+				return
+			default:
+				logs.Tracef("[绑定] 连接失败: %v\n", err)
+				select {
+				case <-time.After(wait):
+				case <-this.Done():
+					return
+				}
+				wait = min(wait*2, time.Second*5)
+				continue
+			}
+		}
+		this.serve(c)
+		c = nil
+	}
+}
+
+// serve 读取连接,直到断开后移除连接
+func (this *BondConn) serve(c *bondCarrier) {
+	this.remove(c, this.readLoop(c))
+}
+
+// readLoop 读取连接的记录,直到连接断开或会话关闭
+func (this *BondConn) readLoop(c *bondCarrier) error {
+	r := bufio.NewReader(c.rw)
+	head := make([]byte, 12)
+	for {
+		_type, err := r.ReadByte()
+		if err != nil {
+			return err
+		}
+		c.lastRecv.Store(time.Now().UnixNano())
+		switch _type {
+		case resumeData:
+			if _, err := io.ReadFull(r, head); err != nil {
+				return err
+			}
+			size := binary.BigEndian.Uint32(head[8:])
+			if size > resumeMaxRecord {
+				return ErrFrameTooLarge
+			}
+			data := make([]byte, size)
+			if _, err := io.ReadFull(r, data); err != nil {
+				return err
+			}
+			// 上层读取慢时所有连接的交付都会阻塞,期间没有读取对端的确认和心跳,结束后重新计时
+			c.blocked.Store(true)
+			err = this.deliver(binary.BigEndian.Uint64(head), data)
+			c.blocked.Store(false)
+			c.lastRecv.Store(time.Now().UnixNano())
+			if err != nil {
+				return err
+			}
+		case resumeAck:
+			if _, err := io.ReadFull(r, head[:8]); err != nil {
+				return err
+			}
+			this.trim(binary.BigEndian.Uint64(head))
+		case resumeClose:
+			this.CloseWithErr(io.EOF)
+			return io.EOF
+		default:
+			return ErrFrameInvalid
+		}
+	}
+}
+
+// deliver 按编号顺序交付数据,提前到达的记录先缓存,重复的记录忽略
+func (this *BondConn) deliver(seq uint64, data []byte) error {
+	this.rMu.Lock()
+	defer this.rMu.Unlock()
+	received := this.received.Load()
+	switch {
+	case seq+uint64(len(data)) <= received:
+		return nil
+	case seq > received:
+		if _, ok := this.pending[seq]; ok {
+			return nil
+		}
+		// 对端不会发送超出缓存的数据,否则提前到达的记录会占用大量内存
+		if seq+uint64(len(data))-received > bondMaxPending || this.waiting+len(data) > bondMaxPending {
+			err := errors.Join(ErrBond, errors.New("提前到达的数据过多"))
+			this.CloseWithErr(err)
+			return err
+		}
+		this.pending[seq] = data
+		this.waiting += len(data)
+		return nil
+	}
+	for data != nil {
+		data = data[received-seq:]
+		if _, err := this.pw.Write(data); err != nil {
+			return err
+		}
+		received = this.received.Add(uint64(len(data)))
+		signal(this.ackNow)
+		seq, data = received, this.pending[received]
+		if data != nil {
+			delete(this.pending, received)
+			this.waiting -= len(data)
+		}
+	}
+	return nil
+}
+
+// trim 对端确认收到了 received 长度的数据,释放缓存
+func (this *BondConn) trim(received uint64) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	n := 0
+	for n < len(this.records) && this.records[n].seq+uint64(len(this.records[n].data)) <= received {
+		this.buffered -= len(this.records[n].data)
+		n++
+	}
+	if n > 0 {
+		this.records = this.records[:copy(this.records, this.records[n:])]
+		signal(this.changed)
+	}
+}
+
+// keepalive 在每条连接上定时发送确认,同时作为心跳,长时间没有收到数据的连接会被断开
+// 收到数据后也会尽快确认,确认不能在读取协程中发送,否则双方的写入都阻塞时会互相等待
+func (this *BondConn) keepalive() {
+	ticker := time.NewTicker(resumeKeepalive)
+	defer ticker.Stop()
+	acked := uint64(0)
+	for {
+		all := false
+		select {
+		case <-this.Done():
+			return
+		case <-ticker.C:
+			all = true
+		case <-this.ackNow:
+			if this.received.Load()-acked < resumeAckBytes {
+				// 数据较少时等待定时确认,避免每条记录都确认
+				continue
+			}
+		}
+		received := this.received.Load()
+		acked = received
+		bs := binary.BigEndian.AppendUint64([]byte{resumeAck}, received)
+		this.mu.Lock()
+		carriers := slices.Clone(this.carriers)
+		this.mu.Unlock()
+		for _, c := range carriers {
+			if all && c.stale() {
+				c.rw.Close()
+				continue
+			}
+			c.wMu.Lock()
+			_, err := c.rw.Write(bs)
+			c.wMu.Unlock()
+			if err != nil {
+				c.rw.Close()
+			}
+			if !all {
+				break
+			}
+		}
+	}
+}
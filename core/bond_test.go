@@ -0,0 +1,200 @@
+package core
+
+import (
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// newBondPair 在 net.Pipe 上建立一对绑定连接,客户端有 n 条底层连接
+func newBondPair(t *testing.T, n int) (client, server *BondConn, srv *BondServer) {
+	t.Helper()
+	srv = NewBondServer()
+	accepted := make(chan *BondConn, 1)
+	dial := func() (io.ReadWriteCloser, error) {
+		c1, c2 := net.Pipe()
+		go func() {
+			if b, err := srv.Accept(c2); err == nil && b != nil {
+				accepted <- b
+			}
+		}()
+		return c1, nil
+	}
+	dials := make([]func() (io.ReadWriteCloser, error), n)
+	for i := range dials {
+		dials[i] = dial
+	}
+	client, err := DialBond(dials...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case server = <-accepted:
+	case <-time.After(5 * time.Second):
+		t.Fatal("服务端没有建立会话")
+	}
+	t.Cleanup(func() {
+		// 服务端可能有阻塞的交付,先关闭服务端,否则客户端通知关闭时会阻塞在 net.Pipe 上
+		server.Close()
+		client.Close()
+	})
+	waitFor(t, "底层连接没有全部加入", func() bool { return client.Carriers() == n && server.Carriers() == n })
+	return client, server, srv
+}
+
+// TestBondReorder 不同连接上的记录乱序到达时按编号交付,重复的记录忽略
+func TestBondReorder(t *testing.T) {
+	b := newBondConn()
+	defer b.Close()
+	got := make(chan string, 1)
+	go func() {
+		buf := make([]byte, 15)
+		io.ReadFull(b, buf)
+		got <- string(buf)
+	}()
+	for _, v := range []struct {
+		seq  uint64
+		data string
+	}{
+		{10, "again"},
+		{5, "world"},
+		{5, "world"}, // 另一条连接重新发送的记录
+		{0, "hello"},
+		{0, "hello"},
+	} {
+		if err := b.deliver(v.seq, []byte(v.data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	select {
+	case s := <-got:
+		if s != "helloworldagain" {
+			t.Fatalf("收到的数据不一致: %q", s)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("读取数据超时")
+	}
+	if len(b.pending) != 0 || b.waiting != 0 {
+		t.Fatalf("提前到达的记录没有释放: %d %d", len(b.pending), b.waiting)
+	}
+}
+
+// TestBondMaxPending 提前到达的数据超过 bondMaxPending 时关闭会话
+func TestBondMaxPending(t *testing.T) {
+	b := newBondConn()
+	defer b.Close()
+	if err := b.deliver(1, []byte("x")); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.deliver(bondMaxPending, []byte("x")); !errors.Is(err, ErrBond) || !b.Closed() {
+		t.Fatalf("预期 ErrBond 并关闭会话,得到 %v", err)
+	}
+}
+
+// TestBondWrongSecret 只知道会话标识、密钥不一致时不能加入会话
+func TestBondWrongSecret(t *testing.T) {
+	client, server, srv := newBondPair(t, 1)
+
+	fake := newBondConn()
+	defer fake.Close()
+	fake.id = client.id
+	fake.secret[0] = ^client.secret[0]
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	errCh := make(chan error, 1)
+	go func() {
+		_, err := srv.Accept(c2)
+		errCh <- err
+	}()
+	if err := fake.join(c1); !errors.Is(err, ErrBond) {
+		t.Fatalf("预期 ErrBond,得到 %v", err)
+	}
+	if err := <-errCh; !errors.Is(err, ErrBond) {
+		t.Fatalf("预期 ErrBond,得到 %v", err)
+	}
+	if server.Carriers() != 1 {
+		t.Fatalf("密钥不一致时加入了会话: %d", server.Carriers())
+	}
+}
+
+// TestBondLoseCarrier 一条连接断开后,未确认的数据由其他连接重新发送,会话继续使用并在后台重连
+func TestBondLoseCarrier(t *testing.T) {
+	client, server, _ := newBondPair(t, 2)
+
+	client.mu.Lock()
+	lost := client.carriers[0]
+	client.mu.Unlock()
+	lost.rw.Close()
+
+	data := make([]byte, 256<<10)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	go client.Write(data)
+	got := make([]byte, len(data))
+	done := make(chan error, 1)
+	go func() {
+		_, err := io.ReadFull(server, got)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("读取数据超时")
+	}
+	for i := range got {
+		if got[i] != data[i] {
+			t.Fatalf("第%d字节不一致", i)
+		}
+	}
+	if client.Closed() || server.Closed() {
+		t.Fatal("一条连接断开时关闭了会话")
+	}
+	waitFor(t, "断开的连接没有重连", func() bool { return client.Carriers() == 2 && server.Carriers() == 2 })
+}
+
+// TestBondStalledReader 上层读取慢时所有连接的读取协程都会阻塞,期间收不到对端的心跳,不能断开正常的连接
+func TestBondStalledReader(t *testing.T) {
+	client, server, _ := newBondPair(t, 2)
+
+	server.mu.Lock()
+	carriers := append([]*bondCarrier(nil), server.carriers...)
+	server.mu.Unlock()
+	blocked := func() (n int) {
+		for _, c := range carriers {
+			if c.blocked.Load() {
+				n++
+			}
+		}
+		return
+	}
+
+	// 第一条记录交付时阻塞,第二条记录分配到另一条连接,等待交付
+	go client.Write(make([]byte, resumeMaxRecord))
+	waitFor(t, "读取协程没有阻塞", func() bool { return blocked() == 1 })
+	client.mu.Lock()
+	client.carriers[0].queued += DefaultBondBuffer
+	client.mu.Unlock()
+	go client.Write(make([]byte, resumeMaxRecord))
+	waitFor(t, "另一条连接的读取协程没有阻塞", func() bool { return blocked() == 2 })
+
+	for _, c := range carriers {
+		c.lastRecv.Store(time.Now().Add(-time.Hour).UnixNano())
+		if c.stale() {
+			t.Fatal("等待交付数据时判断连接断开")
+		}
+	}
+
+	if _, err := io.ReadFull(server, make([]byte, 2*resumeMaxRecord)); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "读取协程恢复后没有重新计时", func() bool { return !carriers[0].stale() && !carriers[1].stale() })
+	if server.Carriers() != 2 {
+		t.Fatalf("断开了正常的连接: %d", server.Carriers())
+	}
+}
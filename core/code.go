@@ -0,0 +1,181 @@
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"strconv"
+)
+
+// Code 错误码,失败的响应和关闭原因携带错误码传给对端,对端还原成 *Error
+type Code uint16
+
+// 错误码常量,只能追加,不能修改已有的值
+const (
+	CodeUnknown     Code = 0  // CodeUnknown 未知错误,对端只能得到错误信息
+	CodeNotRegister Code = 1  // CodeNotRegister 未注册
+	CodeAuth        Code = 2  // CodeAuth 认证失败,例如账号密码错误
+	CodeIdentity    Code = 3  // CodeIdentity 证书身份不匹配
+	CodeKicked      Code = 4  // CodeKicked 被踢下线,例如相同标识的客户端重新注册
+	CodeDialInvalid Code = 5  // CodeDialInvalid 对端没有设置连接函数
+	CodeDial        Code = 6  // CodeDial 对端连接目标失败,例如目标拒绝连接
+	CodeTimeout     Code = 7  // CodeTimeout 超时
+	CodeRemoteClose Code = 8  // CodeRemoteClose 连接已关闭
+	CodeGoAway      Code = 9  // CodeGoAway 隧道正在关闭
+	CodeWindow      Code = 10 // CodeWindow 超出接收窗口
+	CodeCanceled    Code = 11 // CodeCanceled 请求已取消
+	CodeUnsupported Code = 12 // CodeUnsupported 不支持的消息类型
+	CodeMethod      Code = 13 // CodeMethod 远程调用的方法不存在
+	CodeOffline     Code = 14 // CodeOffline 客户端不在线
+	CodeBusy        Code = 15 // CodeBusy 对端繁忙,同时执行和排队的远程调用都达到上限
+	CodeListen      Code = 16 // CodeListen 不允许的监听配置
+)
+
+// codeErrors 错误码对应的预定义错误,用于 errors.Is 和识别本地错误的错误码
+var codeErrors = []struct {
+	code Code
+	err  error
+}{
+	{CodeNotRegister, ErrNotRegister},
+	{CodeAuth, ErrAuth},
+	{CodeIdentity, ErrIdentity},
+	{CodeKicked, ErrKicked},
+	{CodeDialInvalid, ErrDialInvalid},
+	{CodeDial, ErrDial},
+	{CodeTimeout, ErrTimeout},
+	{CodeRemoteClose, ErrRemoteClose},
+	{CodeGoAway, ErrGoAway},
+	{CodeWindow, ErrWindow},
+	{CodeCanceled, context.Canceled},
+	{CodeUnsupported, ErrUnsupported},
+	{CodeMethod, ErrMethod},
+	{CodeOffline, ErrOffline},
+	{CodeBusy, ErrBusy},
+	{CodeListen, ErrListenDenied},
+}
+
+// Err 获取错误码对应的预定义错误,未知的错误码返回nil
+func (c Code) Err() error {
+	for _, v := range codeErrors {
+		if v.code == c {
+			return v.err
+		}
+	}
+	return nil
+}
+
+// String 错误码的描述,即预定义错误的信息
+func (c Code) String() string {
+	if err := c.Err(); err != nil {
+		return err.Error()
+	}
+	return "错误码" + strconv.Itoa(int(c))
+}
+
+// Temporary 是否是临时的错误,认证失败、身份不匹配、被踢下线和监听配置不允许时重试也不会成功
+func (c Code) Temporary() bool {
+	switch c {
+	case CodeAuth, CodeIdentity, CodeKicked, CodeListen:
+		return false
+	}
+	return true
+}
+
+// Error 携带错误码的错误,可以通过 errors.Is 和预定义错误(例如 ErrNotRegister)比较
+type Error struct {
+	Code   Code   `json:"code"`             // Code 错误码
+	Reason string `json:"reason,omitempty"` // Reason 错误的原因
+	Target string `json:"target,omitempty"` // Target 相关的目标地址,例如连接失败的地址
+}
+
+func (this *Error) Error() string {
+	reason := this.Reason
+	if reason == "" {
+		reason = this.Code.String()
+	}
+	if this.Target != "" {
+		return "[" + this.Target + "] " + reason
+	}
+	return reason
+}
+
+// Is 错误码相同,或者和错误码对应的预定义错误比较
+func (this *Error) Is(target error) bool {
+	if e, ok := target.(*Error); ok {
+		return e.Code == this.Code
+	}
+	return this.Code != CodeUnknown && this.Code.Err() == target
+}
+
+// Temporary 是否是临时的错误,见 Code.Temporary
+func (this *Error) Temporary() bool {
+	return this.Code.Temporary()
+}
+
+// CodeOf 获取错误的错误码,*Error 返回其错误码,预定义错误返回对应的错误码,其他返回 CodeUnknown
+func CodeOf(err error) Code {
+	if e := (*Error)(nil); errors.As(err, &e) {
+		return e.Code
+	}
+	for _, v := range codeErrors {
+		if errors.Is(err, v.err) {
+			return v.code
+		}
+	}
+	return CodeUnknown
+}
+
+// Temporary 是否是临时的错误,可以用于判断是否需要重连,
+// 认证失败、身份不匹配和被踢下线返回false,其他错误(例如网络错误)返回true
+func Temporary(err error) bool {
+	return err == nil || CodeOf(err).Temporary()
+}
+
+// dialError 连接目标失败的错误,区分超时和其他失败,携带目标地址
+func dialError(target string, err error) error {
+	if e := (*Error)(nil); errors.As(err, &e) {
+		return err
+	}
+	code := CodeDial
+	if ne := net.Error(nil); errors.As(err, &ne) && ne.Timeout() {
+		code = CodeTimeout
+	}
+	return &Error{Code: code, Reason: err.Error(), Target: target}
+}
+
+// encodeError 编码发给对端的错误,coded 为对端能否解析错误码(协商了 FeatureErrorCode),
+// 能解析时统一编码成 Error(没有错误码的为 CodeUnknown),否则只发送错误信息,兼容旧版本
+func encodeError(err error, coded bool) []byte {
+	if err == nil {
+		return nil
+	}
+	if !coded {
+		return []byte(err.Error())
+	}
+	code := CodeOf(err)
+	e := &Error{Code: code, Reason: err.Error()}
+	if v := (*Error)(nil); errors.As(err, &v) {
+		e.Reason, e.Target = v.Reason, v.Target
+	}
+	bs, _ := json.Marshal(e)
+	return bs
+}
+
+// decodeError 解析对端发送的错误,coded 为对端是否按错误码编码,见 encodeError
+// 携带错误码时还原成 *Error,否则按错误信息识别旧版本发送的预定义错误
+func decodeError(data []byte, coded bool) error {
+	if coded {
+		e := new(Error)
+		if json.Unmarshal(data, e) == nil {
+			return e
+		}
+	}
+	msg := string(data)
+	for _, v := range codeErrors {
+		if v.err.Error() == msg {
+			return &Error{Code: v.code, Reason: msg}
+		}
+	}
+	return errors.New(msg)
+}
@@ -0,0 +1,59 @@
+package core
+
+import (
+	"errors"
+	"testing"
+)
+
+// TestErrorRoundTrip 对端返回的错误经过隧道后保留错误码和目标地址,可以和预定义错误比较
+func TestErrorRoundTrip(t *testing.T) {
+	method := func(err error) TunnelOption {
+		return WithMethod("call", func(tun *Tunnel, args []byte) (any, error) { return nil, err })
+	}
+
+	// 例如服务端转发调用时目标客户端不在线
+	_, c := newTestPair(t, []TunnelOption{method(&Error{Code: CodeOffline, Target: "other"})}, nil)
+	err := c.Call("call", nil, nil)
+	e := (*Error)(nil)
+	if !errors.Is(err, ErrOffline) || !errors.As(err, &e) || e.Target != "other" {
+		t.Fatalf("预期 ErrOffline(other),得到 %v", err)
+	}
+	if !Temporary(err) {
+		t.Fatal("客户端不在线应该是临时的错误")
+	}
+
+	// 编码方式由协商结果决定,不根据内容猜测
+	text := errors.New(`{"code":2,"reason":"x"}`)
+	_, c = newTestPair(t, []TunnelOption{method(text)}, nil)
+	if err := c.Call("call", nil, nil); errors.Is(err, ErrAuth) || err.Error() != text.Error() {
+		t.Fatalf("没有错误码的错误被识别成了 %v", err)
+	}
+
+	// 对端不支持错误码时按错误信息识别预定义错误
+	legacy := &Protocol{Version: ProtocolVersion, Frames: []string{FrameNameV1}, Features: []string{FeatureHalfClose}}
+	_, c = newTestPair(t, []TunnelOption{method(ErrOffline)}, []TunnelOption{WithProtocol(legacy)})
+	if c.Negotiated().HasFeature(FeatureErrorCode) {
+		t.Fatal("协商了错误码")
+	}
+	if err := c.Call("call", nil, nil); !errors.Is(err, ErrOffline) {
+		t.Fatalf("预期 ErrOffline,得到 %v", err)
+	}
+	_, c = newTestPair(t, []TunnelOption{method(text)}, []TunnelOption{WithProtocol(legacy)})
+	if err := c.Call("call", nil, nil); err == nil || err.Error() != text.Error() {
+		t.Fatalf("错误信息不一致: %v", err)
+	}
+}
+
+// TestRegisterErrorCode 注册失败时还没有协商结果,根据注册请求通告的功能编码错误
+func TestRegisterErrorCode(t *testing.T) {
+	s, c := newTestTunnels(t, []TunnelOption{WithRegister(func(tun *Tunnel, data []byte) (any, error) {
+		return nil, &Error{Code: CodeAuth, Reason: "密码错误"}
+	})}, nil)
+	_, err := c.Register(&RegisterReq{Key: "client"})
+	if !errors.Is(err, ErrAuth) || Temporary(err) || err.Error() != "密码错误" {
+		t.Fatalf("预期 ErrAuth,得到 %v", err)
+	}
+	if s.Negotiated() != nil || c.Negotiated() != nil {
+		t.Fatal("注册失败时切换了协议")
+	}
+}
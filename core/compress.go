@@ -0,0 +1,100 @@
+package core
+
+import (
+	"bytes"
+	"compress/flate"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// 压缩算法名称,用于注册时协商
+const (
+	CompressFlate = "flate" // CompressFlate DEFLATE 压缩,标准库实现
+)
+
+// DefaultCompressThreshold 默认的压缩阈值,小于此长度的数据不压缩,避免小包变大
+const DefaultCompressThreshold = 256
+
+// Compressor 压缩算法,每个数据包独立压缩,需要支持并发调用
+type Compressor interface {
+	// Compress 压缩数据
+	Compress(p []byte) ([]byte, error)
+	// Decompress 解压数据,解压后的长度超过 max 时返回错误,0表示不限制
+	Decompress(p []byte, max int) ([]byte, error)
+}
+
+var (
+	compressMu sync.RWMutex
+	compresses = map[string]Compressor{
+		CompressFlate: NewFlate(flate.BestSpeed),
+	}
+)
+
+// RegisterCompress 注册一个压缩算法,注册后可以参与协商
+func RegisterCompress(name string, c Compressor) {
+	compressMu.Lock()
+	defer compressMu.Unlock()
+	compresses[name] = c
+}
+
+// GetCompress 根据名称获取压缩算法,不存在返回nil
+func GetCompress(name string) Compressor {
+	compressMu.RLock()
+	defer compressMu.RUnlock()
+	return compresses[name]
+}
+
+// NewFlate 创建一个 DEFLATE 压缩算法,level 为压缩等级
+// 压缩器和解压器会复用,避免每个数据包都重新分配
+func NewFlate(level int) Compressor {
+	return &flateCompressor{
+		writers: sync.Pool{New: func() any {
+			w, _ := flate.NewWriter(nil, level)
+			return w
+		}},
+		readers: sync.Pool{New: func() any {
+			return flate.NewReader(nil)
+		}},
+	}
+}
+
+type flateCompressor struct {
+	writers sync.Pool
+	readers sync.Pool
+}
+
+func (this *flateCompressor) Compress(p []byte) ([]byte, error) {
+	w := this.writers.Get().(*flate.Writer)
+	defer this.writers.Put(w)
+	buf := bytes.NewBuffer(make([]byte, 0, len(p)))
+	w.Reset(buf)
+	if _, err := w.Write(p); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (this *flateCompressor) Decompress(p []byte, max int) ([]byte, error) {
+	r := this.readers.Get().(io.ReadCloser)
+	defer this.readers.Put(r)
+	if err := r.(flate.Resetter).Reset(bytes.NewReader(p), nil); err != nil {
+		return nil, err
+	}
+	var src io.Reader = r
+	if max > 0 {
+		// 多读一个字节,用于判断是否超过限制
+		src = io.LimitReader(r, int64(max)+1)
+	}
+	bs, err := io.ReadAll(src)
+	if err != nil {
+		return nil, err
+	}
+	if max > 0 && len(bs) > max {
+		return nil, fmt.Errorf("%w: 解压后超过%d字节", ErrFrameTooLarge, max)
+	}
+	return bs, nil
+}
@@ -0,0 +1,39 @@
+package core
+
+import (
+	"bytes"
+	"testing"
+)
+
+// TestCompressNegotiate 双方都启用压缩时协商出压缩算法,达到阈值的数据压缩传输并能正确还原
+func TestCompressNegotiate(t *testing.T) {
+	large := bytes.Repeat([]byte("compress-"), 8<<10)
+	cases := []struct {
+		name     string
+		server   []TunnelOption
+		client   []TunnelOption
+		data     []byte
+		compress string // compress 预期协商的压缩算法
+		saved    bool   // saved 预期是否压缩了数据
+	}{
+		{"双方启用", []TunnelOption{WithCompress()}, []TunnelOption{WithCompress()}, large, CompressFlate, true},
+		{"只有客户端启用", nil, []TunnelOption{WithCompress()}, large, "", false},
+		{"只有服务端启用", []TunnelOption{WithCompress()}, nil, large, "", false},
+		{"小于阈值", []TunnelOption{WithCompress()}, []TunnelOption{WithCompress(), WithCompressThreshold(1 << 20)}, large, CompressFlate, false},
+		{"未知的算法", []TunnelOption{WithCompress("zstd")}, []TunnelOption{WithCompress("zstd")}, large, "", false},
+	}
+	for _, v := range cases {
+		t.Run(v.name, func(t *testing.T) {
+			s, c := newTestPair(t, append(v.server, WithDial(echoDial)), v.client)
+			if got := c.Negotiated().Compress; got != v.compress {
+				t.Fatalf("预期协商%q,得到%q", v.compress, got)
+			}
+			testEcho(t, c, v.data)
+			sent, _ := c.CompressSaved()
+			_, received := s.CompressSaved()
+			if (sent > 0) != v.saved || sent != received {
+				t.Fatalf("压缩节省的字节数错误: 发送%d 接收%d", sent, received)
+			}
+		})
+	}
+}
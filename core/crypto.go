@@ -0,0 +1,248 @@
+package core
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// 加密握手常量
+const (
+	pskVersion   = 0x01             // pskVersion 握手协议版本
+	pskSaltSize  = 32               // pskSaltSize 双方随机盐的长度
+	pskMaxRecord = 16 << 10         // pskMaxRecord 单条加密记录的最大明文长度
+	pskTimeout   = time.Second * 10 // pskTimeout 握手超时时间
+)
+
+// PSK 预共享密钥加密配置,在隧道连接交给 NewTunnel 之前对其进行加密和认证
+// 握手时双方交换随机盐,通过 HKDF-SHA256 派生出两个方向的 AES-256-GCM 密钥,
+// 密钥不一致时握手失败,注册信息(包括密码)不会以明文传输
+type PSK struct {
+	ID     string                          // ID 客户端使用的密钥标识,服务端据此查找密钥,可选
+	Key    []byte                          // Key 预共享密钥,客户端使用,服务端未设置 Lookup 时也使用
+	Lookup func(id string) ([]byte, error) // Lookup 服务端根据密钥标识查找密钥,可选,用于每个设备单独的密钥
+}
+
+// Client 作为客户端进行加密握手,返回加密后的连接
+// 握手失败时不会关闭原连接
+func (this *PSK) Client(c io.ReadWriteCloser) (*PSKConn, error) {
+	if len(this.ID) > 0xFF {
+		return nil, fmt.Errorf("%w: 密钥标识过长", ErrHandshake)
+	}
+	defer setDeadline(c, time.Now().Add(pskTimeout))()
+
+	// 发送 [版本][客户端盐][标识长度][标识]
+	hello := make([]byte, 0, pskSaltSize+len(this.ID)+2)
+	hello = append(hello, pskVersion)
+	hello = append(hello, randBytes(pskSaltSize)...)
+	hello = append(hello, byte(len(this.ID)))
+	hello = append(hello, this.ID...)
+	if _, err := c.Write(hello); err != nil {
+		return nil, err
+	}
+
+	// 读取 [版本][服务端盐]
+	resp := make([]byte, pskSaltSize+1)
+	if _, err := io.ReadFull(c, resp); err != nil {
+		return nil, err
+	}
+	if resp[0] != pskVersion {
+		return nil, fmt.Errorf("%w: 不支持的版本%d", ErrHandshake, resp[0])
+	}
+
+	conn, err := newPSKConn(c, this.ID, this.Key, hello[1:pskSaltSize+1], resp[1:], false)
+	if err != nil {
+		return nil, err
+	}
+	return conn, conn.confirm()
+}
+
+// Server 作为服务端进行加密握手,返回加密后的连接
+// 握手失败时不会关闭原连接
+func (this *PSK) Server(c io.ReadWriteCloser) (*PSKConn, error) {
+	defer setDeadline(c, time.Now().Add(pskTimeout))()
+
+	// 读取 [版本][客户端盐][标识长度][标识]
+	hello := make([]byte, pskSaltSize+2)
+	if _, err := io.ReadFull(c, hello); err != nil {
+		return nil, err
+	}
+	if hello[0] != pskVersion {
+		return nil, fmt.Errorf("%w: 不支持的版本%d", ErrHandshake, hello[0])
+	}
+	id := make([]byte, hello[pskSaltSize+1])
+	if _, err := io.ReadFull(c, id); err != nil {
+		return nil, err
+	}
+
+	key := this.Key
+	if this.Lookup != nil {
+		var err error
+		if key, err = this.Lookup(string(id)); err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrHandshake, err)
+		}
+	}
+
+	// 发送 [版本][服务端盐]
+	resp := append([]byte{pskVersion}, randBytes(pskSaltSize)...)
+	if _, err := c.Write(resp); err != nil {
+		return nil, err
+	}
+
+	conn, err := newPSKConn(c, string(id), key, hello[1:pskSaltSize+1], resp[1:], true)
+	if err != nil {
+		return nil, err
+	}
+	return conn, conn.confirm()
+}
+
+// newPSKConn 根据预共享密钥和双方的盐派生密钥,创建加密连接
+func newPSKConn(c io.ReadWriteCloser, id string, key, clientSalt, serverSalt []byte, server bool) (*PSKConn, error) {
+	if len(key) == 0 {
+		return nil, fmt.Errorf("%w: 密钥为空", ErrHandshake)
+	}
+	salt := append(append([]byte{}, clientSalt...), serverSalt...)
+	c2s, err := newAEAD(key, salt, "injoyai/proxy psk client")
+	if err != nil {
+		return nil, err
+	}
+	s2c, err := newAEAD(key, salt, "injoyai/proxy psk server")
+	if err != nil {
+		return nil, err
+	}
+	conn := &PSKConn{ReadWriteCloser: c, id: id, enc: c2s, dec: s2c}
+	if server {
+		conn.enc, conn.dec = s2c, c2s
+	}
+	return conn, nil
+}
+
+// newAEAD 通过 HKDF-SHA256 派生 AES-256-GCM 密钥
+func newAEAD(key, salt []byte, info string) (cipher.AEAD, error) {
+	k, err := hkdf.Key(sha256.New, key, salt, info, 32)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(k)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// PSKConn 预共享密钥加密的连接
+// 数据按记录加密传输,格式: [密文长度2字节][密文],每个方向使用独立的密钥和递增的nonce
+type PSKConn struct {
+	io.ReadWriteCloser
+	id   string      // id 客户端的密钥标识
+	enc  cipher.AEAD // enc 发送方向的加密器
+	dec  cipher.AEAD // dec 接收方向的解密器
+	wMu  sync.Mutex  // wMu 保证写入记录和nonce递增的原子性
+	wSeq uint64      // wSeq 发送记录序号
+	rSeq uint64      // rSeq 接收记录序号
+	buf  []byte      // buf 已解密未读取的数据
+}
+
+// ID 获取客户端的密钥标识,服务端可以据此识别设备
+func (this *PSKConn) ID() string {
+	return this.id
+}
+
+// confirm 双方各发送一条空记录并校验,密钥不一致时握手失败
+func (this *PSKConn) confirm() error {
+	if _, err := this.writeRecord(nil); err != nil {
+		return err
+	}
+	if _, err := this.readRecord(); err != nil {
+		return fmt.Errorf("%w: %v", ErrHandshake, err)
+	}
+	return nil
+}
+
+// Read 读取解密后的数据,不支持并发调用
+func (this *PSKConn) Read(p []byte) (int, error) {
+	for len(this.buf) == 0 {
+		bs, err := this.readRecord()
+		if err != nil {
+			return 0, err
+		}
+		this.buf = bs
+	}
+	n := copy(p, this.buf)
+	this.buf = this.buf[n:]
+	return n, nil
+}
+
+// Write 加密并写入数据,超过记录长度时会拆分成多条记录
+func (this *PSKConn) Write(p []byte) (int, error) {
+	this.wMu.Lock()
+	defer this.wMu.Unlock()
+	total := 0
+	for len(p) > 0 {
+		n := min(len(p), pskMaxRecord)
+		if _, err := this.writeRecord(p[:n]); err != nil {
+			return total, err
+		}
+		total += n
+		p = p[n:]
+	}
+	return total, nil
+}
+
+// writeRecord 加密并写入一条记录
+func (this *PSKConn) writeRecord(p []byte) (int, error) {
+	bs := make([]byte, 2, 2+len(p)+this.enc.Overhead())
+	bs = this.enc.Seal(bs, this.nonce(this.wSeq), p, nil)
+	binary.BigEndian.PutUint16(bs[:2], uint16(len(bs)-2))
+	this.wSeq++
+	return this.ReadWriteCloser.Write(bs)
+}
+
+// readRecord 读取并解密一条记录,认证失败说明数据被篡改或密钥不一致
+func (this *PSKConn) readRecord() ([]byte, error) {
+	head := make([]byte, 2)
+	if _, err := io.ReadFull(this.ReadWriteCloser, head); err != nil {
+		return nil, err
+	}
+	bs := make([]byte, binary.BigEndian.Uint16(head))
+	if _, err := io.ReadFull(this.ReadWriteCloser, bs); err != nil {
+		return nil, err
+	}
+	bs, err := this.dec.Open(bs[:0], this.nonce(this.rSeq), bs, nil)
+	if err != nil {
+		return nil, ErrDecrypt
+	}
+	this.rSeq++
+	return bs, nil
+}
+
+// nonce 根据记录序号生成nonce
+func (this *PSKConn) nonce(seq uint64) []byte {
+	n := make([]byte, 12)
+	binary.BigEndian.PutUint64(n[4:], seq)
+	return n
+}
+
+// randBytes 生成指定长度的随机字节
+func randBytes(n int) []byte {
+	bs := make([]byte, n)
+	rand.Read(bs)
+	return bs
+}
+
+// setDeadline 连接支持超时时设置超时时间,返回恢复函数
+func setDeadline(c io.ReadWriteCloser, t time.Time) func() {
+	d, ok := c.(interface{ SetDeadline(time.Time) error })
+	if !ok {
+		return func() {}
+	}
+	d.SetDeadline(t)
+	return func() { d.SetDeadline(time.Time{}) }
+}
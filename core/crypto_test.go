@@ -0,0 +1,148 @@
+package core
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// pskPair 在本地 tcp 连接上完成加密握手,返回双方的握手结果
+// 握手时双方同时发送确认记录,需要使用带缓存的连接
+func pskPair(t *testing.T, client, server *PSK) (c, s *PSKConn, cErr, sErr error) {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		conn, err := l.Accept()
+		if err != nil {
+			sErr = err
+			return
+		}
+		t.Cleanup(func() { conn.Close() })
+		if s, sErr = server.Server(conn); sErr != nil {
+			// 和服务端一样,握手失败时关闭连接
+			conn.Close()
+		}
+	}()
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	c, cErr = client.Client(conn)
+	<-done
+	return
+}
+
+// TestPSKHandshake 密钥一致时握手成功,密钥或标识错误时双方都握手失败
+func TestPSKHandshake(t *testing.T) {
+	lookup := func(id string) ([]byte, error) {
+		if id != "device-1" {
+			return nil, errors.New("未知的设备")
+		}
+		return []byte("device-key"), nil
+	}
+	cases := []struct {
+		name   string
+		client *PSK
+		server *PSK
+		ok     bool
+	}{
+		{"密钥一致", &PSK{Key: []byte("secret")}, &PSK{Key: []byte("secret")}, true},
+		{"密钥错误", &PSK{Key: []byte("secret")}, &PSK{Key: []byte("other")}, false},
+		{"按标识查找", &PSK{ID: "device-1", Key: []byte("device-key")}, &PSK{Lookup: lookup}, true},
+		{"标识对应的密钥错误", &PSK{ID: "device-1", Key: []byte("secret")}, &PSK{Lookup: lookup}, false},
+		{"未知的标识", &PSK{ID: "device-2", Key: []byte("device-key")}, &PSK{Lookup: lookup}, false},
+	}
+	for _, v := range cases {
+		t.Run(v.name, func(t *testing.T) {
+			c, s, cErr, sErr := pskPair(t, v.client, v.server)
+			if v.ok {
+				if cErr != nil || sErr != nil {
+					t.Fatal(cErr, sErr)
+				}
+				if s.ID() != v.client.ID {
+					t.Fatalf("服务端得到的标识错误: %q", s.ID())
+				}
+				go c.Write([]byte("hello"))
+				buf := make([]byte, 5)
+				if _, err := io.ReadFull(s, buf); err != nil || string(buf) != "hello" {
+					t.Fatalf("读取错误: %q %v", buf, err)
+				}
+				return
+			}
+			if !errors.Is(sErr, ErrHandshake) {
+				t.Fatalf("服务端预期 ErrHandshake,得到 %v", sErr)
+			}
+			if cErr == nil {
+				t.Fatal("客户端握手成功")
+			}
+		})
+	}
+}
+
+// TestPSKRecord 加密记录被篡改、重放或乱序时解密失败,数据不以明文传输
+func TestPSKRecord(t *testing.T) {
+	cases := []struct {
+		name  string
+		build func(r0, r1 []byte) []byte // build 根据两条正常的记录构造发送给服务端的数据
+		want  []string                   // want 预期依次读取到的数据
+		fail  bool                       // fail 读取完 want 之后是否返回 ErrDecrypt
+	}{
+		{"正常", func(r0, r1 []byte) []byte { return append(r0, r1...) }, []string{"first", "second"}, false},
+		{"篡改密文", func(r0, r1 []byte) []byte { r0[4] ^= 0x01; return r0 }, nil, true},
+		{"篡改认证标签", func(r0, r1 []byte) []byte { r0[len(r0)-1] ^= 0x01; return r0 }, nil, true},
+		{"重放", func(r0, r1 []byte) []byte { return append(append(r0, r0...), r1...) }, []string{"first"}, true},
+		{"乱序", func(r0, r1 []byte) []byte { return append(r1, r0...) }, nil, true},
+	}
+	for _, v := range cases {
+		t.Run(v.name, func(t *testing.T) {
+			key := &PSK{Key: []byte("secret")}
+			c, s, cErr, sErr := pskPair(t, key, key)
+			if cErr != nil || sErr != nil {
+				t.Fatal(cErr, sErr)
+			}
+
+			// 记录客户端发送的两条记录,不发送给服务端
+			raw := c.ReadWriteCloser
+			buf := new(bytes.Buffer)
+			c.ReadWriteCloser = struct {
+				io.Reader
+				io.Writer
+				io.Closer
+			}{raw, buf, raw}
+			c.Write([]byte("first"))
+			r0 := bytes.Clone(buf.Bytes())
+			buf.Reset()
+			c.Write([]byte("second"))
+			r1 := bytes.Clone(buf.Bytes())
+			if bytes.Contains(r0, []byte("first")) || bytes.Contains(r1, []byte("second")) {
+				t.Fatal("数据以明文传输")
+			}
+
+			go raw.Write(v.build(r0, r1))
+			s.ReadWriteCloser.(net.Conn).SetDeadline(time.Now().Add(5 * time.Second))
+			for _, want := range v.want {
+				p := make([]byte, 64)
+				n, err := s.Read(p)
+				if err != nil || string(p[:n]) != want {
+					t.Fatalf("预期%q,得到%q %v", want, p[:n], err)
+				}
+			}
+			if !v.fail {
+				return
+			}
+			if _, err := s.Read(make([]byte, 64)); !errors.Is(err, ErrDecrypt) {
+				t.Fatalf("预期 ErrDecrypt,得到 %v", err)
+			}
+		})
+	}
+}
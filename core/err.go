@@ -11,4 +11,52 @@ var (
 	ErrRemoteClose = errors.New("远程意外关闭连接")
 	// ErrDialInvalid 当拨号函数未设置或无效时返回此错误
 	ErrDialInvalid = errors.New("无效的连接函数")
+	// ErrSerialDenied 当对端请求打开未允许的本地串口设备时返回此错误,见 WithDialSerial
+	ErrSerialDenied = errors.New("不允许打开的串口设备")
+	// ErrTimeout 当等待对端响应超时时返回此错误
+	ErrTimeout = errors.New("超时")
+	// ErrFrameTooLarge 当数据包的长度超过允许的最大帧长度时返回此错误
+	ErrFrameTooLarge = errors.New("数据帧过长")
+	// ErrFrameInvalid 当数据帧的内容无法解析时返回此错误
+	ErrFrameInvalid = errors.New("数据帧格式错误")
+	// ErrFrameResync 当查找帧头时跳过的无效数据过多时返回此错误
+	ErrFrameResync = errors.New("数据帧同步失败")
+	// ErrChecksum 当数据包校验失败时返回此错误
+	ErrChecksum = errors.New("数据校验失败")
+	// ErrCompress 当收到压缩数据但未协商压缩算法时返回此错误
+	ErrCompress = errors.New("未启用压缩")
+	// ErrHandshake 当加密握手失败(例如密钥不一致)时返回此错误
+	ErrHandshake = errors.New("加密握手失败")
+	// ErrDecrypt 当加密数据认证失败(被篡改或密钥不一致)时返回此错误
+	ErrDecrypt = errors.New("数据解密失败")
+	// ErrWindow 当对端发送的数据超过虚拟IO的接收窗口时返回此错误
+	ErrWindow = errors.New("超出接收窗口")
+	// ErrHalfClose 当对端不支持半关闭时返回此错误
+	ErrHalfClose = errors.New("不支持半关闭")
+	// ErrHeartbeat 当连续多次心跳没有响应时返回此错误
+	ErrHeartbeat = errors.New("心跳超时")
+	// ErrGoAway 当隧道正在关闭(优雅关闭)时,拒绝建立新的连接并返回此错误
+	ErrGoAway = errors.New("隧道正在关闭")
+	// ErrResume 当会话恢复失败(会话已过期或数据编号不一致)时返回此错误
+	ErrResume = errors.New("会话恢复失败")
+	// ErrBond 当绑定的连接全部断开或绑定会话不存在时返回此错误
+	ErrBond = errors.New("绑定连接失败")
+	// ErrIdentity 当注册的标识和客户端证书的身份不一致时返回此错误
+	ErrIdentity = errors.New("证书身份不匹配")
+	// ErrAuth 当注册认证失败(例如账号密码错误)时返回此错误,可以在注册事件中返回或包装此错误
+	ErrAuth = errors.New("认证失败")
+	// ErrKicked 当隧道被服务端踢下线(例如相同标识的客户端重新注册)时返回此错误
+	ErrKicked = errors.New("被踢下线")
+	// ErrDial 当对端连接目标地址失败时返回此错误
+	ErrDial = errors.New("连接目标失败")
+	// ErrUnsupported 当消息类型无效或对端没有注册该类型的处理函数时返回此错误
+	ErrUnsupported = errors.New("不支持的消息类型")
+	// ErrMethod 当远程调用的方法名无效或对端没有注册该方法时返回此错误
+	ErrMethod = errors.New("方法不存在")
+	// ErrOffline 当调用的客户端不在线时返回此错误
+	ErrOffline = errors.New("客户端不在线")
+	// ErrBusy 当对端同时执行和排队的远程调用都达到上限时返回此错误,见 WithRPCConcurrency
+	ErrBusy = errors.New("对端繁忙")
+	// ErrListenDenied 当客户端注册时请求服务端未允许的监听配置(例如串口、证书文件)时返回此错误
+	ErrListenDenied = errors.New("不允许的监听配置")
 )
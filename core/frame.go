@@ -6,20 +6,28 @@ type Type uint8
 
 // 消息类型常量,定义隧道中传输的各种操作类型
 const (
-	Register Type = 0x00 // Register 注册消息,客户端向服务端注册身份
-	Open     Type = 0x01 // Open 打开连接,请求建立一条新的虚拟通道
-	Close    Type = 0x02 // Close 关闭连接,通知对端关闭某条虚拟通道
-	Read     Type = 0x03 // Read 读取数据,从虚拟IO中读取数据
-	Write    Type = 0x04 // Write 写入数据,向虚拟IO中写入数据
+	Register  Type = 0x00 // Register 注册消息,客户端向服务端注册身份
+	Open      Type = 0x01 // Open 打开连接,请求建立一条新的虚拟通道
+	Close     Type = 0x02 // Close 关闭连接,通知对端关闭某条虚拟通道
+	Read      Type = 0x03 // Read 读取数据,从虚拟IO中读取数据
+	Write     Type = 0x04 // Write 写入数据,向虚拟IO中写入数据
+	Window    Type = 0x05 // Window 窗口更新,接收方读取数据后归还对端的发送额度
+	HalfClose Type = 0x06 // HalfClose 半关闭,通知对端本端不再写入数据,仍然可以接收数据
+	Ping      Type = 0x07 // Ping 心跳,对端原样响应,用于检测对端是否存活和测量往返时间
+	GoAway    Type = 0x08 // GoAway 正在关闭隧道,通知对端不再建立新的虚拟IO
+	Cancel    Type = 0x09 // Cancel 取消请求,发起方放弃了等待中的连接请求,对端关闭已经建立的虚拟IO
+	Custom    Type = 0x0A // Custom 自定义消息,数据为 [自定义类型][数据],见 CustomType
+	RPC       Type = 0x0B // RPC 远程调用,数据为 [方法名长度][方法名][参数]
 )
 
 // 控制码常量,用于标识消息的方向和状态
 const (
-	Request  Tag = 0x00 // Request 请求包,由发起方发送
-	Response Tag = 0x80 // Response 响应包,由接收方回复
-	Success  Tag = 0x00 // Success 成功状态,仅用于响应包
-	Fail     Tag = 0x40 // Fail 失败状态,仅用于响应包
-	NeedAck  Tag = 0x20 // NeedAck 需要确认,请求包设置此标志表示需要对方回复
+	Request    Tag = 0x00 // Request 请求包,由发起方发送
+	Response   Tag = 0x80 // Response 响应包,由接收方回复
+	Success    Tag = 0x00 // Success 成功状态,仅用于响应包
+	Fail       Tag = 0x40 // Fail 失败状态,仅用于响应包
+	NeedAck    Tag = 0x20 // NeedAck 需要确认,请求包设置此标志表示需要对方回复
+	Compressed Tag = 0x10 // Compressed 数据已压缩,仅用于 Write 数据包
 )
 
 type Tag uint8
@@ -39,7 +47,38 @@ func (this Tag) NeedAck() bool {
 	return this&NeedAck == NeedAck
 }
 
+// Compressed 判断数据是否已压缩
+func (this Tag) Compressed() bool {
+	return this&Compressed == Compressed
+}
+
 type Frame interface {
 	NewPacket(msgID string, _type Type, tag Tag, data any) []byte
 	ReadPacket(r io.Reader) (msgID string, _type Type, tag Tag, data []byte, err error)
 }
+
+// NumericFrame 可选接口,帧协议只支持数字消息ID时实现
+// 隧道检测到此接口后,会使用自增的 uint32 分配消息ID和虚拟IO的标识
+type NumericFrame interface {
+	NumericID() bool
+}
+
+// LimitFrame 可选接口,支持限制最大帧长度的帧协议实现
+// 隧道检测到此接口后,会使用 WithMaxFrameSize 设置的长度读取数据包
+// max 为数据域的最大长度,0表示不限制
+type LimitFrame interface {
+	ReadPacketLimit(r io.Reader, max uint32) (msgID string, _type Type, tag Tag, data []byte, err error)
+}
+
+// AppendFrame 可选接口,支持将数据包编码追加到调用方的缓存中
+// 隧道检测到此接口后,发送时使用池化的缓存编码,减少内存分配
+type AppendFrame interface {
+	AppendPacket(dst []byte, msgID string, _type Type, tag Tag, data []byte) []byte
+}
+
+// BufferFrame 可选接口,支持使用调用方的缓存读取数据包
+// buf 的容量不足时会扩容,返回的 data 引用 buf 的内容,只在下次读取之前有效
+// max 为数据域的最大长度,0表示不限制
+type BufferFrame interface {
+	ReadPacketBuffer(r io.Reader, max uint32, buf *[]byte) (msgID string, _type Type, tag Tag, data []byte, err error)
+}
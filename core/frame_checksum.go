@@ -0,0 +1,107 @@
+package core
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+
+	"github.com/injoyai/conv"
+)
+
+// NewChecksumFrame 给帧协议增加 CRC32 校验
+// 发送时在负载数据末尾追加4字节的校验值(覆盖消息ID、控制码和数据)
+// 接收时校验失败返回 ErrChecksum,同时返回解析出的消息ID和类型,由隧道丢弃并通知对应的请求或虚拟IO
+// 任意实现了 Frame 接口的帧协议都可以使用,双方需同时启用,通常通过注册时协商 FeatureChecksum 启用
+func NewChecksumFrame(f Frame) Frame {
+	if _, ok := f.(*checksumFrame); ok {
+		return f
+	}
+	return &checksumFrame{Frame: f}
+}
+
+// checksumFrame 带 CRC32 校验的帧协议,包装已有的帧协议
+type checksumFrame struct {
+	Frame
+}
+
+// NumericID 实现 NumericFrame 接口,和被包装的帧协议保持一致
+func (this *checksumFrame) NumericID() bool {
+	f, ok := this.Frame.(NumericFrame)
+	return ok && f.NumericID()
+}
+
+func (this *checksumFrame) NewPacket(msgID string, _type Type, tag Tag, data any) []byte {
+	bs := conv.Bytes(data)
+	code := uint8(_type) | uint8(tag)
+	buf := make([]byte, len(bs), len(bs)+4)
+	copy(buf, bs)
+	buf = binary.BigEndian.AppendUint32(buf, this.sum(msgID, code, bs))
+	return this.Frame.NewPacket(msgID, _type, tag, buf)
+}
+
+// AppendPacket 实现 AppendFrame 接口,被包装的帧协议不支持时使用 NewPacket 编码
+func (this *checksumFrame) AppendPacket(dst []byte, msgID string, _type Type, tag Tag, data []byte) []byte {
+	f, ok := this.Frame.(AppendFrame)
+	if !ok {
+		return append(dst, this.NewPacket(msgID, _type, tag, data)...)
+	}
+	buf := getBuf()
+	defer putBuf(buf)
+	*buf = append(*buf, data...)
+	*buf = binary.BigEndian.AppendUint32(*buf, this.sum(msgID, uint8(_type)|uint8(tag), data))
+	return f.AppendPacket(dst, msgID, _type, tag, *buf)
+}
+
+func (this *checksumFrame) ReadPacket(r io.Reader) (msgID string, _type Type, tag Tag, data []byte, err error) {
+	msgID, _type, tag, data, err = this.Frame.ReadPacket(r)
+	return this.check(msgID, _type, tag, data, err)
+}
+
+// ReadPacketLimit 实现 LimitFrame 接口,被包装的帧协议不支持时忽略长度限制
+func (this *checksumFrame) ReadPacketLimit(r io.Reader, max uint32) (msgID string, _type Type, tag Tag, data []byte, err error) {
+	if f, ok := this.Frame.(LimitFrame); ok {
+		msgID, _type, tag, data, err = f.ReadPacketLimit(r, max)
+	} else {
+		msgID, _type, tag, data, err = this.Frame.ReadPacket(r)
+	}
+	return this.check(msgID, _type, tag, data, err)
+}
+
+// ReadPacketBuffer 实现 BufferFrame 接口,被包装的帧协议不支持时不使用 buf
+func (this *checksumFrame) ReadPacketBuffer(r io.Reader, max uint32, buf *[]byte) (msgID string, _type Type, tag Tag, data []byte, err error) {
+	f, ok := this.Frame.(BufferFrame)
+	if !ok {
+		return this.ReadPacketLimit(r, max)
+	}
+	msgID, _type, tag, data, err = f.ReadPacketBuffer(r, max, buf)
+	return this.check(msgID, _type, tag, data, err)
+}
+
+// check 校验并去掉负载数据末尾的校验值
+// 格式错误或长度超限的数据帧也按校验失败处理,读取位置已在帧头之后,下次读取会重新同步,
+// 适用于串口等可能出现干扰的线路
+func (this *checksumFrame) check(msgID string, _type Type, tag Tag, data []byte, err error) (string, Type, Tag, []byte, error) {
+	if errors.Is(err, ErrFrameInvalid) || errors.Is(err, ErrFrameTooLarge) {
+		return msgID, _type, tag, nil, fmt.Errorf("%w: %v", ErrChecksum, err)
+	}
+	if err != nil {
+		return msgID, _type, tag, data, err
+	}
+	if len(data) < 4 {
+		return msgID, _type, tag, nil, ErrChecksum
+	}
+	n := len(data) - 4
+	if binary.BigEndian.Uint32(data[n:]) != this.sum(msgID, uint8(_type)|uint8(tag), data[:n]) {
+		return msgID, _type, tag, nil, ErrChecksum
+	}
+	return msgID, _type, tag, data[:n], nil
+}
+
+// sum 计算消息ID、控制码和数据的 CRC32 校验值
+func (this *checksumFrame) sum(msgID string, code uint8, data []byte) uint32 {
+	crc := crc32.Update(0, crc32.IEEETable, []byte(msgID))
+	crc = crc32.Update(crc, crc32.IEEETable, []byte{code})
+	return crc32.Update(crc, crc32.IEEETable, data)
+}
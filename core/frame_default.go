@@ -2,6 +2,7 @@ package core
 
 import (
 	"bytes"
+	"encoding/binary"
 	"fmt"
 	"io"
 
@@ -10,113 +11,127 @@ import (
 
 var DefaultFrame Frame = &frameV1{}
 
+const (
+	DefaultMaxFrameSize = 4 << 20 // DefaultMaxFrameSize 默认的最大帧长度(数据域),防止恶意的长度字段导致分配过多内存
+	MinFrameSize        = 1 << 10 // MinFrameSize 允许设置的最小帧长度
+	frameOverhead       = 256     // frameOverhead 拆分数据时为消息ID和控制码预留的长度
+)
+
 // 帧协议常量
 const (
-	prefix    = 0x89 // FramePrefix1 帧头第一个字节
-	delimiter = '#'  // FrameDelimiter 帧内字段分隔符
+	prefix        = 0x89     // FramePrefix1 帧头第一个字节
+	delimiter     = '#'      // FrameDelimiter 帧内字段分隔符
+	maxResyncSize = 64 << 10 // maxResyncSize 查找帧头时最多跳过的字节数
 )
 
 type frameV1 struct{}
 
 func (this *frameV1) NewPacket(msgID string, _type Type, tag Tag, data any) []byte {
-	return packetV1{
-		MsgID: msgID,
-		Data:  conv.Bytes(data),
-		Code:  uint8(_type) | uint8(tag),
-	}.Bytes()
+	bs := conv.Bytes(data)
+	return this.AppendPacket(make([]byte, 0, len(bs)+len(msgID)+8), msgID, _type, tag, bs)
+}
+
+// AppendPacket 实现 AppendFrame 接口,将数据包编码追加到 dst
+// 格式: [0x89][0x89][长度4字节][MsgID][#][Code][Data]
+func (this *frameV1) AppendPacket(dst []byte, msgID string, _type Type, tag Tag, data []byte) []byte {
+	dst = append(dst, prefix, prefix)
+	dst = binary.BigEndian.AppendUint32(dst, uint32(len(msgID)+2+len(data)))
+	dst = append(dst, msgID...)
+	dst = append(dst, delimiter, uint8(_type)|uint8(tag))
+	return append(dst, data...)
 }
 
 func (this *frameV1) ReadPacket(r io.Reader) (msgID string, _type Type, tag Tag, data []byte, err error) {
-	data, err = this.read(r)
+	return this.ReadPacketLimit(r, DefaultMaxFrameSize)
+}
+
+// ReadPacketLimit 实现 LimitFrame 接口,读取数据域长度不超过 max 的数据包
+func (this *frameV1) ReadPacketLimit(r io.Reader, max uint32) (msgID string, _type Type, tag Tag, data []byte, err error) {
+	return this.ReadPacketBuffer(r, max, nil)
+}
+
+// ReadPacketBuffer 实现 BufferFrame 接口,buf 为空时每次分配新的缓存
+func (this *frameV1) ReadPacketBuffer(r io.Reader, max uint32, buf *[]byte) (msgID string, _type Type, tag Tag, data []byte, err error) {
+	data, err = readFrame(r, prefix, max, buf)
 	if err != nil {
 		return
 	}
-	var p *packetV1
-	p, err = this.decode(data)
+	var code uint8
+	msgID, code, data, err = this.decode(data)
 	if err != nil {
 		return
 	}
-	return p.MsgID, Type(p.Code & 0x0F), Tag(p.Code & 0xF0), p.Data, nil
+	return msgID, Type(code & 0x0F), Tag(code & 0xF0), data, nil
 }
 
-// Decode 将字节数组解码为数据包
-func (this *frameV1) decode(bs []byte) (*packetV1, error) {
+// decode 将数据域解码为消息ID、控制码和数据
+// 格式: [MsgID][#][Code][Data]
+func (this *frameV1) decode(bs []byte) (string, uint8, []byte, error) {
 	if len(bs) < 2 {
-		return nil, fmt.Errorf("基础长度错误,预期至少2字节,得到%d", len(bs))
+		return "", 0, nil, fmt.Errorf("%w: 基础长度错误,预期至少2字节,得到%d", ErrFrameInvalid, len(bs))
 	}
-	list := bytes.SplitN(bs, []byte{delimiter}, 2)
-	if len(list) != 2 {
-		return nil, fmt.Errorf("数据分割异常: %v", bs)
+	i := bytes.IndexByte(bs, delimiter)
+	if i < 0 {
+		return "", 0, nil, fmt.Errorf("%w: 数据分割异常: %v", ErrFrameInvalid, bs)
 	}
-	if len(list[1]) == 0 {
-		return nil, fmt.Errorf("数据类型异常: %v", bs)
+	if i+1 >= len(bs) {
+		return "", 0, nil, fmt.Errorf("%w: 数据类型异常: %v", ErrFrameInvalid, bs)
 	}
-	return &packetV1{
-		MsgID: string(list[0]),
-		Code:  list[1][0],
-		Data:  list[1][1:],
-	}, nil
+	return string(bs[:i]), bs[i+1], bs[i+2:], nil
 }
 
-// Read 从Reader中读取一帧完整数据
-// 帧格式: [0x89][0x89][长度4字节][数据域]
-// 通过循环查找帧头实现自动分包
-func (this *frameV1) read(r io.Reader) ([]byte, error) {
-
-	for {
+// readFrame 从Reader中读取一帧完整数据
+// 帧格式: [0x89][flag][长度4字节][数据域]
+// 帧头之前的无效数据会被逐字节跳过(重新同步),最多跳过 maxResyncSize 字节
+// max 为数据域的最大长度,0表示不限制
+// buf 不为空时复用其中的缓存,返回的数据引用 buf 的内容,为空时分配新的缓存
+func readFrame(r io.Reader, flag byte, max uint32, buf *[]byte) ([]byte, error) {
+	var bs []byte
+	if buf != nil {
+		bs = *buf
+	}
 
-		// 校验帧头标识 0x8989
-		bufPrefix := make([]byte, 2)
-		n, err := r.Read(bufPrefix)
-		if err != nil {
-			return nil, err
-		}
-		if n != 2 || bufPrefix[0] != prefix || bufPrefix[1] != prefix {
-			continue
+	// 校验帧头标识 0x89{flag}
+	head := grow(bs, 6)
+	if _, err := io.ReadFull(r, head[:2]); err != nil {
+		return nil, err
+	}
+	for skip := 0; head[0] != prefix || head[1] != flag; skip++ {
+		if skip >= maxResyncSize {
+			return nil, ErrFrameResync
 		}
-
-		// 读取数据域长度(4字节)
-		bufLength := make([]byte, 4)
-		n, err = r.Read(bufLength)
-		if err != nil {
+		head[0] = head[1]
+		if _, err := io.ReadFull(r, head[1:2]); err != nil {
 			return nil, err
 		}
-		if n != 4 {
-			continue
-		}
-		length := conv.Int64(bufLength)
+	}
 
-		// 读取数据域
-		bufData := make([]byte, length)
-		n, err = io.ReadAtLeast(r, bufData, int(length))
-		if err != nil {
-			return nil, err
-		}
-		if int64(n) != length {
-			continue
-		}
+	// 读取数据域长度(4字节)
+	if _, err := io.ReadFull(r, head[2:6]); err != nil {
+		return nil, err
+	}
+	length := binary.BigEndian.Uint32(head[2:6])
+	if max > 0 && length > max {
+		// 无法判断后续数据的边界,不能继续同步
+		return nil, fmt.Errorf("%w: %d > %d", ErrFrameTooLarge, length, max)
+	}
 
-		return bufData, nil
+	// 读取数据域,帧头已经解析完成,可以覆盖
+	bufData := grow(head, int(length))
+	if buf != nil {
+		*buf = bufData[:0]
+	}
+	if _, err := io.ReadFull(r, bufData); err != nil {
+		return nil, err
 	}
-}
 
-type packetV1 struct {
-	MsgID string // MsgID 消息唯一标识,用于关联请求和响应
-	Data  []byte // Data 负载数据
-	Code  uint8  // Code 控制码,包含消息类型、方向、状态等信息
+	return bufData, nil
 }
 
-// Bytes 将数据包序列化为字节数组
-// 格式: [0x89][0x89][长度4字节][MsgID][#][Code][Data]
-func (this packetV1) Bytes() []byte {
-	lenData := len(this.Data)
-	lenKey := len(this.MsgID)
-	bs := make([]byte, len(this.Data)+lenKey+8)
-	copy(bs[0:2], []byte{prefix, prefix})
-	copy(bs[2:6], conv.Bytes(uint32(lenKey+2+lenData)))
-	copy(bs[6:len(this.MsgID)+6], this.MsgID)
-	bs[lenKey+6] = delimiter
-	bs[lenKey+7] = this.Code
-	copy(bs[lenKey+8:], this.Data)
-	return bs
+// grow 返回长度为 n 的缓存,容量足够时复用 bs
+func grow(bs []byte, n int) []byte {
+	if cap(bs) >= n {
+		return bs[:n]
+	}
+	return make([]byte, n)
 }
@@ -0,0 +1,200 @@
+package core
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fuzzMaxFrame 模糊测试使用的最大帧长度,较小的值更容易触发超长的错误
+const fuzzMaxFrame = MinFrameSize
+
+// frameSeeds 模糊测试的种子: 完整的数据帧、截断的数据帧、超长的长度字段和帧头之前的无效数据
+func frameSeeds() [][]byte {
+	v1 := DefaultFrame.(AppendFrame)
+	v2 := FrameV2.(AppendFrame)
+	good1 := v1.AppendPacket(nil, "6ba7b810-9dad-11d1-80b4-00c04fd430c8", Write, Request, []byte("hello"))
+	good2 := v2.AppendPacket(nil, "42", Open, Request|NeedAck, []byte(`{"type":"tcp"}`))
+	resp2 := v2.AppendPacket(nil, "7", Write, Response|Fail, nil)
+
+	oversize := []byte{prefix, prefix, 0xFF, 0xFF, 0xFF, 0xFF, 'a', '#', 4}
+	oversize2 := []byte{prefix, prefixV2, 0x7F, 0xFF, 0xFF, 0xFF, 0, 0, 0, 1, 4}
+	junk := []byte{0x00, 0x89, 0x13, 0x89, 0x89 - 1, 0xFF, 0x37}
+
+	return [][]byte{
+		good1,
+		good2,
+		resp2,
+		append(append([]byte{}, good1...), good2...),
+		good1[:len(good1)-3],
+		good2[:4],
+		{prefix},
+		{prefix, prefix, 0, 0, 0, 1, '#'},
+		{prefix, prefixV2, 0, 0, 0, 2, 0, 0},
+		{prefix, prefix, 0, 0, 0, 3, 'a', 'b', 'c'},
+		oversize,
+		oversize2,
+		append(append([]byte{}, junk...), good1...),
+		append(append([]byte{}, junk...), good2...),
+		append(bytes.Repeat([]byte{prefix}, 32), good2...),
+		append(append([]byte{}, oversize...), good1...),
+		[]byte(strings.Repeat("GET / HTTP/1.1\r\n", 8)),
+	}
+}
+
+// countReader 统计已经读取的字节数
+type countReader struct {
+	r io.Reader
+	n int
+}
+
+func (this *countReader) Read(p []byte) (int, error) {
+	n, err := this.r.Read(p)
+	this.n += n
+	return n, err
+}
+
+// FuzzReadPacket 任意输入都不能导致崩溃,读取的数据不能超过最大帧长度,
+// 每次读取跳过的无效数据不能超过 maxResyncSize,成功读取的数据包重新编码后能得到相同的结果
+func FuzzReadPacket(f *testing.F) {
+	for _, seed := range frameSeeds() {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		for _, frame := range []Frame{DefaultFrame, FrameV2} {
+			r := &countReader{r: bytes.NewReader(data)}
+			var buf []byte
+			for {
+				before := r.n
+				msgID, _type, tag, bs, err := frame.(BufferFrame).ReadPacketBuffer(r, fuzzMaxFrame, &buf)
+				// 帧头(2字节)+跳过的数据+长度(4字节)+数据域
+				if read := r.n - before; read > 2+maxResyncSize+4+fuzzMaxFrame {
+					t.Fatalf("一次读取了%d字节,超过了限制", read)
+				}
+				if cap(buf) > fuzzMaxFrame && cap(buf) > 6 {
+					t.Fatalf("缓存容量%d超过了最大帧长度%d", cap(buf), fuzzMaxFrame)
+				}
+				if err != nil {
+					if errors.Is(err, ErrFrameTooLarge) || errors.Is(err, ErrFrameResync) {
+						// 无法继续同步,隧道会关闭
+						break
+					}
+					if errors.Is(err, ErrFrameInvalid) {
+						continue
+					}
+					if err != io.EOF && err != io.ErrUnexpectedEOF {
+						t.Fatalf("未知的错误: %v", err)
+					}
+					break
+				}
+				if len(bs) > fuzzMaxFrame {
+					t.Fatalf("数据长度%d超过了最大帧长度%d", len(bs), fuzzMaxFrame)
+				}
+				packet := frame.(AppendFrame).AppendPacket(nil, msgID, _type, tag, bs)
+				msgID2, _type2, tag2, bs2, err := frame.ReadPacket(bytes.NewReader(packet))
+				if err != nil || msgID2 != msgID || _type2 != _type || tag2 != tag || !bytes.Equal(bs2, bs) {
+					t.Fatalf("重新编码后结果不一致: %q %d %d %x => %q %d %d %x %v", msgID, _type, tag, bs, msgID2, _type2, tag2, bs2, err)
+				}
+			}
+		}
+	})
+}
+
+// FuzzDecode 任意数据域都不能导致崩溃,解码成功时重新编码能得到原始的数据域
+func FuzzDecode(f *testing.F) {
+	for _, seed := range frameSeeds() {
+		if len(seed) > 6 {
+			f.Add(seed[6:])
+		}
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, bs []byte) {
+		msgID, code, data, err := (&frameV1{}).decode(bs)
+		if err != nil {
+			if !errors.Is(err, ErrFrameInvalid) {
+				t.Fatalf("未知的错误: %v", err)
+			}
+			return
+		}
+		if strings.IndexByte(msgID, delimiter) >= 0 {
+			t.Fatalf("消息ID包含分隔符: %q", msgID)
+		}
+		packet := (&frameV1{}).AppendPacket(nil, msgID, Type(code&0x0F), Tag(code&0xF0), data)
+		if binary.BigEndian.Uint32(packet[2:6]) != uint32(len(bs)) || !bytes.Equal(packet[6:], bs) {
+			t.Fatalf("重新编码后结果不一致: %x => %x", bs, packet[6:])
+		}
+	})
+}
+
+// TestReadPacketResync 帧头之前的无效数据不超过 maxResyncSize 时能重新同步,超过时返回 ErrFrameResync
+func TestReadPacketResync(t *testing.T) {
+	for _, frame := range []Frame{DefaultFrame, FrameV2} {
+		good := frame.NewPacket("1", Write, Request, "data")
+
+		stream := append(bytes.Repeat([]byte{0x00}, maxResyncSize), good...)
+		if _, _, _, data, err := frame.ReadPacket(bytes.NewReader(stream)); err != nil || string(data) != "data" {
+			t.Fatalf("重新同步失败: %q %v", data, err)
+		}
+
+		stream = append(bytes.Repeat([]byte{0x00}, maxResyncSize+1), good...)
+		if _, _, _, _, err := frame.ReadPacket(bytes.NewReader(stream)); !errors.Is(err, ErrFrameResync) {
+			t.Fatalf("预期 ErrFrameResync,得到 %v", err)
+		}
+
+		oversize := []byte{prefix, good[1], 0xFF, 0xFF, 0xFF, 0xFF}
+		if _, _, _, _, err := frame.(LimitFrame).ReadPacketLimit(bytes.NewReader(oversize), fuzzMaxFrame); !errors.Is(err, ErrFrameTooLarge) {
+			t.Fatalf("预期 ErrFrameTooLarge,得到 %v", err)
+		}
+	}
+}
+
+// TestChecksumCorrupted 校验失败的数据包被丢弃并计数,隧道继续处理后续的数据包
+func TestChecksumCorrupted(t *testing.T) {
+	cases := []struct {
+		name    string
+		corrupt func(p []byte) // corrupt 修改编码后的数据包,nil表示不修改
+		want    uint64         // want 预期增加的校验失败数量
+	}{
+		{"正常数据", nil, 0},
+		{"数据被修改", func(p []byte) { p[len(p)-5] ^= 0x01 }, 1},
+		{"校验值被修改", func(p []byte) { p[len(p)-1] ^= 0x80 }, 1},
+		{"控制码被修改", func(p []byte) { p[len(p)-9] ^= 0x02 }, 1},
+		{"长度字段被修改", func(p []byte) { p[5]-- }, 1},
+	}
+	for _, frame := range benchFrames {
+		for _, v := range cases {
+			t.Run(frame.name+"/"+v.name, func(t *testing.T) {
+				f := NewChecksumFrame(frame.frame)
+				c1, c2 := net.Pipe()
+				tun := NewTunnel(c1, WithFrame(f))
+				defer tun.Close()
+				go tun.Run()
+
+				// 不需要响应的心跳,校验失败时不会有任何响应
+				p := f.NewPacket("1", Ping, Request, "data")
+				if v.corrupt != nil {
+					v.corrupt(p)
+				}
+				// 紧接着一个需要响应的心跳,收到响应说明之前的数据包已经处理
+				p = append(p, f.NewPacket("2", Ping, Request|NeedAck, "sync")...)
+				go c2.Write(p)
+				c2.SetReadDeadline(time.Now().Add(5 * time.Second))
+				msgID, _, tag, data, err := f.ReadPacket(c2)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if msgID != "2" || tag.IsRequest() || string(data) != "sync" {
+					t.Fatalf("响应错误: %s %d %q", msgID, tag, data)
+				}
+				if got := tun.Corrupted(); got != v.want {
+					t.Fatalf("预期校验失败%d个,得到%d个", v.want, got)
+				}
+			})
+		}
+	}
+}
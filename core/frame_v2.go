@@ -0,0 +1,74 @@
+package core
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"strconv"
+
+	"github.com/injoyai/conv"
+)
+
+// FrameV2 紧凑型帧协议,使用固定长度的数字消息ID
+// 适用于小包频繁、流量敏感的场景(例如按流量计费的蜂窝网络)
+var FrameV2 Frame = &frameV2{}
+
+// 帧协议常量
+const (
+	prefixV2     = 0x8A // prefixV2 V2帧头第二个字节
+	headerV2Size = 5    // headerV2Size 数据域的固定头部长度(消息ID4字节+控制码1字节)
+)
+
+/*
+frameV2 紧凑型帧协议
+帧格式: [0x89][0x8A][长度4字节][MsgID4字节][Code][Data]
+相比 frameV1 去掉了36字节的UUID和分隔符,解析时无需查找分隔符
+消息ID必须是 uint32 范围内的数字字符串,隧道会自动分配
+*/
+type frameV2 struct{}
+
+// NumericID 实现 NumericFrame 接口,告知隧道使用数字消息ID
+func (this *frameV2) NumericID() bool {
+	return true
+}
+
+func (this *frameV2) NewPacket(msgID string, _type Type, tag Tag, data any) []byte {
+	bs := conv.Bytes(data)
+	return this.AppendPacket(make([]byte, 0, len(bs)+headerV2Size+6), msgID, _type, tag, bs)
+}
+
+// AppendPacket 实现 AppendFrame 接口,将数据包编码追加到 dst
+// 格式: [0x89][0x8A][长度4字节][MsgID4字节][Code][Data]
+func (this *frameV2) AppendPacket(dst []byte, msgID string, _type Type, tag Tag, data []byte) []byte {
+	//非数字的消息ID会被编码为0,由隧道负责分配合法的ID
+	id, _ := strconv.ParseUint(msgID, 10, 32)
+	dst = append(dst, prefix, prefixV2)
+	dst = binary.BigEndian.AppendUint32(dst, uint32(len(data)+headerV2Size))
+	dst = binary.BigEndian.AppendUint32(dst, uint32(id))
+	dst = append(dst, uint8(_type)|uint8(tag))
+	return append(dst, data...)
+}
+
+func (this *frameV2) ReadPacket(r io.Reader) (msgID string, _type Type, tag Tag, data []byte, err error) {
+	return this.ReadPacketLimit(r, DefaultMaxFrameSize)
+}
+
+// ReadPacketLimit 实现 LimitFrame 接口,读取数据域长度不超过 max 的数据包
+func (this *frameV2) ReadPacketLimit(r io.Reader, max uint32) (msgID string, _type Type, tag Tag, data []byte, err error) {
+	return this.ReadPacketBuffer(r, max, nil)
+}
+
+// ReadPacketBuffer 实现 BufferFrame 接口,buf 为空时每次分配新的缓存
+func (this *frameV2) ReadPacketBuffer(r io.Reader, max uint32, buf *[]byte) (msgID string, _type Type, tag Tag, data []byte, err error) {
+	data, err = readFrame(r, prefixV2, max, buf)
+	if err != nil {
+		return
+	}
+	if len(data) < headerV2Size {
+		err = fmt.Errorf("%w: 基础长度错误,预期至少%d字节,得到%d", ErrFrameInvalid, headerV2Size, len(data))
+		return
+	}
+	code := data[4]
+	msgID = strconv.FormatUint(uint64(binary.BigEndian.Uint32(data[0:4])), 10)
+	return msgID, Type(code & 0x0F), Tag(code & 0xF0), data[headerV2Size:], nil
+}
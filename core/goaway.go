@@ -0,0 +1,59 @@
+package core
+
+import (
+	"context"
+)
+
+// Shutdown 优雅关闭隧道
+// 通知对端(GoAway)不再建立新的虚拟IO,拒绝对端新的连接请求,等待已有的虚拟IO结束后关闭隧道,
+// ctx 结束时立即关闭隧道并返回 ctx 的错误
+func (this *Tunnel) Shutdown(ctx context.Context) error {
+	this.drain()
+	this.WritePacket(this.newID(""), GoAway, Request, nil) //可忽略错误
+	for {
+		this.ioMu.RLock()
+		n := len(this.ioMap)
+		this.ioMu.RUnlock()
+		if n == 0 {
+			this.CloseWithErr(ErrGoAway)
+			return nil
+		}
+		select {
+		case <-this.ioClosed:
+		case <-this.Done():
+			return nil
+		case <-ctx.Done():
+			this.CloseWithErr(ctx.Err())
+			return ctx.Err()
+		}
+	}
+}
+
+// Draining 隧道正在关闭(本端调用了 Shutdown 或收到对端的 GoAway)时关闭的通道
+// 此时不能再建立新的虚拟IO,已有的虚拟IO不受影响
+func (this *Tunnel) Draining() <-chan struct{} {
+	return this.draining
+}
+
+// drain 标记隧道正在关闭,可以重复调用
+func (this *Tunnel) drain() {
+	this.drainOnce.Do(func() { close(this.draining) })
+}
+
+// isDraining 隧道是否正在关闭
+func (this *Tunnel) isDraining() bool {
+	select {
+	case <-this.draining:
+		return true
+	default:
+		return false
+	}
+}
+
+// Kick 通知对端关闭的原因后立即关闭隧道,例如 ErrKicked,
+// 对端的隧道会以该原因关闭,可以通过 Temporary 判断是否需要重连
+func (this *Tunnel) Kick(err error) error {
+	this.drain()
+	this.WritePacket(this.newID(""), GoAway, Request, encodeError(err, this.Negotiated().HasFeature(FeatureErrorCode))) //可忽略错误
+	return this.CloseWithErr(err)
+}
@@ -0,0 +1,87 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"io"
+	"testing"
+	"time"
+)
+
+// TestShutdownDrain 优雅关闭时通知对端(GoAway)不再建立连接,已有的虚拟IO继续使用,全部结束后关闭隧道
+func TestShutdownDrain(t *testing.T) {
+	s, c := newTestPair(t, []TunnelOption{WithDial(echoDial)}, nil)
+	i, err := c.Dial(&Dial{Type: TCP, Address: "echo"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- s.Shutdown(context.Background()) }()
+	select {
+	case <-c.Draining():
+	case <-time.After(5 * time.Second):
+		t.Fatal("没有收到 GoAway")
+	}
+
+	// 不再建立新的连接,对端收到 GoAway 前发送的请求也会被拒绝
+	if _, err := c.Dial(&Dial{Type: TCP, Address: "echo"}, nil); !errors.Is(err, ErrGoAway) {
+		t.Fatalf("预期 ErrGoAway,得到 %v", err)
+	}
+	if _, _, err := s.dealOpen("open", []byte(`{"type":"tcp","address":"echo"}`)); !errors.Is(err, ErrGoAway) {
+		t.Fatalf("预期 ErrGoAway,得到 %v", err)
+	}
+
+	// 已有的虚拟IO继续使用
+	go i.Write([]byte("hello"))
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(i, buf); err != nil || string(buf) != "hello" {
+		t.Fatalf("关闭期间虚拟IO不可用: %q %v", buf, err)
+	}
+	select {
+	case err := <-done:
+		t.Fatalf("虚拟IO还在使用时关闭了隧道: %v", err)
+	default:
+	}
+
+	i.Close()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("虚拟IO结束后没有关闭隧道")
+	}
+	if !errors.Is(s.Err(), ErrGoAway) {
+		t.Fatalf("预期以 ErrGoAway 关闭,得到 %v", s.Err())
+	}
+}
+
+// TestShutdownTimeout ctx 结束时立即关闭隧道和剩余的虚拟IO
+func TestShutdownTimeout(t *testing.T) {
+	s, c := newTestPair(t, []TunnelOption{WithDial(echoDial)}, nil)
+	i, err := c.Dial(&Dial{Type: TCP, Address: "echo"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := s.Shutdown(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("预期 context.DeadlineExceeded,得到 %v", err)
+	}
+	done := make(chan error, 1)
+	go func() {
+		_, err := i.Read(make([]byte, 1))
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Fatal("虚拟IO没有被关闭")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("虚拟IO没有被关闭")
+	}
+}
@@ -0,0 +1,72 @@
+package core
+
+import (
+	"context"
+
+	"github.com/injoyai/conv"
+)
+
+// CustomType 自定义消息的类型,由应用定义,0~255都可以使用
+// 自定义消息使用内置的消息类型 Custom 传输,数据为 [自定义类型(1字节)][数据],
+// 帧协议中的消息类型只有4位,不直接分配给应用,留给以后的内置类型
+type CustomType uint8
+
+// Handler 自定义消息的处理函数,data 为对端发送的数据
+// 返回值作为响应发送给对端(对端需要响应时),返回错误时对端收到失败的响应
+// 在隧道的读取协程中同步执行,执行期间隧道不会读取任何数据包,所有虚拟IO的数据、控制消息和心跳都会被阻塞,
+// 阻塞时间过长会导致对端心跳超时并关闭隧道,耗时的处理需要自行开启协程(不需要响应时),或使用远程调用(HandleMethod)
+type Handler func(tun *Tunnel, data []byte) (any, error)
+
+// Handle 注册自定义消息类型的处理函数,handler 为nil时取消注册
+// 对端需要注册后才能发送自定义消息,未注册处理函数的消息返回 ErrUnsupported
+// handler 会阻塞隧道的读取,不能执行耗时的操作,见 Handler
+func (this *Tunnel) Handle(_type CustomType, handler Handler) {
+	this.handlerMu.Lock()
+	defer this.handlerMu.Unlock()
+	if handler == nil {
+		delete(this.handlers, _type)
+		return
+	}
+	this.handlers[_type] = handler
+}
+
+// Request 向对端发送自定义消息并等待响应,返回对端处理函数的返回值
+func (this *Tunnel) Request(_type CustomType, data any) ([]byte, error) {
+	return this.RequestContext(context.Background(), _type, data)
+}
+
+// RequestContext 向对端发送自定义消息并等待响应,ctx 结束时放弃等待并返回 ctx 的错误
+func (this *Tunnel) RequestContext(ctx context.Context, _type CustomType, data any) ([]byte, error) {
+	resp, err := this.requestContext(ctx, this.timeout, this.newID(""), Custom, customPayload(_type, data))
+	if err != nil {
+		return nil, err
+	}
+	return conv.Bytes(resp), nil
+}
+
+// Send 向对端发送自定义消息,不等待响应
+func (this *Tunnel) Send(_type CustomType, data any) error {
+	return this.WritePacket(this.newID(""), Custom, Request, customPayload(_type, data))
+}
+
+// customPayload 编码自定义消息的数据,第一个字节为自定义类型
+func customPayload(_type CustomType, data any) []byte {
+	bs := conv.Bytes(data)
+	payload := make([]byte, 0, 1+len(bs))
+	payload = append(payload, byte(_type))
+	return append(payload, bs...)
+}
+
+// dealCustom 处理自定义消息,数据为 [自定义类型][数据]
+func (this *Tunnel) dealCustom(data []byte) (any, error) {
+	if len(data) == 0 {
+		return nil, ErrUnsupported
+	}
+	this.handlerMu.RLock()
+	handler := this.handlers[CustomType(data[0])]
+	this.handlerMu.RUnlock()
+	if handler == nil {
+		return nil, ErrUnsupported
+	}
+	return handler(this, data[1:])
+}
@@ -0,0 +1,54 @@
+package core
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+// TestCustomMessage 注册处理函数后可以收发自定义消息,未注册的类型返回 ErrUnsupported
+func TestCustomMessage(t *testing.T) {
+	const (
+		cmdEcho   CustomType = 1
+		cmdNotify CustomType = 255
+		cmdNone   CustomType = 2
+	)
+	notified := make(chan string, 1)
+	s, c := newTestPair(t, []TunnelOption{
+		WithHandler(cmdEcho, func(tun *Tunnel, data []byte) (any, error) {
+			return "echo:" + string(data), nil
+		}),
+		WithHandler(cmdNotify, func(tun *Tunnel, data []byte) (any, error) {
+			notified <- string(data)
+			return nil, nil
+		}),
+	}, nil)
+
+	resp, err := c.Request(cmdEcho, "hello")
+	if err != nil || string(resp) != "echo:hello" {
+		t.Fatalf("响应不一致: %q %v", resp, err)
+	}
+	if err := c.Send(cmdNotify, "reboot"); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case s := <-notified:
+		if s != "reboot" {
+			t.Fatalf("收到的数据不一致: %q", s)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("没有收到自定义消息")
+	}
+
+	if _, err := c.Request(cmdNone, "x"); !errors.Is(err, ErrUnsupported) {
+		t.Fatalf("预期 ErrUnsupported,得到 %v", err)
+	}
+	// 取消注册后同样返回 ErrUnsupported
+	s.Handle(cmdEcho, nil)
+	if _, err := c.Request(cmdEcho, "x"); !errors.Is(err, ErrUnsupported) {
+		t.Fatalf("预期 ErrUnsupported,得到 %v", err)
+	}
+	if c.Closed() || s.Closed() {
+		t.Fatal("不支持的消息关闭了隧道")
+	}
+}
@@ -0,0 +1,75 @@
+package core
+
+import (
+	"time"
+
+	"github.com/injoyai/logs"
+)
+
+const (
+	// DefaultHeartbeat 默认的心跳间隔
+	DefaultHeartbeat = time.Second * 30
+	// DefaultHeartbeatMiss 默认连续多少次心跳没有响应时关闭隧道
+	DefaultHeartbeatMiss = 3
+)
+
+// Ping 向对端发送心跳并等待响应,返回本次的往返时间,同时更新平滑往返时间
+// 等待时间为心跳间隔,未启用心跳时使用等待响应的超时时间
+func (this *Tunnel) Ping() (time.Duration, error) {
+	timeout := this.heartbeat
+	if timeout <= 0 {
+		timeout = this.timeout
+	}
+	start := time.Now()
+	if _, err := this.requestTimeout(timeout, this.newID(""), Ping, nil); err != nil {
+		return 0, err
+	}
+	rtt := time.Since(start)
+	// 和tcp一样使用 1/8 的权重平滑
+	if srtt := this.rtt.Load(); srtt == 0 {
+		this.rtt.Store(int64(rtt))
+	} else {
+		this.rtt.Store(srtt + (int64(rtt)-srtt)/8)
+	}
+	return rtt, nil
+}
+
+// RTT 获取心跳测量的平滑往返时间,还没有测量时返回0
+func (this *Tunnel) RTT() time.Duration {
+	return time.Duration(this.rtt.Load())
+}
+
+// LastReceived 获取最后一次收到对端数据包的时间
+func (this *Tunnel) LastReceived() time.Time {
+	return time.Unix(0, this.lastRecv.Load())
+}
+
+// keepalive 心跳协程,定时发送心跳,连续多次没有响应时关闭隧道
+// 心跳期间收到过对端的其他数据包时不算丢失,对端可能在忙于处理数据
+func (this *Tunnel) keepalive() {
+	ticker := time.NewTicker(this.heartbeat)
+	defer ticker.Stop()
+	missed := 0
+	for {
+		select {
+		case <-this.Done():
+			return
+		case <-ticker.C:
+		}
+		start := time.Now().UnixNano()
+		_, err := this.Ping()
+		switch {
+		case this.Closed():
+			return
+		case err == nil, this.lastRecv.Load() > start:
+			missed = 0
+			continue
+		}
+		missed++
+		logs.Tracef("[%s] 心跳没有响应(%d/%d): %v\n", this.Key(), missed, this.heartbeatMiss, err)
+		if missed >= this.heartbeatMiss {
+			this.CloseWithErr(ErrHeartbeat)
+			return
+		}
+	}
+}
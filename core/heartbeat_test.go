@@ -0,0 +1,86 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// muteConn 静默后丢弃写入的数据,模拟对端没有断开但不再响应
+type muteConn struct {
+	net.Conn
+	mute atomic.Bool
+}
+
+func (this *muteConn) Write(p []byte) (int, error) {
+	if this.mute.Load() {
+		return len(p), nil
+	}
+	return this.Conn.Write(p)
+}
+
+// TestHeartbeatMiss 心跳测量往返时间,对端连续多次没有响应时以 ErrHeartbeat 关闭隧道
+func TestHeartbeatMiss(t *testing.T) {
+	c1, c2 := net.Pipe()
+	mute := &muteConn{Conn: c1}
+	s := NewTunnel(mute, WithKey("server"), WithRegister(acceptRegister))
+	c := NewTunnel(c2, WithKey("client"), WithHeartbeat(20*time.Millisecond, 3))
+	t.Cleanup(func() {
+		c.Close()
+		s.Close()
+	})
+	go s.Run()
+	go c.Run()
+	if _, err := c.Register(&RegisterReq{Key: "client"}); err != nil {
+		t.Fatal(err)
+	}
+
+	waitFor(t, "没有测量往返时间", func() bool { return c.RTT() > 0 })
+	if rtt := c.RTT(); rtt > time.Second {
+		t.Fatalf("往返时间不正确: %v", rtt)
+	}
+
+	mute.mute.Store(true)
+	start := time.Now()
+	select {
+	case <-c.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("心跳没有响应时没有关闭隧道")
+	}
+	if !errors.Is(c.Err(), ErrHeartbeat) {
+		t.Fatalf("预期 ErrHeartbeat,得到 %v", c.Err())
+	}
+	if d := time.Since(start); d < 40*time.Millisecond {
+		t.Fatalf("没有等待多次心跳就关闭了隧道: %v", d)
+	}
+}
+
+// TestHeartbeatSlowDial 建立连接耗时较长(例如目标不可达)时,不影响隧道响应心跳和其他请求
+func TestHeartbeatSlowDial(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	_, c := newTestPair(t, []TunnelOption{WithDial(func(d *Dial) (io.ReadWriteCloser, string, error) {
+		if d.Address == "echo" {
+			return echoDial(d)
+		}
+		<-release
+		return nil, "", ErrTimeout
+	})}, []TunnelOption{WithHeartbeat(20*time.Millisecond, 3)})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+	if _, err := c.DialContext(ctx, &Dial{Type: TCP, Address: "blackhole"}, nil); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("预期 context.DeadlineExceeded,得到 %v", err)
+	}
+	if c.Closed() {
+		t.Fatalf("建立连接期间隧道被关闭: %v", c.Err())
+	}
+	if c.RTT() <= 0 {
+		t.Fatal("建立连接期间没有响应心跳")
+	}
+	testEcho(t, c, []byte("hello"))
+}
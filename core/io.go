@@ -3,13 +3,22 @@ package core
 
 import (
 	"io"
+	"sync"
+	"sync/atomic"
 
-	"github.com/injoyai/base/chans"
 	"github.com/injoyai/base/safe"
 )
 
-// 编译期检查 IO 是否实现了 io.ReadWriteCloser 接口
-var _ io.ReadWriteCloser = (*IO)(nil)
+// 编译期检查 IO 是否实现了 io.ReadWriteCloser、io.WriterTo、io.ReaderFrom 和 CloseWriter 接口
+var (
+	_ io.ReadWriteCloser = (*IO)(nil)
+	_ CloseWriter        = (*IO)(nil)
+	_ io.WriterTo        = (*IO)(nil)
+	_ io.ReaderFrom      = (*IO)(nil)
+)
+
+// ioQueueSize 未启用流量控制时,虚拟IO缓存的未读数据块数量
+const ioQueueSize = 20
 
 // IOOption IO 的配置函数类型
 type IOOption func(v *IO)
@@ -19,18 +28,20 @@ type IOOption func(v *IO)
 // op 是可选的配置函数,用于设置 OnWrite 和 OnClose 等回调
 func NewIO(w io.Writer, op ...IOOption) *IO {
 	i := &IO{
-		writer: w,
-		reader: chans.NewIO(20),
-		Closer: safe.NewCloser(),
+		writer:   w,
+		readable: make(chan struct{}, 1),
+		writable: make(chan struct{}, 1),
+		Closer:   safe.NewCloser(),
 	}
 	for _, v := range op {
 		v(i)
 	}
 	i.SetCloseFunc(func(error) error {
+		i.drop()
 		if i.OnClose != nil {
 			return i.OnClose(i, i.Err())
 		}
-		return i.reader.Close()
+		return nil
 	})
 	return i
 }
@@ -39,32 +50,248 @@ func NewIO(w io.Writer, op ...IOOption) *IO {
 // 每个IO代表一条独立的虚拟通道,多条IO可以复用同一条物理隧道连接
 // 数据流向:
 //   - 写入: 调用 Write() -> OnWrite回调 -> 打包 -> 通过writer发送到隧道
-//   - 读取: 对端数据通过 ToRead() 写入 -> reader缓冲 -> 调用 Read() 读取
+//   - 读取: 对端数据通过 ToRead() 写入 -> 缓存队列 -> 调用 Read() 读取 -> OnRead回调
 type IO struct {
 	writer       io.Writer                    // writer 虚拟(公共)写入通道,即隧道连接
-	reader       *chans.IO                    // reader 虚拟读取通道,带缓冲
+	mu           sync.Mutex                   // mu 保护缓存队列
+	queue        []*[]byte                    // queue 缓存的未读数据块,使用池化的缓存
+	head         int                          // head queue 中第一个未读数据块的位置
+	buffered     int                          // buffered 未读数据的长度,包括 cache 中未读完的部分
+	dropped      bool                         // dropped 关闭时已丢弃未读数据,不再接收数据
+	eof          bool                         // eof 对端已半关闭,读取完缓存的数据后返回 io.EOF
+	closeErr     error                        // closeErr 对端已关闭,读取完缓存的数据后使用此错误关闭
+	wClosed      atomic.Bool                  // wClosed 本端已半关闭,不能再写入数据
+	readable     chan struct{}                // readable 有新数据时通知 Read
+	writable     chan struct{}                // writable 数据块被取出时通知阻塞的 ToRead
+	window       int                          // window 接收窗口,大于0时 ToRead 不阻塞,未读数据超过窗口时关闭IO
+	shared       *atomic.Int64                // shared 可选,同一隧道所有虚拟IO未读数据的总长度
+	unacked      int                          // unacked 已读取但还未归还对端的窗口,由隧道维护
+	credit       *sendWindow                  // credit 发送窗口,为nil时不限制,由隧道维护
+	openID       string                       // openID 对端建立连接请求的消息ID,用于对端取消请求,由隧道维护
+	cache        *[]byte                      // cache 当前未读完的数据块
+	offset       int                          // offset 当前数据块已读取的长度
 	*safe.Closer                              // Closer 安全关闭控制器
 	OnWrite      func([]byte) ([]byte, error) // OnWrite 写入回调,用于数据打包和日志记录
+	OnRead       func(n int)                  // OnRead 读取数据后的回调,用于归还对端的发送窗口
+	OnCloseWrite func() error                 // OnCloseWrite 半关闭回调,用于通知对端不再写入数据,为nil时不支持半关闭
 	OnClose      func(v *IO, err error) error // OnClose 关闭回调,用于通知对端和清理资源
 }
 
 // ToRead 将数据写入内部缓冲区,数据会流转到 Read 方法
 // 该方法由隧道收到 Write 类型数据包时调用,将数据注入到虚拟IO中
+// 数据会被复制到池化的缓存中,调用后 p 可以复用
+// 启用流量控制时不会阻塞,对端发送的数据超过接收窗口时关闭IO并返回 ErrWindow,
+// 否则缓存满 ioQueueSize 个数据块后阻塞,直到数据被读取
 func (this *IO) ToRead(p []byte) error {
 	if this.Closed() {
 		return this.Err()
 	}
-	_, err := this.reader.Write(p)
-	return err
+	buf := getBuf()
+	*buf = append(*buf, p...)
+	for {
+		this.mu.Lock()
+		switch {
+		case this.dropped:
+			this.mu.Unlock()
+			putBuf(buf)
+			return this.Err()
+		case this.window > 0 && this.buffered+len(p) > this.window:
+			this.mu.Unlock()
+			putBuf(buf)
+			this.CloseWithErr(ErrWindow)
+			return ErrWindow
+		case this.window <= 0 && len(this.queue)-this.head >= ioQueueSize:
+			this.mu.Unlock()
+			select {
+			case <-this.writable:
+				continue
+			case <-this.Done():
+				putBuf(buf)
+				return this.Err()
+			}
+		}
+		this.queue = append(this.queue, buf)
+		this.buffered += len(p)
+		if this.shared != nil {
+			this.shared.Add(int64(len(p)))
+		}
+		this.mu.Unlock()
+		signal(this.readable)
+		return nil
+	}
+}
+
+// Buffered 获取未读数据的长度
+func (this *IO) Buffered() int {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	return this.buffered
+}
+
+// pop 取出第一个未读的数据块,没有时返回nil
+// 对端已半关闭时返回 io.EOF,对端已关闭时关闭IO并返回关闭的错误
+func (this *IO) pop() (*[]byte, error) {
+	this.mu.Lock()
+	if this.head == len(this.queue) {
+		closeErr, eof := this.closeErr, this.eof
+		this.mu.Unlock()
+		if closeErr != nil {
+			this.CloseWithErr(closeErr)
+			return nil, this.Err()
+		}
+		if eof {
+			return nil, io.EOF
+		}
+		return nil, nil
+	}
+	defer this.mu.Unlock()
+	buf := this.queue[this.head]
+	this.queue[this.head] = nil
+	this.head++
+	if this.head == len(this.queue) {
+		this.queue, this.head = this.queue[:0], 0
+	}
+	signal(this.writable)
+	return buf, nil
+}
+
+// readEOF 对端半关闭,读取完缓存的数据后 Read 返回 io.EOF
+func (this *IO) readEOF() {
+	this.mu.Lock()
+	this.eof = true
+	this.mu.Unlock()
+	signal(this.readable)
+}
+
+// remoteClose 对端关闭,不能再写入数据,没有未读的数据时立即关闭,
+// 否则等缓存的数据读取完后再关闭,避免丢失对端关闭前发送的数据
+func (this *IO) remoteClose(err error) {
+	this.wClosed.Store(true)
+	this.mu.Lock()
+	empty := this.head == len(this.queue)
+	if !empty {
+		this.closeErr = err
+	}
+	this.mu.Unlock()
+	if empty {
+		this.CloseWithErr(err)
+		return
+	}
+	signal(this.readable)
+}
+
+// drop 关闭时丢弃未读的数据,不包括正在读取的数据块
+func (this *IO) drop() {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	for _, buf := range this.queue[this.head:] {
+		putBuf(buf)
+	}
+	if this.shared != nil {
+		this.shared.Add(-int64(this.buffered))
+	}
+	this.queue, this.head, this.buffered, this.dropped = nil, 0, 0, true
+}
+
+// next 获取当前未读完的数据块,没有数据时阻塞等待
+func (this *IO) next() ([]byte, error) {
+	for this.cache == nil {
+		if this.Closed() {
+			return nil, this.Err()
+		}
+		buf, err := this.pop()
+		if err != nil {
+			return nil, err
+		}
+		if buf != nil {
+			this.cache, this.offset = buf, 0
+			break
+		}
+		select {
+		case <-this.readable:
+		case <-this.Done():
+			return nil, this.Err()
+		}
+	}
+	return (*this.cache)[this.offset:], nil
+}
+
+// consume 标记当前数据块已读取 n 字节,读完后放回缓存池
+func (this *IO) consume(n int) {
+	this.offset += n
+	if this.offset >= len(*this.cache) {
+		putBuf(this.cache)
+		this.cache = nil
+	}
+	if n == 0 {
+		return
+	}
+	this.mu.Lock()
+	dropped := this.dropped
+	if !dropped {
+		this.buffered -= n
+		if this.shared != nil {
+			this.shared.Add(-int64(n))
+		}
+	}
+	this.mu.Unlock()
+	if !dropped && this.OnRead != nil {
+		this.OnRead(n)
+	}
 }
 
 // Read 从虚拟IO中读取数据
-// 如果IO已关闭则返回错误,否则阻塞等待数据到达
+// 如果IO已关闭则返回错误,对端半关闭且数据已读完时返回 io.EOF,否则阻塞等待数据到达
 func (this *IO) Read(p []byte) (n int, err error) {
-	if this.Closed() {
-		return 0, this.Err()
+	bs, err := this.next()
+	if err != nil {
+		return 0, err
+	}
+	n = copy(p, bs)
+	this.consume(n)
+	return n, nil
+}
+
+// WriteTo 实现 io.WriterTo,直接写出缓存的数据块,io.Copy 时不需要额外的缓存和复制
+// IO关闭时返回关闭的错误,io.EOF 时返回 nil
+func (this *IO) WriteTo(w io.Writer) (n int64, err error) {
+	for {
+		bs, err := this.next()
+		if err != nil {
+			if err == io.EOF {
+				err = nil
+			}
+			return n, err
+		}
+		m, err := w.Write(bs)
+		n += int64(m)
+		this.consume(m)
+		if err != nil {
+			return n, err
+		}
+	}
+}
+
+// ReadFrom 实现 io.ReaderFrom,使用池化的缓存读取数据并写入IO,io.Copy 时不需要分配缓存
+func (this *IO) ReadFrom(r io.Reader) (n int64, err error) {
+	buf := getBuf()
+	defer putBuf(buf)
+	bs := (*buf)[:cap(*buf)]
+	for {
+		m, err := r.Read(bs)
+		if m > 0 {
+			if _, err := this.Write(bs[:m]); err != nil {
+				return n, err
+			}
+			n += int64(m)
+		}
+		if err == io.EOF {
+			return n, nil
+		}
+		if err != nil {
+			return n, err
+		}
 	}
-	return this.reader.Read(p)
 }
 
 // Write 向虚拟IO中写入数据
@@ -74,8 +301,8 @@ func (this *IO) Write(p []byte) (n int, err error) {
 	if this.Closed() {
 		return 0, this.Err()
 	}
-	if this.reader.Closed() {
-		return 0, io.EOF
+	if this.wClosed.Load() {
+		return 0, io.ErrClosedPipe
 	}
 	// 取原始长度,外部调用者不关心内部细节
 	n = len(p)
@@ -91,3 +318,18 @@ func (this *IO) Write(p []byte) (n int, err error) {
 	_, err = this.writer.Write(p)
 	return
 }
+
+// CloseWrite 半关闭,通知对端本端不再写入数据,之后仍然可以读取对端的数据
+// 对端读取完已发送的数据后返回 io.EOF,未设置 OnCloseWrite(例如对端不支持半关闭)时返回 ErrHalfClose
+func (this *IO) CloseWrite() error {
+	if this.Closed() {
+		return this.Err()
+	}
+	if this.OnCloseWrite == nil {
+		return ErrHalfClose
+	}
+	if !this.wClosed.CompareAndSwap(false, true) {
+		return nil
+	}
+	return this.OnCloseWrite()
+}
@@ -3,7 +3,9 @@ package core
 import (
 	"cmp"
 	"context"
+	"crypto/tls"
 	"net"
+	"time"
 
 	"github.com/injoyai/logs"
 )
@@ -39,6 +41,44 @@ func WithConnected(f func(net.Listener, net.Conn)) ListenOption {
 	}
 }
 
+// WithListenTLS 设置 TLS 监听的配置
+// 也可以通过 Param 设置证书等参数,Param 中的参数会覆盖此配置
+func WithListenTLS(cfg *tls.Config) ListenOption {
+	return func(l *Listen) {
+		l.TLS = cfg
+	}
+}
+
+// WithNetListener 使用已有的监听器,例如挂载在已有HTTP服务上的 WebsocketListener
+// 设置后 Listen 不再根据类型新建监听
+func WithNetListener(l net.Listener) ListenOption {
+	return func(listen *Listen) {
+		listen.custom = l
+	}
+}
+
+// WithUDPIdle 设置 UDP 会话的空闲超时时间,0表示不超时
+func WithUDPIdle(idle time.Duration) ListenOption {
+	return func(l *Listen) {
+		if l.Param == nil {
+			l.Param = map[string]any{}
+		}
+		l.Param[ParamIdle] = idle.String()
+	}
+}
+
+// NewListenUDP 创建一个 UDP 类型的监听器配置
+// 同一来源地址的数据报作为一个连接,连接按数据报分帧,见 NewUDPListener
+func NewListenUDP[T cmp.Ordered](addr T, op ...ListenOption) *Listen {
+	return NewListen(UDP, addr, op...)
+}
+
+// NewListenTLS 创建一个 TLS 类型的监听器配置
+// addr 为监听地址/端口
+func NewListenTLS[T cmp.Ordered](addr T, cfg *tls.Config, op ...ListenOption) *Listen {
+	return NewListen(TLS, addr, append([]ListenOption{WithListenTLS(cfg)}, op...)...)
+}
+
 // NewListenTCP 创建一个 TCP 类型的监听器配置
 // addr 为监听地址/端口
 func NewListenTCP[T cmp.Ordered](addr T, op ...ListenOption) *Listen {
@@ -58,13 +98,15 @@ func NewListen[T cmp.Ordered](_type string, addr T, op ...ListenOption) *Listen
 }
 
 type Listen struct {
-	Type        string         `json:"type,omitempty"`  // Type 监听类型,支持 tcp/udp/serial 等
+	Type        string         `json:"type,omitempty"`  // Type 监听类型,支持 tcp/tls/udp/rudp/websocket/serial 等
 	Address     string         `json:"address"`         // Address 监听地址
 	Param       map[string]any `json:"param,omitempty"` // Param 其他自定义参数
+	TLS         *tls.Config    `json:"-"`               // TLS 配置,仅用于tls类型
 	onListened  func(net.Listener)
 	onListenErr func(net.Listener, error)
 	onConnected func(net.Listener, net.Conn)
 	listener    net.Listener
+	custom      net.Listener
 }
 
 func (this *Listen) Key() string {
@@ -100,10 +142,29 @@ func (this *Listen) OnConnected(f func(net.Listener, net.Conn)) {
 }
 
 func (this *Listen) Listen() error {
+	if this.custom != nil {
+		this.listener = this.custom
+		return nil
+	}
 	var err error
 	switch this.Type {
 	case TCP:
 		this.listener, err = net.Listen(TCP, this.Address)
+	case TLS:
+		var cfg *tls.Config
+		cfg, err = NewTLSConfig(this.Param, this.TLS, true)
+		if err != nil {
+			return err
+		}
+		this.listener, err = tls.Listen(TCP, this.Address, cfg)
+	case UDP:
+		this.listener, err = listenUDP(this)
+	case RUDP:
+		this.listener, err = listenRUDP(this)
+	case Serial:
+		this.listener, err = listenSerial(this)
+	case Websocket:
+		this.listener, err = listenWebsocket(this)
 	default:
 		this.listener, err = net.Listen(TCP, this.Address)
 	}
@@ -2,6 +2,8 @@
 package core
 
 import (
+	"context"
+	"crypto/tls"
 	"encoding/json"
 	"io"
 	"net"
@@ -16,6 +18,12 @@ type Dialer interface {
 	Dial() (io.ReadWriteCloser, string, error)
 }
 
+// ContextDialer 可选接口,支持取消的拨号器,ctx 结束时放弃连接并返回 ctx 的错误
+// 客户端检测到此接口后,DialContext 的 ctx 会作用于连接服务端的过程
+type ContextDialer interface {
+	DialContext(ctx context.Context) (io.ReadWriteCloser, string, error)
+}
+
 // NewDialTCP 创建一个 TCP 类型的拨号器
 // address 格式为 "host:port",例如 "192.168.1.100:8080"
 // timeout 为可选参数,指定连接超时时间
@@ -27,20 +35,101 @@ func NewDialTCP(address string, timeout ...time.Duration) *Dial {
 	}
 }
 
+// NewDialTLS 创建一个 TLS 类型的拨号器
+// cfg 为 TLS 配置,可以为nil,也可以通过 Param 设置证书等参数
+func NewDialTLS(address string, cfg *tls.Config, timeout ...time.Duration) *Dial {
+	return &Dial{
+		Type:    TLS,
+		Address: address,
+		Timeout: conv.Default(0, timeout...),
+		TLS:     cfg,
+	}
+}
+
+// NewDialUDP 创建一个 UDP 类型的拨号器
+// 建立的连接按数据报分帧,见 NewUDPStream
+func NewDialUDP(address string, timeout ...time.Duration) *Dial {
+	return &Dial{
+		Type:    UDP,
+		Address: address,
+		Timeout: conv.Default(0, timeout...),
+	}
+}
+
+// 连接相关的自定义参数(Param)名称,用于 Dial
+const (
+	ParamLocal = "local" // ParamLocal 本地地址,例如"192.168.1.2"或"192.168.1.2:0",用于指定tcp/tls连接使用的网卡
+)
+
 // Dial 连接配置,描述如何建立一条到目标地址的连接
 type Dial struct {
-	Type    string         `json:"type,omitempty"`    // Type 连接类型,支持 tcp/udp/websocket/serial 等
+	Type    string         `json:"type,omitempty"`    // Type 连接类型,支持 tcp/tls/udp/rudp/websocket/serial 等
 	Address string         `json:"address"`           // Address 目标地址,格式如 "192.168.1.100:8080"
 	Timeout time.Duration  `json:"timeout,omitempty"` // Timeout 连接超时时间
 	Param   map[string]any `json:"param,omitempty"`   // Param 其他自定义参数
+	TLS     *tls.Config    `json:"-"`                 // TLS 配置,仅用于tls类型,Param 中的参数会覆盖此配置
 }
 
 // Dial 根据配置建立连接
 // 返回 (连接对象, 本地地址字符串, 错误)
 func (this *Dial) Dial() (io.ReadWriteCloser, string, error) {
+	return this.DialContext(context.Background())
+}
+
+// DialContext 实现 ContextDialer 接口,ctx 结束时放弃连接并返回 ctx 的错误
+// 串口等本地设备打开时不会阻塞,只在打开之前检查 ctx
+func (this *Dial) DialContext(ctx context.Context) (io.ReadWriteCloser, string, error) {
 	switch this.Type {
+	case TLS:
+		cfg, err := NewTLSConfig(this.Param, this.TLS, false)
+		if err != nil {
+			return nil, "", err
+		}
+		if cfg.ServerName == "" && !cfg.InsecureSkipVerify {
+			cfg.ServerName, _, _ = net.SplitHostPort(this.Address)
+		}
+		d, err := this.netDialer()
+		if err != nil {
+			return nil, "", err
+		}
+		c, err := (&tls.Dialer{NetDialer: d, Config: cfg}).DialContext(ctx, "tcp", this.Address)
+		if err != nil {
+			return nil, "", err
+		}
+		return c, c.LocalAddr().String(), nil
+	case UDP:
+		c, err := dialUDP(ctx, this)
+		if err != nil {
+			return nil, "", err
+		}
+		return c, c.LocalAddr().String(), nil
+	case RUDP:
+		c, err := dialRUDP(ctx, this)
+		if err != nil {
+			return nil, "", err
+		}
+		return c, c.LocalAddr().String(), nil
+	case Serial:
+		if err := ctx.Err(); err != nil {
+			return nil, "", err
+		}
+		c, err := dialSerial(this)
+		if err != nil {
+			return nil, "", err
+		}
+		return c, c.LocalAddr().String(), nil
+	case Websocket:
+		c, err := dialWebsocket(ctx, this)
+		if err != nil {
+			return nil, "", err
+		}
+		return c, c.LocalAddr().String(), nil
 	default:
-		c, err := net.DialTimeout("tcp", this.Address, this.Timeout)
+		d, err := this.netDialer()
+		if err != nil {
+			return nil, "", err
+		}
+		c, err := d.DialContext(ctx, "tcp", this.Address)
 		if err != nil {
 			return nil, "", err
 		}
@@ -48,6 +137,24 @@ func (this *Dial) Dial() (io.ReadWriteCloser, string, error) {
 	}
 }
 
+// netDialer 根据超时时间和本地地址(ParamLocal)创建tcp拨号器
+func (this *Dial) netDialer() (*net.Dialer, error) {
+	d := &net.Dialer{Timeout: this.Timeout}
+	local := conv.String(this.Param[ParamLocal])
+	if local == "" {
+		return d, nil
+	}
+	if _, _, err := net.SplitHostPort(local); err != nil {
+		local = net.JoinHostPort(local, "0")
+	}
+	addr, err := net.ResolveTCPAddr("tcp", local)
+	if err != nil {
+		return nil, err
+	}
+	d.LocalAddr = addr
+	return d, nil
+}
+
 // DialRes 连接响应,服务端在成功建立连接后返回给客户端
 type DialRes struct {
 	Key   string `json:"key,omitempty"` // Key 虚拟IO的唯一标识
@@ -58,12 +165,15 @@ type DialRes struct {
 
 // RegisterReq 客户端注册请求,客户端连接服务端后发送此消息进行注册
 type RegisterReq struct {
-	Listen   *Listen                                           `json:"listen,omitempty"`   // Listen 客户端需要监听的端口配置,可选
-	Key      string                                            `json:"key"`                // Key 客户端唯一标识
-	Username string                                            `json:"username,omitempty"` // Username 用户名,用于认证
-	Password string                                            `json:"password,omitempty"` // Password 密码,用于认证
-	Param    map[string]any                                    `json:"param,omitempty"`    // Param 其他自定义参数
-	OnProxy  func(r io.ReadWriteCloser) (*Dial, []byte, error) `json:"-"`                  // OnProxy 代理回调,用于控制外部连接如何转发到隧道
+	Listen     *Listen                                           `json:"listen,omitempty"`   // Listen 客户端需要监听的端口配置,可选
+	Key        string                                            `json:"key"`                // Key 客户端唯一标识
+	Username   string                                            `json:"username,omitempty"` // Username 用户名,用于认证
+	Password   string                                            `json:"password,omitempty"` // Password 密码,用于认证
+	Param      map[string]any                                    `json:"param,omitempty"`    // Param 其他自定义参数
+	*Protocol                                                    // Protocol 客户端支持的协议能力,用于协商
+	Identity   *Identity                                         `json:"-"` // Identity 客户端证书的身份,仅在服务端使用TLS双向认证时存在
+	Negotiated *RegisterRes                                      `json:"-"` // Negotiated 服务端协商的结果,旧版本客户端为nil,注册事件中可以修改下发的配置
+	OnProxy    func(r io.ReadWriteCloser) (*Dial, []byte, error) `json:"-"` // OnProxy 代理回调,用于控制外部连接如何转发到隧道
 }
 
 // String 将注册请求序列化为 JSON 字符串,用于日志输出
@@ -4,6 +4,7 @@ package core
 import (
 	"io"
 	"net"
+	"slices"
 	"time"
 
 	"github.com/injoyai/base/maps/wait"
@@ -29,8 +30,90 @@ func WithFrame(f Frame) TunnelOption {
 	}
 }
 
+// WithProtocol 设置本地支持的协议能力,用于注册时协商
+// 默认使用 DefaultProtocol
+func WithProtocol(p *Protocol) TunnelOption {
+	return func(v *Tunnel) {
+		v.protocol = p
+	}
+}
+
+// WithMaxFrameSize 设置允许接收的最大帧长度(数据域)
+// 超过长度的数据包会导致隧道关闭,防止恶意数据导致分配过多内存
+// 默认为 DefaultMaxFrameSize,0表示不限制,最小为 MinFrameSize
+// 注册时会告知对端,对端发送数据时会按此长度拆分,
+// 旧版本对端不会拆分数据,单次写入超过限制时隧道会被关闭,需要兼容时设置为0
+func WithMaxFrameSize(size uint32) TunnelOption {
+	return func(v *Tunnel) {
+		if size > 0 && size < MinFrameSize {
+			size = MinFrameSize
+		}
+		v.maxFrame = size
+	}
+}
+
+// WithChecksum 启用数据包 CRC32 校验
+// 注册时会和对端协商,双方都启用时才生效,适用于串口桥接、无线电等可能出现误码的链路
+func WithChecksum() TunnelOption {
+	return WithFeature(FeatureChecksum)
+}
+
+// WithCompress 启用压缩,name 为支持的压缩算法,按优先级排序,默认为 CompressFlate
+// 注册时会和对端协商,双方都支持时才生效,只压缩虚拟IO的数据
+func WithCompress(name ...string) TunnelOption {
+	if len(name) == 0 {
+		name = []string{CompressFlate}
+	}
+	return func(v *Tunnel) {
+		p := *v.protocol
+		p.Compress = name
+		v.protocol = &p
+	}
+}
+
+// WithCompressThreshold 设置压缩阈值,小于此长度的数据不压缩
+// 默认为 DefaultCompressThreshold
+func WithCompressThreshold(n int) TunnelOption {
+	return func(v *Tunnel) {
+		v.compress = n
+	}
+}
+
+// WithWindow 设置流量控制的缓存大小
+// stream 为每个虚拟IO的接收窗口,对端最多发送这么多未被读取的数据,0表示不启用流量控制,
+// 注册时会和对端协商,双方都启用时生效,使用较小的窗口,默认为 DefaultStreamWindow
+// tunnel 为隧道所有虚拟IO未读数据的上限,超过后暂停归还窗口,0表示不限制,默认为 DefaultTunnelBuffer
+// 启用流量控制后,读取慢的虚拟IO只会阻塞自己,不会阻塞隧道上的其他虚拟IO
+func WithWindow(stream uint32, tunnel int64) TunnelOption {
+	return func(v *Tunnel) {
+		v.window = stream
+		v.budget = tunnel
+	}
+}
+
+// WithHeartbeat 设置心跳间隔,连续 miss 次心跳没有响应时关闭隧道
+// 默认间隔为 DefaultHeartbeat,次数为 DefaultHeartbeatMiss,interval 为0时不发送心跳
+// 心跳同时测量往返时间,通过 Tunnel.RTT 获取
+func WithHeartbeat(interval time.Duration, miss ...int) TunnelOption {
+	return func(v *Tunnel) {
+		v.heartbeat = interval
+		if len(miss) > 0 && miss[0] > 0 {
+			v.heartbeatMiss = miss[0]
+		}
+	}
+}
+
+// WithFeature 声明本地支持的可选功能,注册时和对端协商
+func WithFeature(feature ...string) TunnelOption {
+	return func(v *Tunnel) {
+		p := *v.protocol
+		p.Features = append(slices.Clone(p.Features), feature...)
+		v.protocol = &p
+	}
+}
+
 // WithWait 设置异步等待机制
-// 用于等待请求的响应,默认超时时间为5秒
+// 用于等待请求的响应,超时时间使用 WithWaitTimeout 设置,默认为 DefaultWaitTimeout
 func WithWait(w *wait.Entity) TunnelOption {
 	return func(v *Tunnel) {
 		v.wait = w
@@ -41,6 +124,7 @@ func WithWait(w *wait.Entity) TunnelOption {
 func WithWaitTimeout(timeout time.Duration) TunnelOption {
 	return func(v *Tunnel) {
 		v.wait.SetTimeout(timeout)
+		v.timeout = timeout
 	}
 }
 
@@ -53,8 +137,41 @@ func WithRegister(f func(v *Tunnel, data []byte) (any, error)) TunnelOption {
 	}
 }
 
+// WithHandler 注册自定义消息类型的处理函数,见 Tunnel.Handle
+// handler 在隧道的读取协程中执行,不能执行耗时的操作
+func WithHandler(_type CustomType, handler Handler) TunnelOption {
+	return func(v *Tunnel) {
+		v.Handle(_type, handler)
+	}
+}
+
+// WithRPCConcurrency 设置同时执行的对端远程调用的数量上限,达到上限时新的调用排队等待,
+// queue 为排队的数量上限,排队也达到上限时新的调用直接返回 ErrBusy
+// 默认为 DefaultRPCConcurrency 和 DefaultRPCQueue,n为0表示不限制,queue为0表示不排队
+func WithRPCConcurrency(n int, queue ...int) TunnelOption {
+	return func(v *Tunnel) {
+		if n <= 0 {
+			v.rpc, v.rpcQueue = nil, nil
+			return
+		}
+		q := DefaultRPCQueue
+		if len(queue) > 0 && queue[0] >= 0 {
+			q = queue[0]
+		}
+		v.rpc = make(chan struct{}, n)
+		v.rpcQueue = make(chan struct{}, n+q)
+	}
+}
+
+// WithMethod 注册远程调用的方法,见 Tunnel.HandleMethod
+func WithMethod(method string, f Method) TunnelOption {
+	return func(v *Tunnel) {
+		v.HandleMethod(method, f)
+	}
+}
+
 // WithDialed 设置连接成功回调函数
-// 当通过 OnDial 成功建立到目标的连接后调用
+// 当通过 OnDial 成功建立到目标的连接后调用,key 为虚拟IO的标识,和 Tunnel.GetIO 使用的标识一致
 func WithDialed(f func(d *Dial, key string)) TunnelOption {
 	return func(v *Tunnel) {
 		v.onDialed = f
@@ -85,6 +202,25 @@ func WithDialTCP(address string, timeout ...time.Duration) TunnelOption {
 	})
 }
 
+// WithDialUDP 设置 UDP 拨号函数
+// 忽略服务端下发的连接配置,直接使用指定的地址和超时时间,服务端需要监听 UDP 端口
+func WithDialUDP(address string, timeout ...time.Duration) TunnelOption {
+	return WithDial(func(d *Dial) (io.ReadWriteCloser, string, error) {
+		d.Type = UDP
+		d.Address = address
+		d.Timeout = conv.Default(0, timeout...)
+		return d.Dial()
+	})
+}
+
+// WithDialSerial 允许对端请求打开本地的串口设备(Dial 类型为 serial),默认不允许
+// device 为允许打开的设备路径,为空时允许所有设备,未允许的设备返回 ErrSerialDenied
+func WithDialSerial(device ...string) TunnelOption {
+	return func(v *Tunnel) {
+		v.serial = append([]string{}, device...)
+	}
+}
+
 // WithDialDefault 使用默认的拨号方式
 // 即使用 Dial 结构体中指定的配置进行连接
 func WithDialDefault() TunnelOption {
@@ -0,0 +1,28 @@
+package core
+
+import "sync"
+
+const (
+	poolBufSize = 32 << 10 // poolBufSize 池化缓存的初始容量,和 io.Copy 的缓存大小一致
+	poolMaxSize = 1 << 20  // poolMaxSize 超过这个容量的缓存不放回池中,避免大包长期占用内存
+)
+
+// bufPool 发送数据包和虚拟IO接收数据使用的缓存池
+var bufPool = sync.Pool{New: func() any {
+	bs := make([]byte, 0, poolBufSize)
+	return &bs
+}}
+
+// getBuf 从池中获取一个长度为0的缓存
+func getBuf() *[]byte {
+	return bufPool.Get().(*[]byte)
+}
+
+// putBuf 将缓存放回池中,放回后不能再使用
+func putBuf(bs *[]byte) {
+	if cap(*bs) > poolMaxSize {
+		return
+	}
+	*bs = (*bs)[:0]
+	bufPool.Put(bs)
+}
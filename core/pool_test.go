@@ -0,0 +1,80 @@
+package core
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"testing"
+)
+
+// benchFrames 基准测试使用的帧协议
+var benchFrames = []struct {
+	name  string
+	frame Frame
+}{
+	{"V1", DefaultFrame},
+	{"V2", FrameV2},
+}
+
+// benchPayload 基准测试的数据,和 io.Copy 每次写入的长度接近
+var benchPayload = bytes.Repeat([]byte("x"), 4096)
+
+// BenchmarkWritePacket 编码数据包,NewPacket 为每个数据包分配缓存,AppendPacket 使用池化的缓存
+func BenchmarkWritePacket(b *testing.B) {
+	for _, v := range benchFrames {
+		b.Run(v.name+"/NewPacket", func(b *testing.B) {
+			b.ReportAllocs()
+			b.SetBytes(int64(len(benchPayload)))
+			for i := 0; i < b.N; i++ {
+				io.Discard.Write(v.frame.NewPacket("12", Write, Request, benchPayload))
+			}
+		})
+		b.Run(v.name+"/AppendPacket", func(b *testing.B) {
+			b.ReportAllocs()
+			b.SetBytes(int64(len(benchPayload)))
+			f := v.frame.(AppendFrame)
+			for i := 0; i < b.N; i++ {
+				buf := getBuf()
+				*buf = f.AppendPacket(*buf, "12", Write, Request, benchPayload)
+				io.Discard.Write(*buf)
+				putBuf(buf)
+			}
+		})
+	}
+}
+
+// BenchmarkReadPacket 解码数据包,ReadPacket 为每个数据包分配缓存,ReadPacketBuffer 复用调用方的缓存
+func BenchmarkReadPacket(b *testing.B) {
+	for _, v := range benchFrames {
+		stream := bytes.Repeat(v.frame.NewPacket("12", Write, Request, benchPayload), 64)
+		run := func(b *testing.B, read func(r io.Reader) error) {
+			b.ReportAllocs()
+			b.SetBytes(int64(len(benchPayload)))
+			r := bytes.NewReader(stream)
+			buf := bufio.NewReader(r)
+			for i := 0; i < b.N; i++ {
+				if buf.Buffered() == 0 && r.Len() == 0 {
+					r.Reset(stream)
+					buf.Reset(r)
+				}
+				if err := read(buf); err != nil {
+					b.Fatal(err)
+				}
+			}
+		}
+		b.Run(v.name+"/ReadPacket", func(b *testing.B) {
+			run(b, func(r io.Reader) error {
+				_, _, _, _, err := v.frame.ReadPacket(r)
+				return err
+			})
+		})
+		b.Run(v.name+"/ReadPacketBuffer", func(b *testing.B) {
+			f := v.frame.(BufferFrame)
+			var bs []byte
+			run(b, func(r io.Reader) error {
+				_, _, _, _, err := f.ReadPacketBuffer(r, DefaultMaxFrameSize, &bs)
+				return err
+			})
+		})
+	}
+}
@@ -0,0 +1,129 @@
+package core
+
+import (
+	"slices"
+	"sync"
+)
+
+// ProtocolVersion 当前协议版本
+// 旧版本客户端不携带版本号(即0),服务端会按旧的方式响应注册
+const ProtocolVersion = 1
+
+// 帧协议名称,用于注册时协商
+const (
+	FrameNameV1 = "v1" // FrameNameV1 默认帧协议
+	FrameNameV2 = "v2" // FrameNameV2 紧凑帧协议
+)
+
+var (
+	framesMu sync.RWMutex
+	frames   = map[string]Frame{
+		FrameNameV1: DefaultFrame,
+		FrameNameV2: FrameV2,
+	}
+)
+
+// RegisterFrame 注册一个帧协议,注册后可以参与协商
+// 自定义帧协议的名称需要在服务端和客户端保持一致
+func RegisterFrame(name string, f Frame) {
+	framesMu.Lock()
+	defer framesMu.Unlock()
+	frames[name] = f
+}
+
+// GetFrame 根据名称获取帧协议,不存在返回nil
+func GetFrame(name string) Frame {
+	framesMu.RLock()
+	defer framesMu.RUnlock()
+	return frames[name]
+}
+
+// 可选功能名称,用于注册时协商,双方都支持时启用
+const (
+	FeatureChecksum  = "crc32"     // FeatureChecksum 数据包 CRC32 校验
+	FeatureHalfClose = "halfclose" // FeatureHalfClose 虚拟IO半关闭
+	FeatureErrorCode = "errcode"   // FeatureErrorCode 错误携带错误码,见 Error
+)
+
+// DefaultProtocol 默认的协议能力
+// 支持全部内置帧协议,优先使用紧凑帧协议,支持半关闭和错误码
+func DefaultProtocol() *Protocol {
+	return &Protocol{
+		Version:  ProtocolVersion,
+		Frames:   []string{FrameNameV2, FrameNameV1},
+		Features: []string{FeatureHalfClose, FeatureErrorCode},
+	}
+}
+
+// Protocol 协议能力,注册时由客户端通告给服务端
+// 列表类字段按优先级从高到低排序
+type Protocol struct {
+	Version      int      `json:"version,omitempty"`      // Version 协议版本
+	Frames       []string `json:"frames,omitempty"`       // Frames 支持的帧协议
+	Compress     []string `json:"compress,omitempty"`     // Compress 支持的压缩算法
+	MaxFrameSize uint32   `json:"maxFrameSize,omitempty"` // MaxFrameSize 能接收的最大帧长度,0表示不限制
+	Features     []string `json:"features,omitempty"`     // Features 支持的可选功能
+	Window       uint32   `json:"window,omitempty"`       // Window 每个虚拟IO的接收窗口,0表示不支持流量控制
+}
+
+// Negotiate 根据本地能力和对端(客户端)能力协商出双方共同支持的配置
+// 帧协议和压缩算法以客户端的优先级为准,空字符串表示保持不变/不启用
+// 只会选择本地已经注册的压缩算法
+func (this *Protocol) Negotiate(remote *Protocol) *RegisterRes {
+	compress := slices.DeleteFunc(slices.Clone(this.Compress), func(name string) bool { return GetCompress(name) == nil })
+	res := &RegisterRes{
+		Version:      min(this.Version, remote.Version),
+		Frame:        firstCommon(remote.Frames, this.Frames),
+		Compress:     firstCommon(remote.Compress, compress),
+		MaxFrameSize: minSize(this.MaxFrameSize, remote.MaxFrameSize),
+	}
+	if this.Window > 0 && remote.Window > 0 {
+		// 双方都支持时启用流量控制,使用较小的窗口
+		res.Window = min(this.Window, remote.Window)
+	}
+	for _, v := range remote.Features {
+		if slices.Contains(this.Features, v) {
+			res.Features = append(res.Features, v)
+		}
+	}
+	return res
+}
+
+// RegisterRes 服务端注册响应,包含协商结果和服务端下发的配置
+type RegisterRes struct {
+	Version      int            `json:"version"`                // Version 协商后的协议版本
+	Frame        string         `json:"frame,omitempty"`        // Frame 协商后的帧协议,注册完成后双方切换
+	Compress     string         `json:"compress,omitempty"`     // Compress 协商后的压缩算法
+	MaxFrameSize uint32         `json:"maxFrameSize,omitempty"` // MaxFrameSize 协商后的最大帧长度
+	Features     []string       `json:"features,omitempty"`     // Features 双方都支持的可选功能
+	Window       uint32         `json:"window,omitempty"`       // Window 协商后每个虚拟IO的接收窗口,0表示不启用流量控制
+	Key          string         `json:"key,omitempty"`          // Key 服务端分配的隧道标识
+	Listen       *Listen        `json:"listen,omitempty"`       // Listen 服务端实际监听的配置
+	Param        map[string]any `json:"param,omitempty"`        // Param 服务端下发的自定义参数
+}
+
+// HasFeature 判断是否协商启用了某个可选功能
+func (this *RegisterRes) HasFeature(feature string) bool {
+	return this != nil && slices.Contains(this.Features, feature)
+}
+
+// firstCommon 按 prefer 的顺序返回第一个双方都支持的值
+func firstCommon(prefer, support []string) string {
+	for _, v := range prefer {
+		if slices.Contains(support, v) {
+			return v
+		}
+	}
+	return ""
+}
+
+// minSize 取较小的限制,0表示不限制
+func minSize(a, b uint32) uint32 {
+	switch {
+	case a == 0:
+		return b
+	case b == 0:
+		return a
+	}
+	return min(a, b)
+}
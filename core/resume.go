@@ -0,0 +1,525 @@
+package core
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/injoyai/base/safe"
+	"github.com/injoyai/logs"
+)
+
+const (
+	// DefaultResumeGrace 默认的会话恢复宽限时间,连接断开后在此时间内重连可以恢复会话
+	DefaultResumeGrace = time.Minute
+	// DefaultResumeBuffer 默认缓存的已发送未确认的数据长度,超过后写入阻塞,直到对端确认
+	DefaultResumeBuffer = 4 << 20
+
+	resumeMaxRecord = 64 << 10        // resumeMaxRecord 每条数据记录的最大长度
+	resumeAckBytes  = 64 << 10        // resumeAckBytes 收到这么多数据后立即确认
+	resumeKeepalive = time.Second * 5 // resumeKeepalive 定时确认的间隔,同时作为心跳
+	resumeDeadTimes = 3               // resumeDeadTimes 多少个心跳间隔没有收到数据时认为连接已断开
+)
+
+// 会话记录类型
+const (
+	resumeData  byte = 0x01 // resumeData 数据 [seq 8][len 4][data]
+	resumeAck   byte = 0x02 // resumeAck 确认收到的数据长度 [received 8]
+	resumeClose byte = 0x03 // resumeClose 会话正常关闭
+)
+
+// 握手结果
+const (
+	resumeNew     byte = 0x00 // resumeNew 新的会话
+	resumeResumed byte = 0x01 // resumeResumed 恢复了已有的会话
+	resumeUnknown byte = 0x02 // resumeUnknown 会话不存在(已过期)
+)
+
+// resumeMagic 客户端握手的标识
+var resumeMagic = []byte("RSM1")
+
+// DialResume 建立一个可以恢复的会话连接
+// dial 用于建立(和重新建立)底层连接,连接断开后会在 grace 内不断重连并恢复会话,
+// 未发送成功和对端未确认的数据会重新发送,对上层(例如隧道)透明,超过宽限时间后关闭并返回 ErrResume
+// 服务端需要使用 ResumeServer 接受连接
+// 会话标识以明文在 dial 返回的连接上传输,只有连接已经加密(PSK、TLS)时才是保密的,
+// 否则能看到握手的第三方可以冒充客户端恢复会话
+func DialResume(dial func() (io.ReadWriteCloser, error), grace time.Duration) (*ResumeConn, error) {
+	c, err := dial()
+	if err != nil {
+		return nil, err
+	}
+	s := newResumeConn(grace)
+	s.redial = dial
+	if err := s.handshake(c); err != nil {
+		c.Close()
+		return nil, err
+	}
+	go s.keepalive()
+	go s.runClient(c)
+	return s, nil
+}
+
+// NewResumeServer 创建一个会话恢复的服务端,grace 为连接断开后保留会话的时间
+func NewResumeServer(grace time.Duration) *ResumeServer {
+	return &ResumeServer{
+		grace:    grace,
+		sessions: make(map[[16]byte]*ResumeConn),
+	}
+}
+
+// ResumeServer 会话恢复的服务端,管理连接断开后等待恢复的会话
+type ResumeServer struct {
+	grace    time.Duration
+	mu       sync.Mutex
+	sessions map[[16]byte]*ResumeConn
+}
+
+// Accept 读取客户端的握手
+// 新的会话返回会话连接,恢复已有的会话时,连接会接入已有的会话,
+// 阻塞直到这个连接断开,返回 nil,nil,会话不存在(已过期)时返回 ErrResume
+func (this *ResumeServer) Accept(c io.ReadWriteCloser) (*ResumeConn, error) {
+	hello := make([]byte, len(resumeMagic)+16+8)
+	if _, err := io.ReadFull(c, hello); err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(hello[:len(resumeMagic)], resumeMagic) {
+		return nil, ErrResume
+	}
+	var token [16]byte
+	copy(token[:], hello[len(resumeMagic):])
+	received := binary.BigEndian.Uint64(hello[len(resumeMagic)+16:])
+
+	if token == ([16]byte{}) {
+		s := newResumeConn(this.grace)
+		rand.Read(s.token[:])
+		this.mu.Lock()
+		this.sessions[s.token] = s
+		this.mu.Unlock()
+		s.onClose = func() {
+			this.mu.Lock()
+			delete(this.sessions, s.token)
+			this.mu.Unlock()
+		}
+		if err := writeResumeHello(c, resumeNew, s.token, 0); err != nil {
+			s.CloseWithErr(err)
+			return nil, err
+		}
+		s.attach(c, 0)
+		go s.keepalive()
+		go s.serve(c)
+		return s, nil
+	}
+
+	this.mu.Lock()
+	s := this.sessions[token]
+	this.mu.Unlock()
+	if s == nil || s.Closed() {
+		writeResumeHello(c, resumeUnknown, token, 0)
+		return nil, ErrResume
+	}
+	if err := writeResumeHello(c, resumeResumed, token, s.received.Load()); err != nil {
+		return nil, err
+	}
+	if err := s.attach(c, received); err != nil {
+		return nil, err
+	}
+	s.serve(c)
+	return nil, nil
+}
+
+// Len 获取会话数量,包括等待恢复的会话
+func (this *ResumeServer) Len() int {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	return len(this.sessions)
+}
+
+func newResumeConn(grace time.Duration) *ResumeConn {
+	pr, pw := io.Pipe()
+	s := &ResumeConn{
+		Closer: safe.NewCloser(),
+		grace:  grace,
+		pr:     pr,
+		pw:     pw,
+		space:  make(chan struct{}, 1),
+		ackNow: make(chan struct{}, 1),
+	}
+	s.SetCloseFunc(func(err error) error {
+		s.mu.Lock()
+		c := s.carrier
+		s.carrier = nil
+		if s.expire != nil {
+			s.expire.Stop()
+		}
+		s.mu.Unlock()
+		if c != nil {
+			// 写入可能阻塞在已经断开的连接上,拿不到锁时不通知对端
+			if s.wMu.TryLock() {
+				c.Write([]byte{resumeClose})
+				s.wMu.Unlock()
+			}
+			c.Close()
+		}
+		s.pw.CloseWithError(err)
+		if s.onClose != nil {
+			s.onClose()
+		}
+		return nil
+	})
+	return s
+}
+
+// ResumeConn 可以恢复的会话连接,实现了 io.ReadWriteCloser,可以作为隧道的底层连接
+// 发送的数据按字节编号,缓存到对端确认为止,底层连接断开后,
+// 双方交换已收到的数据长度,重新发送对端没有收到的数据,上层不会感知到连接的断开
+type ResumeConn struct {
+	*safe.Closer
+	token   [16]byte                           // token 会话标识,由服务端分配
+	grace   time.Duration                      // grace 连接断开后等待恢复的时间
+	redial  func() (io.ReadWriteCloser, error) // redial 客户端重新建立底层连接,服务端为nil
+	onClose func()                             // onClose 会话关闭时从服务端移除
+
+	mu      sync.Mutex         // mu 保护下面的字段
+	carrier io.ReadWriteCloser // carrier 当前的底层连接,断开时为nil
+	buf     []byte             // buf 已发送未确认的数据
+	acked   uint64             // acked 对端确认收到的数据长度,即 buf[0] 的编号
+	expire  *time.Timer        // expire 服务端连接断开后等待恢复的计时器
+	space   chan struct{}      // space 对端确认后通知等待缓存空间的写入
+
+	wMu      sync.Mutex    // wMu 保证写入底层连接的记录完整,并且按编号顺序
+	rMu      sync.Mutex    // rMu 保证收到的数据按编号顺序写入,旧的底层连接和新的底层连接可能同时读取
+	received atomic.Uint64 // received 已收到的数据长度
+	lastRecv atomic.Int64  // lastRecv 最后一次从底层连接收到数据的时间(纳秒)
+	blocked  atomic.Bool   // blocked 读取协程是否正在等待上层读取数据,此时没有读取底层连接,不判断心跳
+	ackNow   chan struct{} // ackNow 通知心跳协程立即发送确认
+	pr       *io.PipeReader
+	pw       *io.PipeWriter
+}
+
+// Read 读取对端发送的数据
+func (this *ResumeConn) Read(p []byte) (int, error) {
+	return this.pr.Read(p)
+}
+
+// Write 发送数据,底层连接断开时数据会缓存,恢复后重新发送
+// 未确认的数据超过 DefaultResumeBuffer 时阻塞,直到对端确认或会话关闭
+func (this *ResumeConn) Write(p []byte) (int, error) {
+	total := len(p)
+	for len(p) > 0 {
+		n := min(len(p), resumeMaxRecord)
+		if err := this.writeRecord(p[:n]); err != nil {
+			return total - len(p), err
+		}
+		p = p[n:]
+	}
+	return total, nil
+}
+
+// writeRecord 缓存并发送一条数据记录
+func (this *ResumeConn) writeRecord(p []byte) error {
+	// 等待缓存空间时不能持有写锁,否则恢复时无法重新发送,对端也就无法确认
+	for {
+		this.mu.Lock()
+		full := len(this.buf) > 0 && len(this.buf)+len(p) > DefaultResumeBuffer
+		this.mu.Unlock()
+		if this.Closed() {
+			return this.Err()
+		}
+		if !full {
+			break
+		}
+		select {
+		case <-this.space:
+		case <-this.Done():
+			return this.Err()
+		}
+	}
+	this.wMu.Lock()
+	defer this.wMu.Unlock()
+	this.mu.Lock()
+	seq := this.acked + uint64(len(this.buf))
+	this.buf = append(this.buf, p...)
+	c := this.carrier
+	this.mu.Unlock()
+	if c != nil {
+		if err := writeResumeData(c, seq, p); err != nil {
+			// 数据已缓存,等待恢复后重新发送
+			c.Close()
+		}
+	}
+	return nil
+}
+
+// handshake 客户端握手,新的会话分配标识,已有的会话恢复
+func (this *ResumeConn) handshake(c io.ReadWriteCloser) error {
+	hello := append(bytes.Clone(resumeMagic), this.token[:]...)
+	hello = binary.BigEndian.AppendUint64(hello, this.received.Load())
+	if _, err := c.Write(hello); err != nil {
+		return err
+	}
+	res := make([]byte, 1+16+8)
+	if _, err := io.ReadFull(c, res); err != nil {
+		return err
+	}
+	if res[0] == resumeUnknown {
+		return ErrResume
+	}
+	copy(this.token[:], res[1:17])
+	return this.attach(c, binary.BigEndian.Uint64(res[17:]))
+}
+
+// attach 使用新的底层连接,received 为对端已收到的数据长度,重新发送对端没有收到的数据
+// 双方恢复时都会重新发送数据,需要先开始读取底层连接,重新发送在单独的协程中进行,
+// 期间持有写锁,保证新写入的数据在重新发送的数据之后
+func (this *ResumeConn) attach(c io.ReadWriteCloser, received uint64) error {
+	this.wMu.Lock()
+	this.mu.Lock()
+	if received < this.acked || received > this.acked+uint64(len(this.buf)) {
+		this.mu.Unlock()
+		this.wMu.Unlock()
+		err := errors.Join(ErrResume, errors.New("数据编号不一致"))
+		this.CloseWithErr(err)
+		return err
+	}
+	this.trim(received)
+	old := this.carrier
+	this.carrier = c
+	if this.expire != nil {
+		this.expire.Stop()
+		this.expire = nil
+	}
+	pending := bytes.Clone(this.buf)
+	seq := this.acked
+	this.mu.Unlock()
+	if old != nil {
+		old.Close()
+	}
+	this.lastRecv.Store(time.Now().UnixNano())
+	go func() {
+		defer this.wMu.Unlock()
+		for len(pending) > 0 {
+			n := min(len(pending), resumeMaxRecord)
+			if err := writeResumeData(c, seq, pending[:n]); err != nil {
+				c.Close()
+				return
+			}
+			seq += uint64(n)
+			pending = pending[n:]
+		}
+	}()
+	return nil
+}
+
+// detach 底层连接断开,c 已经被替换时忽略
+// 服务端开始计时,超过宽限时间没有恢复时关闭会话
+func (this *ResumeConn) detach(c io.ReadWriteCloser, err error) {
+	c.Close()
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	if this.carrier != c || this.Closed() {
+		return
+	}
+	this.carrier = nil
+	logs.Tracef("[会话] 连接断开,等待恢复: %v\n", err)
+	if this.redial == nil {
+		this.expire = time.AfterFunc(this.grace, func() {
+			this.CloseWithErr(ErrResume)
+		})
+	}
+}
+
+// trim 对端确认收到了 received 长度的数据,释放缓存,调用方需持有锁
+func (this *ResumeConn) trim(received uint64) {
+	if received <= this.acked {
+		return
+	}
+	n := min(received-this.acked, uint64(len(this.buf)))
+	this.buf = this.buf[:copy(this.buf, this.buf[n:])]
+	this.acked += n
+	signal(this.space)
+}
+
+// serve 服务端读取底层连接,直到断开
+func (this *ResumeConn) serve(c io.ReadWriteCloser) {
+	this.detach(c, this.readLoop(c))
+}
+
+// runClient 客户端读取底层连接,断开后在宽限时间内重连
+func (this *ResumeConn) runClient(c io.ReadWriteCloser) {
+	for {
+		this.detach(c, this.readLoop(c))
+		if this.Closed() {
+			return
+		}
+		deadline := time.Now().Add(this.grace)
+		wait := time.Millisecond * 100
+		for c = nil; c == nil; {
+			if time.Now().After(deadline) {
+				this.CloseWithErr(ErrResume)
+				return
+			}
+			select {
+			case <-time.After(wait):
+			case <-this.Done():
+				return
+			}
+			wait = min(wait*2, time.Second*5)
+			conn, err := this.redial()
+			if err != nil {
+				logs.Tracef("[会话] 重连失败: %v\n", err)
+				continue
+			}
+			if err := this.handshake(conn); err != nil {
+				conn.Close()
+				if errors.Is(err, ErrResume) {
+					this.CloseWithErr(err)
+					return
+				}
+				continue
+			}
+			c = conn
+		}
+		logs.Tracef("[会话] 恢复成功\n")
+	}
+}
+
+// readLoop 读取底层连接的记录,直到连接断开或会话关闭
+func (this *ResumeConn) readLoop(c io.ReadWriteCloser) error {
+	r := bufio.NewReader(c)
+	head := make([]byte, 12)
+	buf := make([]byte, resumeMaxRecord)
+	var unacked uint64
+	for {
+		_type, err := r.ReadByte()
+		if err != nil {
+			return err
+		}
+		this.lastRecv.Store(time.Now().UnixNano())
+		switch _type {
+		case resumeData:
+			if _, err := io.ReadFull(r, head); err != nil {
+				return err
+			}
+			seq := binary.BigEndian.Uint64(head)
+			size := binary.BigEndian.Uint32(head[8:])
+			if size > resumeMaxRecord {
+				return ErrFrameTooLarge
+			}
+			data := buf[:size]
+			if _, err := io.ReadFull(r, data); err != nil {
+				return err
+			}
+			// 上层读取慢时写入会阻塞,期间没有读取对端的确认和心跳,结束后重新计时
+			this.blocked.Store(true)
+			n, err := this.deliver(c, seq, data)
+			this.blocked.Store(false)
+			this.lastRecv.Store(time.Now().UnixNano())
+			if err != nil {
+				return err
+			}
+			if unacked += uint64(n); unacked >= resumeAckBytes {
+				unacked = 0
+				signal(this.ackNow)
+			}
+		case resumeAck:
+			if _, err := io.ReadFull(r, head[:8]); err != nil {
+				return err
+			}
+			this.mu.Lock()
+			this.trim(binary.BigEndian.Uint64(head))
+			this.mu.Unlock()
+		case resumeClose:
+			this.CloseWithErr(io.EOF)
+			return io.EOF
+		default:
+			return ErrFrameInvalid
+		}
+	}
+}
+
+// deliver 写入底层连接 c 收到的数据记录,返回新收到的数据长度
+// 恢复后旧的底层连接可能还有缓存的记录,c 已经被替换时丢弃,由新的底层连接重新接收
+func (this *ResumeConn) deliver(c io.ReadWriteCloser, seq uint64, data []byte) (int, error) {
+	this.rMu.Lock()
+	defer this.rMu.Unlock()
+	this.mu.Lock()
+	replaced := this.carrier != c
+	this.mu.Unlock()
+	if replaced {
+		return 0, io.ErrClosedPipe
+	}
+	received := this.received.Load()
+	if seq > received {
+		// 中间的数据丢失,无法恢复
+		this.CloseWithErr(ErrResume)
+		return 0, ErrResume
+	}
+	skip := received - seq
+	if skip >= uint64(len(data)) {
+		// 重新发送的数据已经收到过
+		return 0, nil
+	}
+	data = data[skip:]
+	if _, err := this.pw.Write(data); err != nil {
+		return 0, err
+	}
+	this.received.Add(uint64(len(data)))
+	return len(data), nil
+}
+
+// keepalive 定时发送确认,同时作为心跳,长时间没有收到数据时断开底层连接,触发恢复
+// 读取协程等待上层读取数据时不判断,底层连接没有问题,只是没有读取
+// 确认不能在读取协程中发送,否则双方的写入都阻塞时会互相等待
+func (this *ResumeConn) keepalive() {
+	ticker := time.NewTicker(resumeKeepalive)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-this.Done():
+			return
+		case <-ticker.C:
+		case <-this.ackNow:
+		}
+		this.mu.Lock()
+		c := this.carrier
+		this.mu.Unlock()
+		if c == nil {
+			continue
+		}
+		if !this.blocked.Load() && time.Since(time.Unix(0, this.lastRecv.Load())) > resumeKeepalive*resumeDeadTimes {
+			c.Close()
+			continue
+		}
+		bs := binary.BigEndian.AppendUint64([]byte{resumeAck}, this.received.Load())
+		this.wMu.Lock()
+		_, err := c.Write(bs)
+		this.wMu.Unlock()
+		if err != nil {
+			c.Close()
+		}
+	}
+}
+
+// writeResumeData 写入一条数据记录
+func writeResumeData(w io.Writer, seq uint64, p []byte) error {
+	bs := make([]byte, 13, 13+len(p))
+	bs[0] = resumeData
+	binary.BigEndian.PutUint64(bs[1:], seq)
+	binary.BigEndian.PutUint32(bs[9:], uint32(len(p)))
+	_, err := w.Write(append(bs, p...))
+	return err
+}
+
+// writeResumeHello 服务端响应握手
+func writeResumeHello(w io.Writer, status byte, token [16]byte, received uint64) error {
+	bs := append([]byte{status}, token[:]...)
+	_, err := w.Write(binary.BigEndian.AppendUint64(bs, received))
+	return err
+}
@@ -0,0 +1,162 @@
+package core
+
+import (
+	"errors"
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newResumePair 在 net.Pipe 上建立一对可以恢复的会话,dials 为客户端建立底层连接的次数
+func newResumePair(t *testing.T) (client, server *ResumeConn, dials *atomic.Int32) {
+	t.Helper()
+	srv := NewResumeServer(time.Minute)
+	accepted := make(chan *ResumeConn, 1)
+	dials = new(atomic.Int32)
+	client, err := DialResume(func() (io.ReadWriteCloser, error) {
+		dials.Add(1)
+		c1, c2 := net.Pipe()
+		go func() {
+			if s, err := srv.Accept(c2); err == nil && s != nil {
+				accepted <- s
+			}
+		}()
+		return c1, nil
+	}, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case server = <-accepted:
+	case <-time.After(5 * time.Second):
+		t.Fatal("服务端没有建立会话")
+	}
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	return client, server, dials
+}
+
+// currentCarrier 会话当前的底层连接
+func (this *ResumeConn) currentCarrier() io.ReadWriteCloser {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	return this.carrier
+}
+
+// readTimeout 读取指定长度的数据,超时后失败
+func readTimeout(t *testing.T, r io.Reader, n int) string {
+	t.Helper()
+	ch := make(chan []byte, 1)
+	go func() {
+		buf := make([]byte, n)
+		io.ReadFull(r, buf)
+		ch <- buf
+	}()
+	select {
+	case bs := <-ch:
+		return string(bs)
+	case <-time.After(10 * time.Second):
+		t.Fatal("读取数据超时")
+		return ""
+	}
+}
+
+// TestResumeReplay 底层连接断开后重连恢复会话,对端没有收到的数据重新发送,双方的数据都不丢失
+func TestResumeReplay(t *testing.T) {
+	client, server, dials := newResumePair(t)
+	client.Write([]byte("hello"))
+	if s := readTimeout(t, server, 5); s != "hello" {
+		t.Fatalf("收到的数据不一致: %q", s)
+	}
+
+	// 断开服务端的底层连接,之后写入的数据发送失败,缓存到恢复后重新发送
+	server.currentCarrier().Close()
+	go client.Write([]byte("world"))
+	go server.Write([]byte("back"))
+
+	if s := readTimeout(t, server, 5); s != "world" {
+		t.Fatalf("恢复后收到的数据不一致: %q", s)
+	}
+	if s := readTimeout(t, client, 4); s != "back" {
+		t.Fatalf("恢复后收到的数据不一致: %q", s)
+	}
+	if n := dials.Load(); n != 2 {
+		t.Fatalf("预期重连1次,建立了%d次底层连接", n)
+	}
+}
+
+// TestResumeDuplicate 重新发送的数据记录中已经收到的部分被丢弃,中间的数据丢失时关闭会话
+func TestResumeDuplicate(t *testing.T) {
+	s := newResumeConn(time.Minute)
+	defer s.Close()
+	c, peer := net.Pipe()
+	go io.Copy(io.Discard, peer)
+	s.carrier = c
+
+	got := make(chan string, 1)
+	go func() {
+		buf := make([]byte, 10)
+		io.ReadFull(s, buf)
+		got <- string(buf)
+	}()
+	for _, v := range []struct {
+		seq  uint64
+		data string
+		n    int
+	}{
+		{0, "hello", 5},
+		{3, "loworld", 5}, // 部分重复
+		{0, "hello", 0},   // 全部重复
+	} {
+		n, err := s.deliver(c, v.seq, []byte(v.data))
+		if err != nil || n != v.n {
+			t.Fatalf("记录[%d]%q: 预期新收到%d字节,得到%d %v", v.seq, v.data, v.n, n, err)
+		}
+	}
+	select {
+	case bs := <-got:
+		if bs != "helloworld" {
+			t.Fatalf("收到的数据不一致: %q", bs)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("读取数据超时")
+	}
+
+	// 已经被替换的底层连接上的记录丢弃
+	old, _ := net.Pipe()
+	if _, err := s.deliver(old, 10, []byte("x")); !errors.Is(err, io.ErrClosedPipe) {
+		t.Fatalf("预期 io.ErrClosedPipe,得到 %v", err)
+	}
+	// 中间的数据丢失
+	if _, err := s.deliver(c, 20, []byte("x")); !errors.Is(err, ErrResume) || !s.Closed() {
+		t.Fatalf("预期 ErrResume 并关闭会话,得到 %v", err)
+	}
+}
+
+// TestResumeStalledReader 上层读取慢时读取协程阻塞,期间收不到对端的心跳,不能断开正常的底层连接
+func TestResumeStalledReader(t *testing.T) {
+	client, server, dials := newResumePair(t)
+	carrier := server.currentCarrier()
+
+	go client.Write([]byte("stall"))
+	waitFor(t, "读取协程没有阻塞", server.blocked.Load)
+
+	// 模拟已经很久没有收到对端的数据,立即检查心跳
+	server.lastRecv.Store(time.Now().Add(-time.Hour).UnixNano())
+	signal(server.ackNow)
+	time.Sleep(50 * time.Millisecond)
+
+	if s := readTimeout(t, server, 5); s != "stall" {
+		t.Fatalf("收到的数据不一致: %q", s)
+	}
+	if server.currentCarrier() != carrier || dials.Load() != 1 {
+		t.Fatalf("断开了正常的底层连接,建立了%d次底层连接", dials.Load())
+	}
+	if time.Since(time.Unix(0, server.lastRecv.Load())) > time.Second {
+		t.Fatal("读取协程恢复后没有重新计时")
+	}
+}
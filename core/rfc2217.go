@@ -0,0 +1,479 @@
+package core
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"go.bug.st/serial"
+)
+
+// ParamRFC2217 串口连接是否使用 RFC 2217(Telnet COM-PORT-OPTION)协议,用于 Dial
+// 开启后数据流为 Telnet 格式,串口参数(波特率/校验位/DTR/RTS等)可以通过数据流中的控制消息修改,
+// 可以直接使用支持 RFC 2217 的终端工具(例如 pyserial 的 rfc2217://)连接服务端的监听端口
+const ParamRFC2217 = "rfc2217"
+
+// Telnet 命令和选项
+const (
+	telnetSE   = 240
+	telnetSB   = 250
+	telnetWILL = 251
+	telnetWONT = 252
+	telnetDO   = 253
+	telnetDONT = 254
+	telnetIAC  = 255
+
+	telnetBinary  = 0
+	telnetSGA     = 3
+	telnetComPort = 44
+)
+
+// RFC 2217 命令,服务端的响应为命令+100
+const (
+	comSignature      = 0
+	comSetBaudRate    = 1
+	comSetDataSize    = 2
+	comSetParity      = 3
+	comSetStopSize    = 4
+	comSetControl     = 5
+	comNotifyLine     = 6
+	comNotifyModem    = 7
+	comFlowSuspend    = 8
+	comFlowResume     = 9
+	comSetLineMask    = 10
+	comSetModemMask   = 11
+	comPurgeData      = 12
+	comServerResponse = 100
+)
+
+// RFC 2217 SET-CONTROL 的取值
+const (
+	comControlBreakOn  = 5
+	comControlBreakOff = 6
+	comControlDTROn    = 8
+	comControlDTROff   = 9
+	comControlRTSOn    = 11
+	comControlRTSOff   = 12
+)
+
+// rfc2217Signature 响应 SIGNATURE 命令的标识
+const rfc2217Signature = "injoyai/proxy"
+
+// rfc2217MaxSub 子协商数据的最大长度,串口控制命令不会超过,超过的部分丢弃,防止无限增长
+const rfc2217MaxSub = 64
+
+// rfc2217Parity RFC 2217 的校验位取值和串口库的对应关系,下标为 RFC 2217 的取值
+var rfc2217Parity = []serial.Parity{0, serial.NoParity, serial.OddParity, serial.EvenParity, serial.MarkParity, serial.SpaceParity}
+
+// rfc2217StopBits RFC 2217 的停止位取值和串口库的对应关系,下标为 RFC 2217 的取值
+var rfc2217StopBits = []serial.StopBits{0, serial.OneStopBit, serial.TwoStopBits, serial.OnePointFiveStopBits}
+
+// NewRFC2217 将串口连接包装成 RFC 2217 服务端(串口服务器)
+// 写入的数据按 Telnet 格式解析,普通数据写入串口,控制消息用于修改串口参数并响应当前值,
+// 读取的数据为串口收到的数据(按 Telnet 格式转义)和控制消息的响应
+func NewRFC2217(c *SerialConn, mode *serial.Mode) net.Conn {
+	pr, pw := io.Pipe()
+	r := &rfc2217{
+		SerialConn: c,
+		mode:       *mode,
+		pr:         pr,
+		pw:         pw,
+		options:    map[[2]byte]bool{},
+	}
+	go func() {
+		// 主动请求对端启用串口控制选项
+		r.send([]byte{telnetIAC, telnetDO, telnetComPort})
+		r.run()
+	}()
+	return r
+}
+
+type rfc2217 struct {
+	*SerialConn
+	mode serial.Mode // mode 当前的串口参数
+
+	pr  *io.PipeReader
+	pw  *io.PipeWriter
+	wMu sync.Mutex // wMu 串口数据和控制消息的响应共用输出,需要保证完整性
+
+	state   int              // state Telnet 解析状态
+	cmd     byte             // cmd 当前的 Telnet 命令(WILL/WONT/DO/DONT)
+	sb      []byte           // sb 子协商的数据
+	options map[[2]byte]bool // options 已经回复过的选项协商,避免循环协商
+}
+
+// Telnet 解析状态
+const (
+	telnetData = iota
+	telnetCmd
+	telnetOption
+	telnetSub
+	telnetSubIAC
+)
+
+// run 读取串口数据,转义后输出
+func (this *rfc2217) run() {
+	buf := make([]byte, 4096)
+	for {
+		n, err := this.SerialConn.Read(buf)
+		if err != nil {
+			this.pw.CloseWithError(err)
+			return
+		}
+		this.send(telnetEscape(buf[:n]))
+	}
+}
+
+// send 输出数据
+func (this *rfc2217) send(p []byte) {
+	this.wMu.Lock()
+	defer this.wMu.Unlock()
+	this.pw.Write(p)
+}
+
+func (this *rfc2217) Read(p []byte) (int, error) {
+	return this.pr.Read(p)
+}
+
+// Write 解析 Telnet 数据,普通数据写入串口,控制消息修改串口参数,不支持并发调用
+func (this *rfc2217) Write(p []byte) (int, error) {
+	data := make([]byte, 0, len(p))
+	for _, b := range p {
+		switch this.state {
+		case telnetData:
+			if b == telnetIAC {
+				this.state = telnetCmd
+				continue
+			}
+			data = append(data, b)
+		case telnetCmd:
+			switch b {
+			case telnetIAC:
+				data = append(data, b)
+				this.state = telnetData
+			case telnetWILL, telnetWONT, telnetDO, telnetDONT:
+				this.cmd = b
+				this.state = telnetOption
+			case telnetSB:
+				this.sb = this.sb[:0]
+				this.state = telnetSub
+			default:
+				// 其他 Telnet 命令(NOP等)忽略
+				this.state = telnetData
+			}
+		case telnetOption:
+			this.negotiate(this.cmd, b)
+			this.state = telnetData
+		case telnetSub:
+			if b == telnetIAC {
+				this.state = telnetSubIAC
+				continue
+			}
+			this.appendSub(b)
+		case telnetSubIAC:
+			switch b {
+			case telnetSE:
+				this.subnegotiate(this.sb)
+				this.state = telnetData
+			default:
+				// IAC IAC 表示数据 0xFF
+				this.appendSub(b)
+				this.state = telnetSub
+			}
+		}
+	}
+	if len(data) > 0 {
+		if _, err := this.SerialConn.Write(data); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+// appendSub 保存子协商的数据,超过 rfc2217MaxSub 的部分丢弃
+func (this *rfc2217) appendSub(b byte) {
+	if len(this.sb) < rfc2217MaxSub {
+		this.sb = append(this.sb, b)
+	}
+}
+
+// negotiate 处理选项协商,只接受二进制、抑制继续和串口控制选项
+func (this *rfc2217) negotiate(cmd, option byte) {
+	supported := option == telnetBinary || option == telnetSGA || option == telnetComPort
+	var reply byte
+	switch cmd {
+	case telnetWILL:
+		reply = telnetDONT
+		if supported {
+			reply = telnetDO
+		}
+	case telnetDO:
+		reply = telnetWONT
+		if supported && option != telnetComPort {
+			reply = telnetWILL
+		}
+	default:
+		return
+	}
+	key := [2]byte{cmd, option}
+	if this.options[key] {
+		return
+	}
+	this.options[key] = true
+	this.send([]byte{telnetIAC, reply, option})
+}
+
+// subnegotiate 处理串口控制命令,修改串口参数并响应当前值
+func (this *rfc2217) subnegotiate(sb []byte) {
+	if len(sb) < 2 || sb[0] != telnetComPort {
+		return
+	}
+	cmd, value := sb[1], sb[2:]
+	switch cmd {
+	case comSignature:
+		this.reply(cmd, []byte(rfc2217Signature))
+	case comSetBaudRate:
+		if len(value) == 4 {
+			if baud := int(binary.BigEndian.Uint32(value)); baud > 0 {
+				this.setMode(func(m *serial.Mode) { m.BaudRate = baud })
+			}
+		}
+		this.reply(cmd, binary.BigEndian.AppendUint32(nil, uint32(this.mode.BaudRate)))
+	case comSetDataSize:
+		if len(value) == 1 && value[0] >= 5 && value[0] <= 8 {
+			this.setMode(func(m *serial.Mode) { m.DataBits = int(value[0]) })
+		}
+		this.reply(cmd, []byte{byte(this.mode.DataBits)})
+	case comSetParity:
+		if len(value) == 1 && value[0] > 0 && int(value[0]) < len(rfc2217Parity) {
+			this.setMode(func(m *serial.Mode) { m.Parity = rfc2217Parity[value[0]] })
+		}
+		for i, v := range rfc2217Parity[1:] {
+			if v == this.mode.Parity {
+				this.reply(cmd, []byte{byte(i + 1)})
+			}
+		}
+	case comSetStopSize:
+		if len(value) == 1 && value[0] > 0 && int(value[0]) < len(rfc2217StopBits) {
+			this.setMode(func(m *serial.Mode) { m.StopBits = rfc2217StopBits[value[0]] })
+		}
+		for i, v := range rfc2217StopBits[1:] {
+			if v == this.mode.StopBits {
+				this.reply(cmd, []byte{byte(i + 1)})
+			}
+		}
+	case comSetControl:
+		if len(value) == 1 {
+			this.control(value[0])
+			this.reply(cmd, value)
+		}
+	case comSetLineMask, comSetModemMask:
+		// 不支持状态通知,按原值响应
+		this.reply(cmd, value)
+	case comPurgeData:
+		if len(value) == 1 {
+			if value[0] == 1 || value[0] == 3 {
+				this.SerialConn.ResetInputBuffer()
+			}
+			if value[0] == 2 || value[0] == 3 {
+				this.SerialConn.ResetOutputBuffer()
+			}
+			this.reply(cmd, value)
+		}
+	case comFlowSuspend, comFlowResume, comNotifyLine, comNotifyModem:
+		// 流控暂停/恢复和状态通知不处理
+	}
+}
+
+// setMode 修改串口参数,失败时保持原参数
+func (this *rfc2217) setMode(f func(m *serial.Mode)) {
+	mode := this.mode
+	f(&mode)
+	if this.SerialConn.SetMode(&mode) == nil {
+		this.mode = mode
+	}
+}
+
+// control 处理 SET-CONTROL 命令,支持 DTR/RTS/BREAK
+func (this *rfc2217) control(v byte) {
+	switch v {
+	case comControlDTROn, comControlDTROff:
+		this.SerialConn.SetDTR(v == comControlDTROn)
+	case comControlRTSOn, comControlRTSOff:
+		this.SerialConn.SetRTS(v == comControlRTSOn)
+	case comControlBreakOn:
+		go this.SerialConn.Break(time.Millisecond * 250)
+	case comControlBreakOff:
+	}
+}
+
+// reply 响应串口控制命令
+func (this *rfc2217) reply(cmd byte, value []byte) {
+	bs := []byte{telnetIAC, telnetSB, telnetComPort, cmd + comServerResponse}
+	bs = append(bs, telnetEscape(value)...)
+	this.send(append(bs, telnetIAC, telnetSE))
+}
+
+func (this *rfc2217) Close() error {
+	this.pw.Close()
+	return this.SerialConn.Close()
+}
+
+// SetDeadline 串口由后台持续读取,忽略超时
+func (this *rfc2217) SetDeadline(t time.Time) error { return nil }
+
+// SetReadDeadline 串口由后台持续读取,忽略读超时
+func (this *rfc2217) SetReadDeadline(t time.Time) error { return nil }
+
+// telnetEscape 转义数据中的 0xFF
+func telnetEscape(p []byte) []byte {
+	out := make([]byte, 0, len(p))
+	for _, b := range p {
+		out = append(out, b)
+		if b == telnetIAC {
+			out = append(out, telnetIAC)
+		}
+	}
+	return out
+}
+
+// NewRFC2217Client 创建一个 RFC 2217 客户端,用于通过隧道远程修改串口参数
+// c 通常为连接到服务端监听端口的连接,对端需要使用 ParamRFC2217 打开串口
+// 读写的数据为串口的原始数据,Telnet 格式的转义和控制消息由客户端处理
+func NewRFC2217Client(c io.ReadWriteCloser) (*RFC2217Client, error) {
+	cli := &RFC2217Client{ReadWriteCloser: c}
+	_, err := c.Write([]byte{
+		telnetIAC, telnetWILL, telnetComPort,
+		telnetIAC, telnetWILL, telnetBinary,
+		telnetIAC, telnetDO, telnetBinary,
+	})
+	return cli, err
+}
+
+// RFC2217Client RFC 2217 客户端
+type RFC2217Client struct {
+	io.ReadWriteCloser
+	wMu   sync.Mutex
+	state int
+	buf   []byte
+}
+
+// SetMode 修改串口参数
+func (this *RFC2217Client) SetMode(mode *serial.Mode) error {
+	if err := this.SetBaudRate(mode.BaudRate); err != nil {
+		return err
+	}
+	cmds := [][]byte{{comSetDataSize, byte(mode.DataBits)}}
+	for i, v := range rfc2217Parity[1:] {
+		if v == mode.Parity {
+			cmds = append(cmds, []byte{comSetParity, byte(i + 1)})
+		}
+	}
+	for i, v := range rfc2217StopBits[1:] {
+		if v == mode.StopBits {
+			cmds = append(cmds, []byte{comSetStopSize, byte(i + 1)})
+		}
+	}
+	for _, v := range cmds {
+		if err := this.command(v[0], v[1:]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SetBaudRate 修改波特率
+func (this *RFC2217Client) SetBaudRate(baud int) error {
+	return this.command(comSetBaudRate, binary.BigEndian.AppendUint32(nil, uint32(baud)))
+}
+
+// SetDTR 设置 DTR 信号
+func (this *RFC2217Client) SetDTR(b bool) error {
+	if b {
+		return this.command(comSetControl, []byte{comControlDTROn})
+	}
+	return this.command(comSetControl, []byte{comControlDTROff})
+}
+
+// SetRTS 设置 RTS 信号
+func (this *RFC2217Client) SetRTS(b bool) error {
+	if b {
+		return this.command(comSetControl, []byte{comControlRTSOn})
+	}
+	return this.command(comSetControl, []byte{comControlRTSOff})
+}
+
+// command 发送串口控制命令,不等待响应
+func (this *RFC2217Client) command(cmd byte, value []byte) error {
+	bs := []byte{telnetIAC, telnetSB, telnetComPort, cmd}
+	bs = append(bs, telnetEscape(value)...)
+	bs = append(bs, telnetIAC, telnetSE)
+	this.wMu.Lock()
+	defer this.wMu.Unlock()
+	_, err := this.ReadWriteCloser.Write(bs)
+	return err
+}
+
+// Write 写入串口数据
+func (this *RFC2217Client) Write(p []byte) (int, error) {
+	this.wMu.Lock()
+	defer this.wMu.Unlock()
+	if _, err := this.ReadWriteCloser.Write(telnetEscape(p)); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Read 读取串口数据,忽略 Telnet 命令和控制消息的响应,不支持并发调用
+func (this *RFC2217Client) Read(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	for {
+		if len(this.buf) > 0 {
+			n := copy(p, this.buf)
+			this.buf = this.buf[n:]
+			return n, nil
+		}
+		buf := make([]byte, len(p))
+		n, err := this.ReadWriteCloser.Read(buf)
+		for _, b := range buf[:n] {
+			switch this.state {
+			case telnetData:
+				if b == telnetIAC {
+					this.state = telnetCmd
+					continue
+				}
+				this.buf = append(this.buf, b)
+			case telnetCmd:
+				switch b {
+				case telnetIAC:
+					this.buf = append(this.buf, b)
+					this.state = telnetData
+				case telnetWILL, telnetWONT, telnetDO, telnetDONT:
+					this.state = telnetOption
+				case telnetSB:
+					this.state = telnetSub
+				default:
+					this.state = telnetData
+				}
+			case telnetOption:
+				this.state = telnetData
+			case telnetSub:
+				if b == telnetIAC {
+					this.state = telnetSubIAC
+				}
+			case telnetSubIAC:
+				this.state = telnetSub
+				if b == telnetSE {
+					this.state = telnetData
+				}
+			}
+		}
+		if len(this.buf) == 0 && err != nil {
+			return 0, err
+		}
+	}
+}
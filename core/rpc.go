@@ -0,0 +1,169 @@
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/injoyai/conv"
+	"github.com/injoyai/logs"
+)
+
+// DefaultRPCConcurrency 默认的同时执行的远程调用数量上限
+const DefaultRPCConcurrency = 64
+
+// DefaultRPCQueue 默认的等待执行的远程调用数量上限
+const DefaultRPCQueue = 256
+
+// Method 远程调用的方法,args 为调用方的参数,返回值作为结果返回给调用方
+// 参数和结果为 []byte 或 string 时原样传输,其他类型使用JSON编码
+// 返回的错误会传给调用方,*Error 会保留错误码(可以使用自定义的错误码)
+// 每次调用在单独的协程中执行,不会阻塞隧道和其他调用,同时执行的数量见 WithRPCConcurrency
+type Method func(tun *Tunnel, args []byte) (any, error)
+
+// HandleMethod 注册远程调用的方法,method 为方法名,长度不超过255,f 为nil时取消注册
+func (this *Tunnel) HandleMethod(method string, f Method) {
+	this.handlerMu.Lock()
+	defer this.handlerMu.Unlock()
+	if f == nil {
+		delete(this.methods, method)
+		return
+	}
+	this.methods[method] = f
+}
+
+// Call 调用对端的方法,结果解码到 reply,reply 为nil时忽略结果,超时时间为等待响应的超时时间
+func (this *Tunnel) Call(method string, args, reply any) error {
+	return this.CallContext(context.Background(), method, args, reply)
+}
+
+// CallContext 调用对端的方法,ctx 可以设置本次调用的超时时间,结束时放弃等待并返回 ctx 的错误
+// reply 为 *[]byte 或 *string 时原样保存结果,其他类型使用JSON解码
+func (this *Tunnel) CallContext(ctx context.Context, method string, args, reply any) error {
+	if len(method) == 0 || len(method) > 255 {
+		return ErrMethod
+	}
+	body, err := encodePayload(args)
+	if err != nil {
+		return err
+	}
+	timeout := this.timeout
+	if deadline, ok := ctx.Deadline(); ok {
+		// 使用 ctx 的超时时间,等待的时间稍长,保证超时时返回 ctx 的错误
+		timeout = time.Until(deadline) + time.Second
+	}
+	data := make([]byte, 0, 1+len(method)+len(body))
+	data = append(data, byte(len(method)))
+	data = append(data, method...)
+	data = append(data, body...)
+	resp, err := this.requestContext(ctx, timeout, this.newID(""), RPC, data)
+	if err != nil {
+		return err
+	}
+	return decodePayload(conv.Bytes(resp), reply)
+}
+
+// goRPC 在单独的协程中执行对端的远程调用,同时执行的调用达到上限时排队等待,
+// 排队的调用也达到上限时直接响应 ErrBusy
+func (this *Tunnel) goRPC(msgID string, needAck bool, data []byte) {
+	sem, queue := this.rpc, this.rpcQueue
+	if sem != nil {
+		select {
+		case queue <- struct{}{}:
+		default:
+			this.replyRPC(msgID, needAck, nil, ErrBusy)
+			return
+		}
+	}
+	go func() {
+		if sem != nil {
+			select {
+			case sem <- struct{}{}:
+			case <-this.Done():
+				<-queue
+				return
+			}
+		}
+		resp, err := this.callMethod(data)
+		if sem != nil {
+			// 方法执行完毕即释放,响应的发送不占用名额
+			<-sem
+			<-queue
+		}
+		this.replyRPC(msgID, needAck, resp, err)
+	}()
+}
+
+// replyRPC 响应对端的远程调用,对端不需要响应时忽略
+func (this *Tunnel) replyRPC(msgID string, needAck bool, resp []byte, err error) {
+	if err != nil {
+		logs.Trace("[错误]", err)
+	}
+	if !needAck {
+		return
+	}
+	if err != nil {
+		err = this.WritePacket(msgID, RPC, Response|Fail, encodeError(err, this.Negotiated().HasFeature(FeatureErrorCode)))
+	} else {
+		err = this.WritePacket(msgID, RPC, Response|Success, resp)
+	}
+	logs.PrintErr(err)
+}
+
+// callMethod 解析方法名并执行方法,返回编码后的结果
+func (this *Tunnel) callMethod(data []byte) ([]byte, error) {
+	if !this.registered.Load() {
+		return nil, ErrNotRegister
+	}
+	if len(data) == 0 || len(data) < 1+int(data[0]) {
+		return nil, ErrFrameInvalid
+	}
+	method := string(data[1 : 1+data[0]])
+	this.handlerMu.RLock()
+	f := this.methods[method]
+	this.handlerMu.RUnlock()
+	if f == nil {
+		return nil, &Error{Code: CodeMethod, Target: method}
+	}
+	res, err := f(this, data[1+data[0]:])
+	if err != nil {
+		return nil, err
+	}
+	return encodePayload(res)
+}
+
+// encodePayload 编码参数或结果,[]byte 和 string 原样传输,其他类型使用JSON编码
+func encodePayload(v any) ([]byte, error) {
+	switch val := v.(type) {
+	case nil:
+		return nil, nil
+	case []byte:
+		return val, nil
+	case string:
+		return []byte(val), nil
+	}
+	return json.Marshal(v)
+}
+
+// decodePayload 解码参数或结果,见 encodePayload
+func decodePayload(data []byte, v any) error {
+	switch val := v.(type) {
+	case nil:
+		return nil
+	case *[]byte:
+		*val = data
+		return nil
+	case *string:
+		*val = string(data)
+		return nil
+	}
+	if len(data) == 0 {
+		return nil
+	}
+	return json.Unmarshal(data, v)
+}
+
+// DecodeArgs 解码远程调用的参数,见 Method
+func DecodeArgs(args []byte, v any) error {
+	return decodePayload(args, v)
+}
@@ -0,0 +1,74 @@
+package core
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+// TestRPCConcurrency 同时执行的远程调用达到上限时排队等待,排队也达到上限时新的调用返回 ErrBusy,
+// 执行结束后排队的调用继续执行
+func TestRPCConcurrency(t *testing.T) {
+	release := make(chan struct{})
+	s, c := newTestPair(t, []TunnelOption{WithRPCConcurrency(1, 1),
+		WithMethod("wait", func(tun *Tunnel, args []byte) (any, error) {
+			<-release
+			return "done:" + string(args), nil
+		})}, nil)
+
+	done := make(chan error, 2)
+	call := func(args string) {
+		var reply string
+		err := c.Call("wait", args, &reply)
+		if err == nil && reply != "done:"+args {
+			err = errors.New("调用结果不一致: " + reply)
+		}
+		done <- err
+	}
+
+	// 第一个调用执行,第二个调用排队
+	go call("1")
+	waitFor(t, "调用没有开始执行", func() bool { return len(s.rpc) == 1 })
+	go call("2")
+	waitFor(t, "调用没有排队", func() bool { return len(s.rpcQueue) == 2 })
+
+	err := c.Call("wait", nil, nil)
+	if !errors.Is(err, ErrBusy) || CodeOf(err) != CodeBusy || !Temporary(err) {
+		t.Fatalf("预期 ErrBusy,得到 %v", err)
+	}
+
+	close(release)
+	for i := 0; i < 2; i++ {
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Fatal(err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("排队的调用没有执行")
+		}
+	}
+	if err := c.Call("wait", "3", nil); err != nil {
+		t.Fatal(err)
+	}
+	if len(s.rpc) != 0 || len(s.rpcQueue) != 0 {
+		t.Fatalf("调用结束后没有释放名额: %d %d", len(s.rpc), len(s.rpcQueue))
+	}
+}
+
+// TestRPCNoQueue 不排队时同时执行的调用达到上限立即返回 ErrBusy
+func TestRPCNoQueue(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	s, c := newTestPair(t, []TunnelOption{WithRPCConcurrency(1, 0),
+		WithMethod("wait", func(tun *Tunnel, args []byte) (any, error) {
+			<-release
+			return nil, nil
+		})}, nil)
+
+	go c.Call("wait", nil, nil)
+	waitFor(t, "调用没有开始执行", func() bool { return len(s.rpc) == 1 })
+	if err := c.Call("wait", nil, nil); !errors.Is(err, ErrBusy) {
+		t.Fatalf("预期 ErrBusy,得到 %v", err)
+	}
+}
@@ -0,0 +1,575 @@
+package core
+
+import (
+	"cmp"
+	"context"
+	"encoding/binary"
+	"io"
+	"math/rand/v2"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/injoyai/base/safe"
+	"github.com/injoyai/conv"
+)
+
+// 可靠UDP相关的自定义参数(Param)名称,用于 Dial 和 Listen,两端建议使用相同的配置
+const (
+	ParamWindow   = "window"   // ParamWindow 收发窗口大小(数据段数量),默认128,高延迟高带宽的线路需要调大
+	ParamInterval = "interval" // ParamInterval 检查重传和发送确认的间隔,例如"10ms",默认10ms
+	ParamRTO      = "rto"      // ParamRTO 最小重传超时时间,例如"50ms",默认50ms,调小可以更快的重传,但会增加误重传
+)
+
+const (
+	DefaultRUDPWindow   = 128                    // DefaultRUDPWindow 默认的收发窗口大小
+	DefaultRUDPInterval = time.Millisecond * 10  // DefaultRUDPInterval 默认的检查重传间隔
+	DefaultRUDPMinRTO   = time.Millisecond * 50  // DefaultRUDPMinRTO 默认的最小重传超时时间
+	rudpInitRTO         = time.Millisecond * 200 // rudpInitRTO 还没有测得往返时间时的重传超时时间
+	rudpMaxRTO          = time.Second * 60       // rudpMaxRTO 最大的重传超时时间
+	rudpMTU             = 1400                   // rudpMTU 单个数据报的最大长度,避免IP分片
+	rudpHeader          = 15                     // rudpHeader 数据段头部的长度
+	rudpMSS             = rudpMTU - rudpHeader   // rudpMSS 单个数据段的最大数据长度
+	rudpDeadLink        = 20                     // rudpDeadLink 单个数据段的最大超时重传次数,超过后认为对端已断开
+	rudpFastResend      = 2                      // rudpFastResend 被后续数据段的确认跳过多少次后立即重传
+	rudpKeepalive       = time.Second * 10       // rudpKeepalive 没有数据时发送心跳的间隔
+	rudpDeadTimeout     = rudpKeepalive * 3      // rudpDeadTimeout 超过这个时间没有收到对端的数据认为对端已断开
+	rudpLinger          = time.Second * 5        // rudpLinger 关闭时等待已写入的数据被对端确认的最长时间
+)
+
+// 数据段类型
+const (
+	rudpPush  byte = 1 // rudpPush 数据
+	rudpAck   byte = 2 // rudpAck 确认,数据为确认的序号列表
+	rudpPing  byte = 3 // rudpPing 心跳和窗口更新
+	rudpClose byte = 4 // rudpClose 关闭连接
+)
+
+// RUDPConfig 可靠UDP的配置
+type RUDPConfig struct {
+	Window   int           // Window 收发窗口大小(数据段数量)
+	Interval time.Duration // Interval 检查重传和发送确认的间隔
+	MinRTO   time.Duration // MinRTO 最小重传超时时间
+}
+
+// NewRUDPConfig 根据自定义参数生成可靠UDP的配置
+func NewRUDPConfig(param map[string]any) *RUDPConfig {
+	cfg := &RUDPConfig{
+		Window:   DefaultRUDPWindow,
+		Interval: DefaultRUDPInterval,
+		MinRTO:   DefaultRUDPMinRTO,
+	}
+	if v := conv.Int(param[ParamWindow]); v > 0 {
+		cfg.Window = min(v, 0xFFFF)
+	}
+	if v, ok := param[ParamInterval]; ok && parseDuration(v) > 0 {
+		cfg.Interval = parseDuration(v)
+	}
+	if v, ok := param[ParamRTO]; ok && parseDuration(v) > 0 {
+		cfg.MinRTO = parseDuration(v)
+	}
+	return cfg
+}
+
+// NewDialRUDP 创建一个可靠UDP类型的拨号器
+func NewDialRUDP(address string, timeout ...time.Duration) *Dial {
+	return &Dial{
+		Type:    RUDP,
+		Address: address,
+		Timeout: conv.Default(0, timeout...),
+	}
+}
+
+// NewListenRUDP 创建一个可靠UDP类型的监听器配置,同一来源地址的数据报作为一个连接
+func NewListenRUDP[T cmp.Ordered](addr T, op ...ListenOption) *Listen {
+	return NewListen(RUDP, addr, op...)
+}
+
+// dialRUDP 建立可靠UDP连接
+func dialRUDP(ctx context.Context, d *Dial) (net.Conn, error) {
+	c, err := (&net.Dialer{Timeout: d.Timeout}).DialContext(ctx, UDP, d.Address)
+	if err != nil {
+		return nil, err
+	}
+	return NewRUDPConn(c, NewRUDPConfig(d.Param)), nil
+}
+
+// listenRUDP 监听可靠UDP端口,按来源地址区分连接
+// 连接由心跳判断对端是否断开,默认不设置UDP会话的空闲超时
+func listenRUDP(l *Listen) (net.Listener, error) {
+	c, err := net.ListenPacket(UDP, l.Address)
+	if err != nil {
+		return nil, err
+	}
+	var idle time.Duration
+	if v, ok := l.Param[ParamIdle]; ok {
+		idle = parseDuration(v)
+	}
+	cfg := NewRUDPConfig(l.Param)
+	return newUDPListener(c, idle, func(c net.Conn) net.Conn {
+		return newRUDPConn(c, 0, cfg)
+	}), nil
+}
+
+// NewRUDPConn 在数据报连接上建立可靠的字节流连接(类似KCP的ARQ),用于丢包较多的线路
+// 丢失的数据段单独重传,不会像TCP一样因为拥塞控制大幅降速
+// c 每次 Read 需要返回一个完整的数据报,例如 net.UDPConn,cfg 为空时使用默认配置
+func NewRUDPConn(c net.Conn, cfg *RUDPConfig) *RUDPConn {
+	return newRUDPConn(c, rand.Uint32()|1, cfg)
+}
+
+// newRUDPConn conv 为连接标识,用于丢弃其他连接的数据段,0表示使用收到的第一个数据段的标识
+func newRUDPConn(c net.Conn, conv uint32, cfg *RUDPConfig) *RUDPConn {
+	if cfg == nil {
+		cfg = NewRUDPConfig(nil)
+	}
+	now := time.Now()
+	r := &RUDPConn{
+		Closer:   safe.NewCloser(),
+		conn:     c,
+		cfg:      *cfg,
+		conv:     conv,
+		rmtWnd:   uint32(cfg.Window),
+		rcvBuf:   make(map[uint32][]byte),
+		rto:      max(rudpInitRTO, cfg.MinRTO),
+		lastSend: now,
+		lastRecv: now,
+		rSignal:  make(chan struct{}, 1),
+		wSignal:  make(chan struct{}, 1),
+	}
+	r.SetCloseFunc(func(err error) error {
+		r.mu.Lock()
+		bs := r.segment(rudpClose, 0, nil)
+		r.mu.Unlock()
+		// 尽量通知对端关闭,丢失时对端由心跳超时关闭
+		c.Write(bs)
+		return c.Close()
+	})
+	go r.readLoop()
+	go r.tickLoop()
+	return r
+}
+
+// RUDPConn 可靠UDP连接,实现了 net.Conn
+type RUDPConn struct {
+	*safe.Closer
+	conn net.Conn
+	cfg  RUDPConfig
+	mu   sync.Mutex
+	conv uint32 // conv 连接标识
+
+	sndQueue [][]byte       // sndQueue 等待发送的数据段
+	sndBuf   []*rudpSegment // sndBuf 已发送未确认的数据段,按序号排序
+	sndNxt   uint32         // sndNxt 下一个数据段的序号
+	rmtWnd   uint32         // rmtWnd 对端的接收窗口
+
+	rcvNxt   uint32            // rcvNxt 下一个期望收到的序号
+	rcvBuf   map[uint32][]byte // rcvBuf 乱序收到的数据段
+	rcvQueue []byte            // rcvQueue 已按顺序收到未读取的数据
+	acks     []uint32          // acks 等待发送的确认
+	lastWnd  uint32            // lastWnd 上次通告的接收窗口
+
+	srtt, rttvar, rto  time.Duration
+	lastSend, lastRecv time.Time
+
+	retransmitted atomic.Uint64
+	deadline      atomic.Int64 // deadline 读超时时间(纳秒时间戳),0表示不超时
+	wDeadline     atomic.Int64 // wDeadline 写超时时间(纳秒时间戳),0表示不超时
+	rSignal       chan struct{}
+	wSignal       chan struct{}
+}
+
+type rudpSegment struct {
+	sn       uint32
+	data     []byte
+	xmit     int           // xmit 发送次数
+	timeouts int           // timeouts 超时重传的次数
+	rto      time.Duration // rto 当前的重传超时时间
+	sentAt   time.Time
+	resendAt time.Time
+	fastack  int // fastack 被后续数据段的确认跳过的次数
+}
+
+// seqBefore 序号 a 是否在 b 之前,处理序号回绕
+func seqBefore(a, b uint32) bool { return int32(a-b) < 0 }
+
+// signal 非阻塞的通知等待者
+func signal(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+// readLoop 读取数据报并处理
+func (this *RUDPConn) readLoop() {
+	buf := make([]byte, udpMaxDatagram)
+	for {
+		n, err := this.conn.Read(buf)
+		if err != nil {
+			this.CloseWithErr(err)
+			return
+		}
+		this.input(buf[:n])
+	}
+}
+
+// tickLoop 定时检查重传、发送确认和心跳
+func (this *RUDPConn) tickLoop() {
+	t := time.NewTicker(this.cfg.Interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-this.Done():
+			return
+		case <-t.C:
+			this.mu.Lock()
+			dead := time.Since(this.lastRecv) > rudpDeadTimeout
+			out, deadLink := this.flush(time.Now())
+			this.mu.Unlock()
+			if dead || deadLink {
+				this.CloseWithErr(ErrTimeout)
+				return
+			}
+			this.output(out)
+		}
+	}
+}
+
+// input 处理收到的数据报
+func (this *RUDPConn) input(p []byte) {
+	if len(p) < rudpHeader {
+		return
+	}
+	conv := binary.BigEndian.Uint32(p)
+	cmd := p[4]
+	wnd := uint32(binary.BigEndian.Uint16(p[5:]))
+	sn := binary.BigEndian.Uint32(p[7:])
+	una := binary.BigEndian.Uint32(p[11:])
+	data := p[rudpHeader:]
+
+	this.mu.Lock()
+	if this.conv == 0 {
+		this.conv = conv
+	}
+	if conv != this.conv {
+		this.mu.Unlock()
+		return
+	}
+	now := time.Now()
+	this.lastRecv = now
+	this.rmtWnd = wnd
+	inflight := len(this.sndBuf)
+
+	// 对端已经按顺序收到的数据段
+	for len(this.sndBuf) > 0 && seqBefore(this.sndBuf[0].sn, una) {
+		this.sndBuf = this.sndBuf[1:]
+	}
+
+	switch cmd {
+	case rudpAck:
+		for ; len(data) >= 4; data = data[4:] {
+			this.ack(binary.BigEndian.Uint32(data), now)
+		}
+
+	case rudpPush:
+		if seqBefore(sn, this.rcvNxt+uint32(this.cfg.Window)) {
+			// 重复的数据段也需要确认,可能是之前的确认丢失了
+			this.acks = append(this.acks, sn)
+			if _, ok := this.rcvBuf[sn]; !ok && !seqBefore(sn, this.rcvNxt) {
+				this.rcvBuf[sn] = append([]byte(nil), data...)
+			}
+			received := false
+			for bs, ok := this.rcvBuf[this.rcvNxt]; ok; bs, ok = this.rcvBuf[this.rcvNxt] {
+				this.rcvQueue = append(this.rcvQueue, bs...)
+				delete(this.rcvBuf, this.rcvNxt)
+				this.rcvNxt++
+				received = true
+			}
+			if received {
+				signal(this.rSignal)
+			}
+		}
+
+	case rudpClose:
+		this.mu.Unlock()
+		this.CloseWithErr(io.EOF)
+		return
+
+	}
+
+	if len(this.sndBuf) < inflight {
+		signal(this.wSignal)
+	}
+	// 立即发送确认,窗口变大时发送新的数据段
+	out, _ := this.flush(now)
+	this.mu.Unlock()
+	this.output(out)
+}
+
+// ack 处理单个确认,更新往返时间
+func (this *RUDPConn) ack(sn uint32, now time.Time) {
+	for i, seg := range this.sndBuf {
+		if seg.sn == sn {
+			if seg.xmit == 1 {
+				// 重传过的数据段无法判断确认的是哪一次发送,不用于计算往返时间
+				this.updateRTT(now.Sub(seg.sentAt))
+			}
+			this.sndBuf = append(this.sndBuf[:i], this.sndBuf[i+1:]...)
+			return
+		}
+		if seqBefore(seg.sn, sn) {
+			seg.fastack++
+		}
+	}
+}
+
+// updateRTT 按 RFC 6298 计算重传超时时间
+func (this *RUDPConn) updateRTT(rtt time.Duration) {
+	if this.srtt == 0 {
+		this.srtt, this.rttvar = rtt, rtt/2
+	} else {
+		delta := this.srtt - rtt
+		if delta < 0 {
+			delta = -delta
+		}
+		this.rttvar = (3*this.rttvar + delta) / 4
+		this.srtt = (7*this.srtt + rtt) / 8
+	}
+	this.rto = min(max(this.srtt+max(this.cfg.Interval, 4*this.rttvar), this.cfg.MinRTO), rudpMaxRTO)
+}
+
+// rcvWnd 当前的接收窗口
+func (this *RUDPConn) rcvWnd() uint32 {
+	used := len(this.rcvBuf) + (len(this.rcvQueue)+rudpMSS-1)/rudpMSS
+	return uint32(max(this.cfg.Window-used, 0))
+}
+
+// segment 编码数据段,头部为 [标识4][类型1][窗口2][序号4][已收到的序号4]
+func (this *RUDPConn) segment(cmd byte, sn uint32, data []byte) []byte {
+	this.lastWnd = this.rcvWnd()
+	bs := make([]byte, rudpHeader, rudpHeader+len(data))
+	binary.BigEndian.PutUint32(bs, this.conv)
+	bs[4] = cmd
+	binary.BigEndian.PutUint16(bs[5:], uint16(this.lastWnd))
+	binary.BigEndian.PutUint32(bs[7:], sn)
+	binary.BigEndian.PutUint32(bs[11:], this.rcvNxt)
+	return append(bs, data...)
+}
+
+// flush 生成需要发送的数据报,返回是否有数据段超过了最大发送次数
+func (this *RUDPConn) flush(now time.Time) (out [][]byte, deadLink bool) {
+	// 确认
+	for len(this.acks) > 0 {
+		n := min(len(this.acks), rudpMSS/4)
+		data := make([]byte, 0, n*4)
+		for _, sn := range this.acks[:n] {
+			data = binary.BigEndian.AppendUint32(data, sn)
+		}
+		out = append(out, this.segment(rudpAck, 0, data))
+		this.acks = this.acks[n:]
+	}
+	this.acks = nil
+
+	// 对端窗口为0时仍然发送一个数据段,用于探测窗口
+	wnd := min(uint32(this.cfg.Window), this.rmtWnd)
+	if wnd == 0 && len(this.sndBuf) == 0 {
+		wnd = 1
+	}
+	for len(this.sndQueue) > 0 && uint32(len(this.sndBuf)) < wnd {
+		this.sndBuf = append(this.sndBuf, &rudpSegment{sn: this.sndNxt, data: this.sndQueue[0]})
+		this.sndQueue = this.sndQueue[1:]
+		this.sndNxt++
+	}
+	if len(this.sndQueue) == 0 {
+		this.sndQueue = nil
+	}
+
+	for _, seg := range this.sndBuf {
+		switch {
+		case seg.xmit == 0:
+			seg.rto = this.rto
+		case !now.Before(seg.resendAt):
+			// 超时重传,退避重传时间
+			seg.rto = min(seg.rto+seg.rto/2, rudpMaxRTO)
+			seg.timeouts++
+			this.retransmitted.Add(1)
+		case seg.fastack >= rudpFastResend && now.Sub(seg.sentAt) >= this.srtt:
+			// 后续的数据段已经确认,认为已经丢失,每个往返时间最多快速重传一次
+			seg.fastack = 0
+			this.retransmitted.Add(1)
+		default:
+			continue
+		}
+		seg.xmit++
+		seg.sentAt = now
+		seg.resendAt = now.Add(seg.rto)
+		if seg.timeouts > rudpDeadLink {
+			deadLink = true
+		}
+		out = append(out, this.segment(rudpPush, seg.sn, seg.data))
+	}
+
+	if len(out) == 0 && now.Sub(this.lastSend) >= rudpKeepalive {
+		out = append(out, this.segment(rudpPing, 0, nil))
+	}
+	if len(out) > 0 {
+		this.lastSend = now
+	}
+	return
+}
+
+// output 发送数据报,UDP发送失败等同于丢包,由重传处理
+func (this *RUDPConn) output(out [][]byte) {
+	for _, bs := range out {
+		this.conn.Write(bs)
+	}
+}
+
+// Read 读取按顺序收到的数据
+func (this *RUDPConn) Read(p []byte) (int, error) {
+	for {
+		this.mu.Lock()
+		if len(this.rcvQueue) > 0 {
+			n := copy(p, this.rcvQueue)
+			this.rcvQueue = this.rcvQueue[n:]
+			if len(this.rcvQueue) == 0 {
+				this.rcvQueue = nil
+			}
+			var out [][]byte
+			if this.lastWnd == 0 && this.rcvWnd() > 0 {
+				// 对端因为窗口为0暂停了发送,主动通知窗口更新
+				out = append(out, this.segment(rudpPing, 0, nil))
+			}
+			this.mu.Unlock()
+			this.output(out)
+			return n, nil
+		}
+		this.mu.Unlock()
+
+		if this.Closed() {
+			return 0, this.Err()
+		}
+		if err := this.wait(this.rSignal, this.deadline.Load()); err != nil {
+			return 0, err
+		}
+	}
+}
+
+// wait 等待通知、连接关闭或超时,deadline 为超时时间(纳秒时间戳),0表示不超时
+func (this *RUDPConn) wait(ch chan struct{}, deadline int64) error {
+	var timeout <-chan time.Time
+	if deadline != 0 {
+		timer := time.NewTimer(time.Until(time.Unix(0, deadline)))
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case <-ch:
+	case <-this.Done():
+	case <-timeout:
+		return os.ErrDeadlineExceeded
+	}
+	return nil
+}
+
+// Write 写入数据,发送缓存满时阻塞,直到对端确认、连接关闭或写超时
+func (this *RUDPConn) Write(p []byte) (int, error) {
+	n := 0
+	for len(p) > 0 {
+		if t := this.wDeadline.Load(); t != 0 && time.Now().UnixNano() >= t {
+			return n, os.ErrDeadlineExceeded
+		}
+		this.mu.Lock()
+		if this.Closed() {
+			this.mu.Unlock()
+			return n, this.Err()
+		}
+		if len(this.sndQueue)+len(this.sndBuf) >= 2*this.cfg.Window {
+			this.mu.Unlock()
+			if err := this.wait(this.wSignal, this.wDeadline.Load()); err != nil {
+				return n, err
+			}
+			continue
+		}
+		for len(p) > 0 && len(this.sndQueue)+len(this.sndBuf) < 2*this.cfg.Window {
+			size := min(len(p), rudpMSS)
+			this.sndQueue = append(this.sndQueue, append([]byte(nil), p[:size]...))
+			p = p[size:]
+			n += size
+		}
+		out, _ := this.flush(time.Now())
+		this.mu.Unlock()
+		this.output(out)
+	}
+	return n, nil
+}
+
+// Retransmitted 重传的数据段数量
+func (this *RUDPConn) Retransmitted() uint64 {
+	return this.retransmitted.Load()
+}
+
+// RTT 平滑后的往返时间
+func (this *RUDPConn) RTT() time.Duration {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	return this.srtt
+}
+
+// Close 等待已写入的数据被对端确认后关闭连接,最多等待 rudpLinger,超时后丢弃未确认的数据
+func (this *RUDPConn) Close() error {
+	this.linger(time.Now().Add(rudpLinger))
+	return this.CloseWithErr(io.EOF)
+}
+
+// linger 等待发送缓存中的数据全部被对端确认,直到超时或连接关闭
+func (this *RUDPConn) linger(deadline time.Time) {
+	for time.Now().Before(deadline) {
+		this.mu.Lock()
+		pending := len(this.sndQueue) + len(this.sndBuf)
+		this.mu.Unlock()
+		if pending == 0 {
+			return
+		}
+		// 写入也会等待 wSignal,按检查间隔轮询,避免通知被抢走后一直等到超时
+		select {
+		case <-this.wSignal:
+		case <-this.Done():
+			return
+		case <-time.After(this.cfg.Interval):
+		}
+	}
+}
+
+func (this *RUDPConn) LocalAddr() net.Addr { return this.conn.LocalAddr() }
+
+func (this *RUDPConn) RemoteAddr() net.Addr { return this.conn.RemoteAddr() }
+
+func (this *RUDPConn) SetDeadline(t time.Time) error {
+	this.SetReadDeadline(t)
+	return this.SetWriteDeadline(t)
+}
+
+func (this *RUDPConn) SetReadDeadline(t time.Time) error {
+	if t.IsZero() {
+		this.deadline.Store(0)
+	} else {
+		this.deadline.Store(t.UnixNano())
+	}
+	signal(this.rSignal)
+	return nil
+}
+
+// SetWriteDeadline 设置写超时,发送缓存满时 Write 最多等待到这个时间
+func (this *RUDPConn) SetWriteDeadline(t time.Time) error {
+	if t.IsZero() {
+		this.wDeadline.Store(0)
+	} else {
+		this.wDeadline.Store(t.UnixNano())
+	}
+	signal(this.wSignal)
+	return nil
+}
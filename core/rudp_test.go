@@ -0,0 +1,185 @@
+package core
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"io"
+	mrand "math/rand/v2"
+	"net"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+// lossyPipe 内存中的数据报连接对,按 loss 的比例丢包,每个数据报延迟 delay 后送达,
+// 模拟丢包的UDP中转,缓存满时和UDP一样丢弃
+func lossyPipe(loss float64, delay time.Duration) (net.Conn, net.Conn) {
+	a := &lossyConn{in: make(chan []byte, 1024), done: make(chan struct{}), loss: loss, delay: delay}
+	b := &lossyConn{in: make(chan []byte, 1024), done: make(chan struct{}), loss: loss, delay: delay}
+	a.peer, b.peer = b, a
+	return a, b
+}
+
+type lossyConn struct {
+	net.Conn
+	peer  *lossyConn
+	in    chan []byte
+	done  chan struct{}
+	once  sync.Once
+	loss  float64
+	delay time.Duration
+}
+
+func (this *lossyConn) Read(p []byte) (int, error) {
+	select {
+	case bs := <-this.in:
+		return copy(p, bs), nil
+	case <-this.done:
+		return 0, net.ErrClosed
+	}
+}
+
+func (this *lossyConn) Write(p []byte) (int, error) {
+	if mrand.Float64() < this.loss {
+		return len(p), nil
+	}
+	bs := append([]byte(nil), p...)
+	time.AfterFunc(this.delay, func() {
+		select {
+		case this.peer.in <- bs:
+		default:
+		}
+	})
+	return len(p), nil
+}
+
+func (this *lossyConn) Close() error {
+	this.once.Do(func() { close(this.done) })
+	return nil
+}
+
+func (this *lossyConn) LocalAddr() net.Addr { return &net.UDPAddr{} }
+
+func (this *lossyConn) RemoteAddr() net.Addr { return &net.UDPAddr{} }
+
+// newRUDPPair 在丢包的中转上建立一对可靠UDP连接
+func newRUDPPair(t testing.TB, loss float64, delay time.Duration, cfg *RUDPConfig) (*RUDPConn, *RUDPConn) {
+	a, b := lossyPipe(loss, delay)
+	client, server := NewRUDPConn(a, cfg), newRUDPConn(b, 0, cfg)
+	t.Cleanup(func() {
+		client.CloseWithErr(io.EOF)
+		server.CloseWithErr(io.EOF)
+	})
+	return client, server
+}
+
+// TestRUDPLossy 丢包的线路上数据按顺序完整送达,关闭前已写入的数据会等待对端确认
+func TestRUDPLossy(t *testing.T) {
+	client, server := newRUDPPair(t, 0.1, time.Millisecond, nil)
+
+	data := make([]byte, 1<<20)
+	rand.Read(data)
+	closed := make(chan time.Duration, 1)
+	go func() {
+		client.Write(data)
+		start := time.Now()
+		client.Close()
+		closed <- time.Since(start)
+	}()
+
+	// 关闭的通知也可能丢失,按长度读取,不依赖对端关闭
+	done := make(chan []byte, 1)
+	go func() {
+		bs := make([]byte, len(data))
+		n, _ := io.ReadFull(server, bs)
+		done <- bs[:n]
+	}()
+	select {
+	case bs := <-done:
+		if !bytes.Equal(bs, data) {
+			t.Fatalf("数据不一致,收到 %d 字节,预期 %d 字节", len(bs), len(data))
+		}
+	case <-time.After(30 * time.Second):
+		t.Fatal("接收数据超时")
+	}
+	// 关闭时等待数据全部被确认后返回,不需要等到 rudpLinger
+	select {
+	case d := <-closed:
+		if d >= rudpLinger {
+			t.Fatalf("数据没有全部被确认: %v", d)
+		}
+	case <-time.After(2 * rudpLinger):
+		t.Fatal("关闭超时")
+	}
+	if client.Retransmitted() == 0 {
+		t.Fatal("丢包时没有重传")
+	}
+}
+
+// TestRUDPWriteDeadline 对端不确认时写入在发送缓存满后阻塞,直到写超时
+func TestRUDPWriteDeadline(t *testing.T) {
+	client, _ := newRUDPPair(t, 1, 0, &RUDPConfig{Window: 4, Interval: DefaultRUDPInterval, MinRTO: DefaultRUDPMinRTO})
+
+	client.SetWriteDeadline(time.Now().Add(100 * time.Millisecond))
+	start := time.Now()
+	n, err := client.Write(make([]byte, 16*rudpMSS))
+	if !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("预期写超时,得到 %v", err)
+	}
+	if n != 8*rudpMSS {
+		t.Fatalf("写入了 %d 字节,预期填满发送缓存 %d 字节", n, 8*rudpMSS)
+	}
+	if d := time.Since(start); d < 100*time.Millisecond || d > 5*time.Second {
+		t.Fatalf("写超时的时间不正确: %v", d)
+	}
+
+	// 已经超时的连接立即返回
+	if _, err := client.Write([]byte{1}); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("预期写超时,得到 %v", err)
+	}
+
+	// 取消写超时后,阻塞的写入可以被关闭打断
+	client.SetWriteDeadline(time.Time{})
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		client.CloseWithErr(io.EOF)
+	}()
+	if _, err := client.Write([]byte{1}); err == nil {
+		t.Fatal("预期写入失败")
+	}
+}
+
+// BenchmarkRUDP 可靠UDP在不同丢包率下的吞吐量,和 TestRUDPLossy 使用相同的中转
+func BenchmarkRUDP(b *testing.B) {
+	for _, v := range []struct {
+		name string
+		loss float64
+	}{
+		{"无丢包", 0},
+		{"丢包5%", 0.05},
+		{"丢包10%", 0.1},
+	} {
+		b.Run(v.name, func(b *testing.B) {
+			client, server := newRUDPPair(b, v.loss, time.Millisecond, nil)
+			buf := make([]byte, 32<<10)
+			total := int64(len(buf)) * int64(b.N)
+			done := make(chan error, 1)
+			go func() {
+				_, err := io.CopyN(io.Discard, server, total)
+				done <- err
+			}()
+			b.SetBytes(int64(len(buf)))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := client.Write(buf); err != nil {
+					b.Fatal(err)
+				}
+			}
+			if err := <-done; err != nil {
+				b.Fatal(err)
+			}
+		})
+	}
+}
@@ -0,0 +1,166 @@
+package core
+
+import (
+	"sync"
+)
+
+// sendBatchSize 发送协程每次合并写入的最大长度,超过后分多次写入
+const sendBatchSize = 64 << 10
+
+// sendItem 等待发送的数据包
+type sendItem struct {
+	msgID string
+	_type Type
+	tag   Tag
+	data  []byte
+	then  func()     // then 数据包编码后在发送协程中立即执行,用于切换帧协议
+	done  chan error // done 发送结果
+}
+
+var sendItemPool = sync.Pool{New: func() any {
+	return &sendItem{done: make(chan error, 1)}
+}}
+
+// stream 是否为虚拟IO的数据流消息(数据、半关闭和关闭),同一个IO的数据流消息需要按顺序发送
+func (this *sendItem) stream() bool {
+	return this.tag.IsRequest() && (this._type == Write || this._type == HalfClose || this._type == Close)
+}
+
+// sender 隧道的发送队列,所有数据包由一个发送协程编码并写入连接,不会交错
+// 控制消息(注册、建立连接、响应等)优先发送,虚拟IO的数据和关闭消息按IO排队,
+// 多个IO之间轮流发送,避免一个大流量的IO阻塞其他IO
+type sender struct {
+	mu      sync.Mutex
+	control []*sendItem            // control 控制消息,优先发送
+	streams map[string][]*sendItem // streams 每个虚拟IO等待发送的数据流消息
+	ring    []string               // ring 有消息等待发送的虚拟IO,按轮询顺序
+	free    [][]*sendItem          // free 复用已发送完的IO队列,避免每个数据包重新分配
+	signal  chan struct{}          // signal 有新消息时通知发送协程
+}
+
+func newSender() *sender {
+	return &sender{
+		streams: make(map[string][]*sendItem),
+		signal:  make(chan struct{}, 1),
+	}
+}
+
+// push 添加一个等待发送的数据包
+func (this *sender) push(v *sendItem) {
+	this.mu.Lock()
+	if v.stream() {
+		queue, ok := this.streams[v.msgID]
+		if !ok {
+			if n := len(this.free); n > 0 {
+				queue, this.free = this.free[n-1], this.free[:n-1]
+			}
+			this.ring = append(this.ring, v.msgID)
+		}
+		this.streams[v.msgID] = append(queue, v)
+	} else {
+		this.control = append(this.control, v)
+	}
+	this.mu.Unlock()
+	signal(this.signal)
+}
+
+// pop 按优先级取出等待发送的数据包,总长度不超过 size,至少取出一个
+func (this *sender) pop(list []*sendItem, size int) []*sendItem {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	total := 0
+	for len(this.control) > 0 && (len(list) == 0 || total < size) {
+		var v *sendItem
+		v, this.control = shift(this.control)
+		list = append(list, v)
+		total += len(v.data)
+	}
+	// 每个虚拟IO每轮发送一个数据包
+	for len(this.ring) > 0 && (len(list) == 0 || total < size) {
+		var key string
+		key, this.ring = shift(this.ring)
+		v, queue := shift(this.streams[key])
+		list = append(list, v)
+		total += len(v.data)
+		if len(queue) > 0 {
+			this.streams[key] = queue
+			this.ring = append(this.ring, key)
+		} else {
+			delete(this.streams, key)
+			this.free = append(this.free, queue)
+		}
+	}
+	return list
+}
+
+// shift 取出队列的第一个元素,剩余元素前移以复用队列的容量
+// 每个IO同时只有少量等待发送的数据包,前移的开销可以忽略
+func shift[T any](queue []T) (T, []T) {
+	v := queue[0]
+	n := copy(queue, queue[1:])
+	var zero T
+	queue[n] = zero
+	return v, queue[:n]
+}
+
+// fail 隧道关闭时,通知所有等待发送的数据包
+func (this *sender) fail(err error) {
+	this.mu.Lock()
+	list := this.control
+	for _, queue := range this.streams {
+		list = append(list, queue...)
+	}
+	this.control, this.streams, this.ring, this.free = nil, make(map[string][]*sendItem), nil, nil
+	this.mu.Unlock()
+	for _, v := range list {
+		v.done <- err
+	}
+}
+
+// runSender 发送协程,合并编码等待发送的数据包并写入连接
+func (this *Tunnel) runSender() {
+	buf := getBuf()
+	defer putBuf(buf)
+	var list []*sendItem
+	for {
+		select {
+		case <-this.send.signal:
+		case <-this.Done():
+			this.send.fail(this.Err())
+			return
+		}
+		for {
+			list = this.send.pop(list[:0], sendBatchSize)
+			if len(list) == 0 {
+				break
+			}
+			*buf = (*buf)[:0]
+			this.wMu.Lock()
+			for _, v := range list {
+				*buf = this.encode(*buf, v)
+				if v.then != nil {
+					v.then()
+				}
+			}
+			this.wMu.Unlock()
+			_, err := this.r.Write(*buf)
+			for i, v := range list {
+				v.done <- err
+				list[i] = nil
+			}
+			if len(*buf) > poolMaxSize {
+				// 大包之后不保留过大的缓存
+				putBuf(buf)
+				buf = getBuf()
+			}
+		}
+	}
+}
+
+// encode 使用当前的帧协议编码数据包,调用方需持有写锁
+func (this *Tunnel) encode(dst []byte, v *sendItem) []byte {
+	if f, ok := this.f.(AppendFrame); ok {
+		return f.AppendPacket(dst, v.msgID, v._type, v.tag, v.data)
+	}
+	return append(dst, this.f.NewPacket(v.msgID, v._type, v.tag, v.data)...)
+}
@@ -0,0 +1,300 @@
+package core
+
+import (
+	"cmp"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/injoyai/base/safe"
+	"github.com/injoyai/conv"
+	"go.bug.st/serial"
+)
+
+// 串口相关的自定义参数(Param)名称,用于 Dial 和 Listen
+// 串口设备路径使用 Address,例如 /dev/ttyUSB0 或 COM3,Address 为空时使用 ParamDevice
+const (
+	ParamDevice   = "device"   // ParamDevice 串口设备路径
+	ParamBaud     = "baud"     // ParamBaud 波特率,默认9600
+	ParamDataBits = "dataBits" // ParamDataBits 数据位,5/6/7/8,默认8
+	ParamParity   = "parity"   // ParamParity 校验位,N/O/E/M/S(none/odd/even/mark/space),默认N
+	ParamStopBits = "stopBits" // ParamStopBits 停止位,1/1.5/2,默认1
+)
+
+const (
+	DefaultBaud      = 9600            // DefaultBaud 默认的波特率
+	serialRetryDelay = time.Second * 3 // serialRetryDelay 串口监听重新打开设备的间隔
+)
+
+// NewDialSerial 创建一个串口类型的拨号器
+// device 为串口设备路径,其他参数(数据位/校验位/停止位)通过 Param 设置
+func NewDialSerial(device string, baud int) *Dial {
+	return &Dial{
+		Type:    Serial,
+		Address: device,
+		Param:   map[string]any{ParamBaud: baud},
+	}
+}
+
+// NewListenSerial 创建一个串口类型的监听器配置
+// 串口同时只有一个连接,连接关闭后会重新打开设备,等待下一次连接
+func NewListenSerial(device string, baud int, op ...ListenOption) *Listen {
+	l := NewListen(Serial, device, op...)
+	if l.Param == nil {
+		l.Param = map[string]any{}
+	}
+	if _, ok := l.Param[ParamBaud]; !ok {
+		l.Param[ParamBaud] = baud
+	}
+	return l
+}
+
+// NewSerialMode 根据自定义参数生成串口配置
+func NewSerialMode(param map[string]any) (*serial.Mode, error) {
+	mode := &serial.Mode{
+		BaudRate: DefaultBaud,
+		DataBits: 8,
+		Parity:   serial.NoParity,
+		StopBits: serial.OneStopBit,
+	}
+	if v := conv.Int(param[ParamBaud]); v > 0 {
+		mode.BaudRate = v
+	}
+	if v := conv.Int(param[ParamDataBits]); v > 0 {
+		mode.DataBits = v
+	}
+	switch strings.ToUpper(conv.String(param[ParamParity])) {
+	case "", "N", "NONE":
+	case "O", "ODD":
+		mode.Parity = serial.OddParity
+	case "E", "EVEN":
+		mode.Parity = serial.EvenParity
+	case "M", "MARK":
+		mode.Parity = serial.MarkParity
+	case "S", "SPACE":
+		mode.Parity = serial.SpaceParity
+	default:
+		return nil, fmt.Errorf("无效的串口校验位: %v", param[ParamParity])
+	}
+	switch conv.String(param[ParamStopBits]) {
+	case "", "1":
+	case "1.5":
+		mode.StopBits = serial.OnePointFiveStopBits
+	case "2":
+		mode.StopBits = serial.TwoStopBits
+	default:
+		return nil, fmt.Errorf("无效的串口停止位: %v", param[ParamStopBits])
+	}
+	return mode, nil
+}
+
+// serialDevice 获取串口设备路径
+func serialDevice(address string, param map[string]any) string {
+	if address != "" {
+		return address
+	}
+	return conv.String(param[ParamDevice])
+}
+
+// dialSerial 打开串口设备
+func dialSerial(d *Dial) (net.Conn, error) {
+	mode, err := NewSerialMode(d.Param)
+	if err != nil {
+		return nil, err
+	}
+	c, err := OpenSerial(serialDevice(d.Address, d.Param), mode)
+	if err != nil {
+		return nil, err
+	}
+	if conv.Bool(d.Param[ParamRFC2217]) {
+		return NewRFC2217(c, mode), nil
+	}
+	return c, nil
+}
+
+// openSerial 打开对端请求的本地串口设备,需要通过 WithDialSerial 允许
+func (this *Tunnel) openSerial(d *Dial) (io.ReadWriteCloser, string, error) {
+	device := serialDevice(d.Address, d.Param)
+	if this.serial == nil || (len(this.serial) > 0 && !slices.Contains(this.serial, device)) {
+		return nil, "", ErrSerialDenied
+	}
+	return d.Dial()
+}
+
+// listenSerial 打开串口设备并监听,设备不存在等错误会直接返回
+func listenSerial(l *Listen) (net.Listener, error) {
+	mode, err := NewSerialMode(l.Param)
+	if err != nil {
+		return nil, err
+	}
+	device := serialDevice(l.Address, l.Param)
+	c, err := OpenSerial(device, mode)
+	if err != nil {
+		return nil, err
+	}
+	return newSerialListener(c, device, mode), nil
+}
+
+// OpenSerial 打开串口设备,返回的连接可以直接作为隧道的连接(core.NewTunnel)
+// 打开时会清空接收缓存中的残留数据,读取没有超时,会一直阻塞到收到数据,
+// 线路上的干扰数据由帧协议逐字节重新同步,建议同时开启 WithChecksum
+func OpenSerial(device string, mode *serial.Mode) (*SerialConn, error) {
+	port, err := serial.Open(device, mode)
+	if err != nil {
+		return nil, err
+	}
+	port.ResetInputBuffer()
+	return &SerialConn{Port: port, addr: serialAddr(device)}, nil
+}
+
+// SerialConn 串口连接,实现了 net.Conn
+type SerialConn struct {
+	serial.Port
+	addr     serialAddr
+	deadline atomic.Int64 // deadline 读超时时间(纳秒时间戳),0表示不超时
+	once     sync.Once
+	onClose  func()
+}
+
+// Read 读取数据,至少读取到一个字节或发生错误时返回
+func (this *SerialConn) Read(p []byte) (int, error) {
+	for {
+		n, err := this.Port.Read(p)
+		if n > 0 || err != nil {
+			return n, err
+		}
+		// 读取超时时串口库返回(0,nil)
+		if t := this.deadline.Load(); t != 0 && time.Now().UnixNano() >= t {
+			return 0, os.ErrDeadlineExceeded
+		}
+	}
+}
+
+// Close 关闭串口
+func (this *SerialConn) Close() error {
+	err := this.Port.Close()
+	this.once.Do(func() {
+		if this.onClose != nil {
+			this.onClose()
+		}
+	})
+	return err
+}
+
+func (this *SerialConn) LocalAddr() net.Addr { return this.addr }
+
+func (this *SerialConn) RemoteAddr() net.Addr { return this.addr }
+
+func (this *SerialConn) SetDeadline(t time.Time) error { return this.SetReadDeadline(t) }
+
+// SetReadDeadline 设置读超时,串口只支持相对的超时时间,在设置时换算
+func (this *SerialConn) SetReadDeadline(t time.Time) error {
+	if t.IsZero() {
+		this.deadline.Store(0)
+		return this.Port.SetReadTimeout(serial.NoTimeout)
+	}
+	this.deadline.Store(t.UnixNano())
+	return this.Port.SetReadTimeout(max(time.Until(t), time.Millisecond))
+}
+
+// SetWriteDeadline 串口不支持写超时,忽略
+func (this *SerialConn) SetWriteDeadline(t time.Time) error { return nil }
+
+// serialAddr 串口地址,即设备路径
+type serialAddr string
+
+func (this serialAddr) Network() string { return Serial }
+
+func (this serialAddr) String() string { return string(this) }
+
+func newSerialListener(c *SerialConn, device string, mode *serial.Mode) *SerialListener {
+	l := &SerialListener{
+		Closer: safe.NewCloser(),
+		device: device,
+		mode:   mode,
+		free:   make(chan struct{}, 1),
+	}
+	l.pending = c
+	l.free <- struct{}{}
+	l.SetCloseFunc(func(error) error {
+		l.mu.Lock()
+		c := cmp.Or(l.conn, l.pending)
+		l.mu.Unlock()
+		if c != nil {
+			return c.Close()
+		}
+		return nil
+	})
+	return l
+}
+
+// SerialListener 串口监听器,同时只有一个连接
+// 连接关闭后重新打开设备并交给 Accept,用于设备重启或USB串口重新插拔的场景
+type SerialListener struct {
+	*safe.Closer
+	device  string
+	mode    *serial.Mode
+	mu      sync.Mutex
+	conn    *SerialConn   // conn 当前的连接
+	pending *SerialConn   // pending 已打开但还未 Accept 的连接
+	free    chan struct{} // free 当前没有连接时可读
+}
+
+// Accept 等待上一个连接关闭,返回新打开的串口连接
+func (this *SerialListener) Accept() (net.Conn, error) {
+	select {
+	case <-this.free:
+	case <-this.Done():
+		return nil, this.Err()
+	}
+	for {
+		c, err := this.open()
+		if err == nil {
+			return c, nil
+		}
+		select {
+		case <-time.After(serialRetryDelay):
+		case <-this.Done():
+			return nil, this.Err()
+		}
+	}
+}
+
+// open 打开串口设备,优先使用已打开的连接
+func (this *SerialListener) open() (*SerialConn, error) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	c := this.pending
+	this.pending = nil
+	if c == nil {
+		var err error
+		if c, err = OpenSerial(this.device, this.mode); err != nil {
+			return nil, err
+		}
+	}
+	if this.Closed() {
+		c.Close()
+		return nil, this.Err()
+	}
+	c.onClose = func() {
+		this.mu.Lock()
+		if this.conn == c {
+			this.conn = nil
+		}
+		this.mu.Unlock()
+		this.free <- struct{}{}
+	}
+	this.conn = c
+	return c, nil
+}
+
+// Addr 监听地址,即设备路径
+func (this *SerialListener) Addr() net.Addr {
+	return serialAddr(this.device)
+}
@@ -0,0 +1,99 @@
+//go:build linux
+
+package core
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+	"unsafe"
+)
+
+// openPty 打开一对伪终端,返回主设备和从设备的路径,从设备可以使用 OpenSerial 打开
+func openPty(t *testing.T) (*os.File, string) {
+	master, err := os.OpenFile("/dev/ptmx", os.O_RDWR|syscall.O_NOCTTY, 0)
+	if err != nil {
+		t.Skip("不支持伪终端:", err)
+	}
+	t.Cleanup(func() { master.Close() })
+	raw, err := master.SyscallConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var n uint32
+	var errno syscall.Errno
+	err = raw.Control(func(fd uintptr) {
+		unlock := int32(0)
+		if _, _, errno = syscall.Syscall(syscall.SYS_IOCTL, fd, syscall.TIOCSPTLCK, uintptr(unsafe.Pointer(&unlock))); errno != 0 {
+			return
+		}
+		_, _, errno = syscall.Syscall(syscall.SYS_IOCTL, fd, syscall.TIOCGPTN, uintptr(unsafe.Pointer(&n)))
+	})
+	if err != nil || errno != 0 {
+		t.Fatal(err, errno)
+	}
+	return master, fmt.Sprintf("/dev/pts/%d", n)
+}
+
+// openSerialPair 打开两对伪终端,转发两个主设备之间的数据,模拟一条串口线路
+// 返回两端的串口连接和两端的主设备,向主设备写入的数据会被对应的串口读取,用于模拟线路干扰
+func openSerialPair(t *testing.T) (a, b *SerialConn, lineA, lineB *os.File) {
+	ma, sa := openPty(t)
+	mb, sb := openPty(t)
+	mode, err := NewSerialMode(map[string]any{ParamBaud: 115200})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a, err = OpenSerial(sa, mode); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { a.Close() })
+	if b, err = OpenSerial(sb, mode); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { b.Close() })
+	return a, b, ma, mb
+}
+
+// TestSerialTunnel 在一对伪终端上运行隧道,线路上的干扰数据需要能被帧协议逐字节重新同步
+func TestSerialTunnel(t *testing.T) {
+	a, b, lineA, lineB := openSerialPair(t)
+
+	server := NewTunnel(a, WithKey("a"), WithChecksum(), WithDial(echoDial), WithRegister(acceptRegister))
+	defer server.Close()
+	client := NewTunnel(b, WithKey("b"), WithChecksum())
+	defer client.Close()
+
+	// 开始通信之前的线路噪声,不包含帧头
+	lineA.Write([]byte{0x00, 0x89, 0x13, 0xFF, 0x37})
+	go io.Copy(lineB, lineA)
+	go io.Copy(lineA, lineB)
+	go server.Run()
+	go client.Run()
+
+	if _, err := client.Register(&RegisterReq{Key: "b"}); err != nil {
+		t.Fatal(err)
+	}
+	if !client.Negotiated().HasFeature(FeatureChecksum) {
+		t.Fatal("没有协商数据校验")
+	}
+	testEcho(t, client, bytes.Repeat([]byte("serial-"), 3000))
+
+	// 通信过程中的干扰数据,包含声明超长数据的帧头和无效的数据帧
+	time.Sleep(100 * time.Millisecond)
+	lineA.Write([]byte{1, 2, prefix, prefix, 0x7F, 0xFF, 0xFF, 0xFF, prefix, prefixV2, 0x7F, 0xFF, 0xFF, 0xFF, 9, 9})
+	lineB.Write([]byte{1, 2, prefix, prefix, 0, 0, 0, 3, 9, 9, 9, prefix, prefixV2, 0, 0, 0, 3, 9, 9, 9})
+	time.Sleep(100 * time.Millisecond)
+
+	testEcho(t, client, []byte("after-noise"))
+	if server.Corrupted() == 0 || client.Corrupted() == 0 {
+		t.Fatalf("干扰数据没有按校验失败处理: %d %d", server.Corrupted(), client.Corrupted())
+	}
+	if server.Closed() || client.Closed() {
+		t.Fatal("隧道被干扰数据关闭")
+	}
+}
@@ -0,0 +1,161 @@
+package core
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/injoyai/conv"
+)
+
+// TLS 相关的自定义参数(Param)名称,用于 Dial 和 Listen
+const (
+	ParamCert        = "cert"        // ParamCert 证书文件路径,服务端必填,客户端用于双向认证
+	ParamKey         = "key"         // ParamKey 私钥文件路径
+	ParamCA          = "ca"          // ParamCA CA证书文件路径,用于校验对端证书
+	ParamServerName  = "serverName"  // ParamServerName 校验服务端证书时使用的域名
+	ParamInsecure    = "insecure"    // ParamInsecure 是否跳过证书校验,仅用于测试
+	ParamFingerprint = "fingerprint" // ParamFingerprint 固定对端证书的SHA256指纹(十六进制),多个用逗号分隔
+)
+
+// Fingerprint 计算证书的SHA256指纹,十六进制小写
+func Fingerprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.Raw)
+	return hex.EncodeToString(sum[:])
+}
+
+// NewIdentity 根据对端证书创建身份信息
+func NewIdentity(cert *x509.Certificate) *Identity {
+	i := &Identity{
+		CommonName:  cert.Subject.CommonName,
+		Subject:     cert.Subject.String(),
+		SANs:        slices.Clone(cert.DNSNames),
+		Fingerprint: Fingerprint(cert),
+		Cert:        cert,
+	}
+	for _, v := range cert.IPAddresses {
+		i.SANs = append(i.SANs, v.String())
+	}
+	for _, v := range cert.URIs {
+		i.SANs = append(i.SANs, v.String())
+	}
+	i.SANs = append(i.SANs, cert.EmailAddresses...)
+	return i
+}
+
+// PeerIdentity 完成 TLS 握手并获取对端证书的身份信息
+// 非 TLS 连接或对端未提供证书时返回nil
+func PeerIdentity(c io.ReadWriteCloser) (*Identity, error) {
+	conn, ok := c.(*tls.Conn)
+	if !ok {
+		return nil, nil
+	}
+	defer setDeadline(conn, time.Now().Add(pskTimeout))()
+	if err := conn.Handshake(); err != nil {
+		return nil, err
+	}
+	if certs := conn.ConnectionState().PeerCertificates; len(certs) > 0 {
+		return NewIdentity(certs[0]), nil
+	}
+	return nil, nil
+}
+
+// Identity 通过 TLS 双向认证得到的对端身份
+type Identity struct {
+	CommonName  string            `json:"commonName"`     // CommonName 证书主题的通用名称
+	Subject     string            `json:"subject"`        // Subject 证书主题
+	SANs        []string          `json:"sans,omitempty"` // SANs 证书的备用名称,包括域名、IP、URI和邮箱
+	Fingerprint string            `json:"fingerprint"`    // Fingerprint 证书的SHA256指纹
+	Cert        *x509.Certificate `json:"-"`              // Cert 对端证书
+}
+
+// Match 判断标识是否和证书的通用名称或备用名称一致
+func (this *Identity) Match(key string) bool {
+	return this != nil && key != "" && (this.CommonName == key || slices.Contains(this.SANs, key))
+}
+
+// NewTLSConfig 根据自定义参数创建 TLS 配置
+// base 为基础配置,可以为nil,参数中的配置会覆盖基础配置
+func NewTLSConfig(param map[string]any, base *tls.Config, server bool) (*tls.Config, error) {
+	cfg := &tls.Config{}
+	if base != nil {
+		cfg = base.Clone()
+	}
+	get := func(key string) string { return conv.String(param[key]) }
+
+	// 本地证书
+	if cert, key := get(ParamCert), get(ParamKey); cert != "" {
+		c, err := tls.LoadX509KeyPair(cert, conv.Select(key == "", cert, key))
+		if err != nil {
+			return nil, err
+		}
+		cfg.Certificates = []tls.Certificate{c}
+	}
+	if server && len(cfg.Certificates) == 0 && cfg.GetCertificate == nil {
+		return nil, errors.New("TLS监听需要设置证书")
+	}
+
+	// 校验对端证书的CA
+	if ca := get(ParamCA); ca != "" {
+		bs, err := os.ReadFile(ca)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(bs) {
+			return nil, fmt.Errorf("无效的CA证书: %s", ca)
+		}
+		if server {
+			cfg.ClientCAs = pool
+			if cfg.ClientAuth == tls.NoClientCert {
+				cfg.ClientAuth = tls.RequireAndVerifyClientCert
+			}
+		} else {
+			cfg.RootCAs = pool
+		}
+	}
+
+	if name := get(ParamServerName); name != "" {
+		cfg.ServerName = name
+	}
+	if conv.Bool(param[ParamInsecure]) {
+		cfg.InsecureSkipVerify = true
+	}
+
+	// 固定证书指纹,未设置CA时只校验指纹,适用于自签名证书
+	if pins := get(ParamFingerprint); pins != "" {
+		var list []string
+		for _, v := range strings.Split(pins, ",") {
+			list = append(list, strings.ToLower(strings.ReplaceAll(strings.TrimSpace(v), ":", "")))
+		}
+		if !server && cfg.RootCAs == nil {
+			cfg.InsecureSkipVerify = true
+		}
+		if server && cfg.ClientAuth == tls.NoClientCert {
+			cfg.ClientAuth = tls.RequireAnyClientCert
+		}
+		cfg.VerifyPeerCertificate = func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			if len(rawCerts) == 0 {
+				return errors.New("对端未提供证书")
+			}
+			cert, err := x509.ParseCertificate(rawCerts[0])
+			if err != nil {
+				return err
+			}
+			if !slices.Contains(list, Fingerprint(cert)) {
+				return fmt.Errorf("证书指纹不匹配: %s", Fingerprint(cert))
+			}
+			return nil
+		}
+	}
+
+	return cfg, nil
+}
@@ -3,10 +3,14 @@ package core
 
 import (
 	"bufio"
+	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"slices"
+	"strconv"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -18,25 +22,49 @@ import (
 	"github.com/injoyai/logs"
 )
 
+// DefaultWaitTimeout 默认的等待响应超时时间
+const DefaultWaitTimeout = time.Second * 30
+
 // NewTunnel 创建一个新的隧道实例
 // r 是底层的物理连接,option 是可选的配置函数
 // 隧道是虚拟通道的管理器,支持多条虚拟IO复用同一条物理连接
 func NewTunnel(r io.ReadWriteCloser, option ...TunnelOption) *Tunnel {
 	v := &Tunnel{
-		k:      fmt.Sprintf("%p", r),
-		f:      DefaultFrame,
-		r:      r,
-		ioMap:  map[string]*IO{},
-		wait:   wait.New(time.Second * 30),
-		Closer: safe.NewCloser(),
-		dial:   DefaultDial,
+		k:             fmt.Sprintf("%p", r),
+		f:             DefaultFrame,
+		r:             r,
+		ioMap:         map[string]*IO{},
+		opening:       map[string]bool{},
+		wait:          wait.New(DefaultWaitTimeout),
+		timeout:       DefaultWaitTimeout,
+		Closer:        safe.NewCloser(),
+		dial:          DefaultDial,
+		protocol:      DefaultProtocol(),
+		maxFrame:      DefaultMaxFrameSize,
+		compress:      DefaultCompressThreshold,
+		window:        DefaultStreamWindow,
+		budget:        DefaultTunnelBuffer,
+		stalled:       map[string]*IO{},
+		heartbeat:     DefaultHeartbeat,
+		heartbeatMiss: DefaultHeartbeatMiss,
+		draining:      make(chan struct{}),
+		ioClosed:      make(chan struct{}, 1),
+		handlers:      map[CustomType]Handler{},
+		methods:       map[string]Method{},
+		rpc:           make(chan struct{}, DefaultRPCConcurrency),
+		rpcQueue:      make(chan struct{}, DefaultRPCConcurrency+DefaultRPCQueue),
 	}
 	v.Closer.SetCloseFunc(func(err error) error {
-		v.ioMu.Lock()
+		// 虚拟IO关闭时会从 ioMap 中移除,不能在持有锁时关闭
+		v.ioMu.RLock()
+		list := make([]*IO, 0, len(v.ioMap))
 		for _, c := range v.ioMap {
+			list = append(list, c)
+		}
+		v.ioMu.RUnlock()
+		for _, c := range list {
 			c.Close()
 		}
-		v.ioMu.Unlock()
 		return v.r.Close()
 	})
 	for _, op := range option {
@@ -55,16 +83,51 @@ func NewTunnel(r io.ReadWriteCloser, option ...TunnelOption) *Tunnel {
 type Tunnel struct {
 	*safe.Closer // Closer 安全关闭控制器
 
-	k          string             // k 隧道唯一标识
-	f          Frame              // f 帧协议实例
-	r          io.ReadWriteCloser // r 底层物理连接
-	ioMu       sync.RWMutex       // ioMu 保护 ioMap 的并发访问
-	ioMap      map[string]*IO     // ioMap 虚拟IO映射,key为IO的唯一标识
-	wait       *wait.Entity       // wait 异步等待机制,用于等待请求响应
-	running    atomic.Bool        // running 隧道是否正在运行
-	registered atomic.Bool        // registered 是否已完成注册
+	k             string                      // k 隧道唯一标识
+	f             Frame                       // f 帧协议实例
+	r             io.ReadWriteCloser          // r 底层物理连接
+	wMu           sync.Mutex                  // wMu 写锁,保证帧协议切换前后的数据包顺序
+	send          *sender                     // send 发送队列,所有数据包由一个发送协程写入
+	sendOnce      sync.Once                   // sendOnce 首次发送时启动发送协程
+	ioMu          sync.RWMutex                // ioMu 保护 ioMap 的并发访问
+	ioMap         map[string]*IO              // ioMap 虚拟IO映射,key为IO的唯一标识
+	openMu        sync.Mutex                  // openMu 保护 opening,和创建虚拟IO一起加锁
+	opening       map[string]bool             // opening 正在建立连接的请求,值为对端是否已经放弃(Cancel)
+	wait          *wait.Entity                // wait 异步等待机制,用于等待请求响应
+	timeout       time.Duration               // timeout 等待响应的超时时间
+	running       atomic.Bool                 // running 隧道是否正在运行
+	registered    atomic.Bool                 // registered 是否已完成注册
+	seq           atomic.Uint32               // seq 数字消息ID的自增序号
+	initiator     atomic.Bool                 // initiator 是否为发起注册的一方,双方分配奇偶不同的数字ID,避免冲突
+	codedRegister atomic.Bool                 // codedRegister 注册请求是否通告了错误码功能,对端注册失败的响应会携带错误码
+	protocol      *Protocol                   // protocol 本地支持的协议能力,注册时用于协商
+	negotiated    atomic.Pointer[RegisterRes] // negotiated 注册协商的结果
+	maxFrame      uint32                      // maxFrame 允许接收的最大帧长度(数据域),0表示不限制
+	corrupted     atomic.Uint64               // corrupted 校验失败被丢弃的数据包数量
+	compress      int                         // compress 压缩阈值,小于此长度的数据不压缩
+	txSaved       atomic.Int64                // txSaved 发送时压缩节省的字节数
+	rxSaved       atomic.Int64                // rxSaved 接收时压缩节省的字节数
+	rBuf          []byte                      // rBuf 读取数据包的缓存,只在读取协程中使用
+	window        uint32                      // window 每个虚拟IO的接收窗口,0表示不启用流量控制
+	budget        int64                       // budget 所有虚拟IO未读数据的上限,0表示不限制
+	buffered      atomic.Int64                // buffered 所有虚拟IO未读数据的总长度
+	flowMu        sync.Mutex                  // flowMu 保护归还窗口的状态
+	stalled       map[string]*IO              // stalled 超过上限时暂停归还窗口的虚拟IO
+	heartbeat     time.Duration               // heartbeat 心跳间隔,0表示不发送心跳
+	heartbeatMiss int                         // heartbeatMiss 连续多少次心跳没有响应时关闭隧道
+	rtt           atomic.Int64                // rtt 心跳测量的平滑往返时间(纳秒)
+	lastRecv      atomic.Int64                // lastRecv 最后一次收到数据包的时间(纳秒)
+	draining      chan struct{}               // draining 正在关闭时关闭,不再建立新的虚拟IO
+	drainOnce     sync.Once                   // drainOnce 保证 draining 只关闭一次
+	ioClosed      chan struct{}               // ioClosed 虚拟IO关闭时通知 Shutdown
+	handlerMu     sync.RWMutex                // handlerMu 保护 handlers 和 methods
+	handlers      map[CustomType]Handler      // handlers 自定义消息的处理函数
+	methods       map[string]Method           // methods 远程调用的方法
+	rpc           chan struct{}               // rpc 限制同时执行的远程调用数量,nil表示不限制
+	rpcQueue      chan struct{}               // rpcQueue 限制执行和排队的远程调用总数,超过时响应 ErrBusy
 
 	dial       func(d *Dial) (io.ReadWriteCloser, string, error) // dial 拨号函数
+	serial     []string                                          // serial 允许对端打开的本地串口设备,nil表示不允许,空表示不限制
 	onRegister func(v *Tunnel, data []byte) (any, error)         // onRegister 注册回调
 	onDialed   func(d *Dial, key string)                         // onDialed 连接成功回调
 }
@@ -86,22 +149,228 @@ func (this *Tunnel) SetOption(op ...TunnelOption) {
 	}
 }
 
+// newID 生成一个新的消息ID
+// 帧协议使用数字ID时分配自增ID,发起注册的一方使用奇数,另一方使用偶数,
+// 长时间运行的隧道序号会回绕,回绕后跳过0和仍在使用的虚拟IO标识
+// 否则使用 fallback,为空时生成UUID
+func (this *Tunnel) newID(fallback string) string {
+	this.wMu.Lock()
+	f, ok := this.f.(NumericFrame)
+	this.wMu.Unlock()
+	if ok && f.NumericID() {
+		for {
+			id := this.seq.Add(1) * 2
+			if this.initiator.Load() {
+				id--
+			}
+			key := strconv.FormatUint(uint64(id), 10)
+			if id != 0 && this.GetIO(key) == nil {
+				return key
+			}
+		}
+	}
+	if fallback == "" {
+		return uuid.New().String()
+	}
+	return fallback
+}
+
 // WritePacket 发送一个数据包到对端
 // msgID 为消息唯一标识,t 为消息类型,i 为消息内容
+// 数据包由发送协程统一写入,返回时数据包已经写入物理连接
 func (this *Tunnel) WritePacket(msgID string, _type Type, tag Tag, i any) error {
-	bs := this.f.NewPacket(msgID, _type, tag, i)
-	_, err := this.r.Write(bs)
-	return err
+	return this.writePacket(msgID, _type, tag, i, nil)
+}
+
+// writePacket 将数据包加入发送队列,等待发送协程写入物理连接
+// then 在数据包编码后在发送协程中执行,此时后续数据包还未编码
+func (this *Tunnel) writePacket(msgID string, _type Type, tag Tag, i any, then func()) error {
+	this.sendOnce.Do(func() {
+		this.send = newSender()
+		go this.runSender()
+	})
+	v := sendItemPool.Get().(*sendItem)
+	v.msgID, v._type, v.tag, v.data, v.then = msgID, _type, tag, conv.Bytes(i), then
+	this.send.push(v)
+	select {
+	case err := <-v.done:
+		v.data, v.then = nil, nil
+		sendItemPool.Put(v)
+		return err
+	case <-this.Done():
+		// 发送协程退出时会通知队列中的数据包,这里不能回收
+		return this.Err()
+	}
+}
+
+// writeData 发送虚拟IO的数据
+// 协商了最大帧长度时,会将数据拆分成多个数据包发送,避免超过对端的限制
+// 启用了流量控制时,每个数据包不超过发送窗口的剩余额度,没有额度时等待对端归还
+func (this *Tunnel) writeData(i *IO, key string, bs []byte) error {
+	size := len(bs)
+	if res := this.Negotiated(); res != nil && res.MaxFrameSize > frameOverhead {
+		size = int(res.MaxFrameSize - frameOverhead)
+	}
+	for {
+		n := min(size, len(bs))
+		if i.credit != nil {
+			var ok bool
+			if n, ok = i.credit.take(n, i.Done()); !ok {
+				return i.Err()
+			}
+		}
+		if err := this.writeChunk(key, bs[:n]); err != nil {
+			return err
+		}
+		bs = bs[n:]
+		if len(bs) == 0 {
+			return nil
+		}
+	}
+}
+
+// writeChunk 发送一个数据包的虚拟IO数据
+// 协商了压缩算法且数据达到压缩阈值时压缩,压缩后没有变小则发送原始数据
+func (this *Tunnel) writeChunk(key string, bs []byte) error {
+	tag := Request
+	if c := this.compressor(); c != nil && len(bs) >= this.compress {
+		if p, err := c.Compress(bs); err == nil && len(p) < len(bs) {
+			this.txSaved.Add(int64(len(bs) - len(p)))
+			bs, tag = p, tag|Compressed
+		}
+	}
+	return this.WritePacket(key, Write, tag, bs)
+}
+
+// decompress 解压对端发送的数据
+func (this *Tunnel) decompress(bs []byte) ([]byte, error) {
+	c := this.compressor()
+	if c == nil {
+		return nil, ErrCompress
+	}
+	p, err := c.Decompress(bs, int(this.maxFrame))
+	if err != nil {
+		return nil, err
+	}
+	this.rxSaved.Add(int64(len(p) - len(bs)))
+	return p, nil
+}
+
+// compressor 获取协商后的压缩算法,未启用压缩时返回nil
+func (this *Tunnel) compressor() Compressor {
+	if res := this.Negotiated(); res != nil && res.Compress != "" {
+		return GetCompress(res.Compress)
+	}
+	return nil
+}
+
+// CompressSaved 获取压缩节省的字节数,分别为发送和接收的数据
+func (this *Tunnel) CompressSaved() (sent, received int64) {
+	return this.txSaved.Load(), this.rxSaved.Load()
+}
+
+// readPacket 从连接中读取一个数据包
+// 帧协议实现了 LimitFrame 时,会限制数据包的最大长度
+// 帧协议实现了 BufferFrame 时,复用读取缓存,返回的数据只在下次读取之前有效
+func (this *Tunnel) readPacket(r io.Reader) (msgID string, _type Type, tag Tag, data []byte, err error) {
+	if f, ok := this.f.(BufferFrame); ok {
+		return f.ReadPacketBuffer(r, this.maxFrame, &this.rBuf)
+	}
+	if f, ok := this.f.(LimitFrame); ok {
+		return f.ReadPacketLimit(r, this.maxFrame)
+	}
+	return this.f.ReadPacket(r)
+}
+
+// request 发送需要响应的请求并等待响应
+// 需要在发送之前注册等待,否则对端响应过快时响应会被丢弃,隧道关闭时立即返回
+// then 可选,在读取下一个数据包之前处理成功的响应,用于对端紧接着响应发送的数据需要依赖响应结果的场景
+func (this *Tunnel) request(msgID string, _type Type, data any, then ...func(v any) (any, error)) (any, error) {
+	return this.requestContext(context.Background(), this.timeout, msgID, _type, data, then...)
+}
+
+// requestTimeout 发送需要响应的请求并等待响应,timeout 为等待响应的超时时间
+func (this *Tunnel) requestTimeout(timeout time.Duration, msgID string, _type Type, data any, then ...func(v any) (any, error)) (any, error) {
+	return this.requestContext(context.Background(), timeout, msgID, _type, data, then...)
+}
+
+// requestContext 发送需要响应的请求并等待响应,ctx 结束或超时时放弃等待,
+// 放弃的是 Open 请求时通知对端(Cancel)关闭可能已经建立的虚拟IO
+func (this *Tunnel) requestContext(ctx context.Context, timeout time.Duration, msgID string, _type Type, data any, then ...func(v any) (any, error)) (any, error) {
+	type result struct {
+		v   any
+		err error
+	}
+	ch := make(chan result, 1)
+	this.wait.Async(msgID, func(v any, err error) {
+		if err == nil && len(then) > 0 && then[0] != nil {
+			v, err = then[0](v)
+		}
+		select {
+		case ch <- result{v, err}:
+		default:
+		}
+	}, 1, timeout)
+	if err := this.WritePacket(msgID, _type, Request|NeedAck, data); err != nil {
+		this.wait.Done(msgID, nil, err)
+		return nil, err
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	var err error
+	select {
+	case r := <-ch:
+		return r.v, r.err
+	case <-timer.C:
+		err = ErrTimeout
+	case <-ctx.Done():
+		err = ctx.Err()
+	case <-this.Done():
+		err = this.Err()
+	}
+	this.wait.Done(msgID, nil, err)
+	// 响应可能和超时同时到达,已经处理的成功响应需要返回给调用者
+	select {
+	case r := <-ch:
+		if r.err == nil {
+			return r.v, nil
+		}
+	default:
+	}
+	if _type == Open && !this.Closed() {
+		this.WritePacket(msgID, Cancel, Request, nil) //可忽略错误
+	}
+	return nil, err
+}
+
+// localProtocol 本地的协议能力,包含允许接收的最大帧长度
+func (this *Tunnel) localProtocol() *Protocol {
+	p := *this.protocol
+	p.MaxFrameSize = minSize(p.MaxFrameSize, this.maxFrame)
+	p.Window = this.window
+	return &p
 }
 
 // Register 向对端发送注册请求并等待响应
-// data 为注册信息,通常为 RegisterReq 结构体
-// 返回对端的响应数据
+// data 为注册信息,通常为 RegisterReq 结构体,未设置协议能力时会使用隧道的协议能力
+// 返回对端的响应数据,新版本服务端返回 RegisterRes
 func (this *Tunnel) Register(data any) (any, error) {
-	if err := this.WritePacket(this.Key(), Register, Request|NeedAck, data); err != nil {
-		return nil, err
+	return this.RegisterContext(context.Background(), data)
+}
+
+// RegisterContext 向对端发送注册请求并等待响应,ctx 结束时放弃等待并返回 ctx 的错误
+func (this *Tunnel) RegisterContext(ctx context.Context, data any) (any, error) {
+	this.initiator.Store(true)
+	if req, ok := data.(*RegisterReq); ok && req != nil && req.Protocol == nil {
+		// 复制请求,调用方的请求保持不变,重连时使用新隧道的协议能力
+		cp := *req
+		cp.Protocol = this.localProtocol()
+		data = &cp
 	}
-	resp, err := this.wait.Wait(this.Key())
+	req, ok := data.(*RegisterReq)
+	this.codedRegister.Store(ok && req != nil && req.Protocol != nil && slices.Contains(req.Features, FeatureErrorCode))
+	msgID := this.newID(this.Key())
+	resp, err := this.requestContext(ctx, this.timeout, msgID, Register, data)
 	if err != nil {
 		return nil, err
 	}
@@ -109,26 +378,67 @@ func (this *Tunnel) Register(data any) (any, error) {
 	return resp, nil
 }
 
+// Negotiate 服务端根据客户端的注册请求协商协议参数
+// 旧版本客户端(未携带协议版本)返回nil,此时应按旧的方式响应
+// 协商结果不会立即生效,注册处理函数返回结果作为响应并发送后,双方才切换到协商后的配置,
+// 注册失败时隧道保持原来的配置
+func (this *Tunnel) Negotiate(req *RegisterReq) *RegisterRes {
+	if req == nil || req.Protocol == nil || req.Version == 0 {
+		return nil
+	}
+	return this.localProtocol().Negotiate(req.Protocol)
+}
+
+// Negotiated 获取注册协商的结果,旧版本对端或未注册时返回nil
+func (this *Tunnel) Negotiated() *RegisterRes {
+	return this.negotiated.Load()
+}
+
+// useNegotiated 应用协商结果,调用方需持有写锁
+// 在此之前发送的数据包使用原帧协议,之后的使用协商后的帧协议
+func (this *Tunnel) useNegotiated(res *RegisterRes) {
+	this.negotiated.Store(res)
+	if f := GetFrame(res.Frame); f != nil {
+		this.f = f
+	}
+	if res.HasFeature(FeatureChecksum) {
+		this.f = NewChecksumFrame(this.f)
+	}
+}
+
+// Corrupted 获取校验失败被丢弃的数据包数量
+func (this *Tunnel) Corrupted() uint64 {
+	return this.corrupted.Load()
+}
+
 // Dial 向对端发起建立连接的请求
 // msgID 为消息唯一标识(为空则自动生成),dial 为目标连接配置,closer 为关闭回调
 // 返回一个虚拟IO,可以通过此IO与目标地址进行数据交互
 func (this *Tunnel) Dial(dial *Dial, onClose func() error) (io.ReadWriteCloser, error) {
-	msgID := uuid.New().String()
-	if err := this.WritePacket(msgID, Open, Request|NeedAck, dial); err != nil {
-		return nil, err
-	}
-	val, err := this.wait.Wait(msgID)
-	if err != nil {
-		return nil, err
+	return this.DialContext(context.Background(), dial, onClose)
+}
+
+// DialContext 向对端发起建立连接的请求,ctx 结束时放弃等待并返回 ctx 的错误,
+// 同时通知对端关闭可能已经建立的连接
+func (this *Tunnel) DialContext(ctx context.Context, dial *Dial, onClose func() error) (io.ReadWriteCloser, error) {
+	if this.isDraining() {
+		return nil, ErrGoAway
 	}
 	res := new(DialRes)
-	if err := json.Unmarshal(conv.Bytes(val), res); err != nil {
+	// 对端会在响应之后立即转发目标的数据(例如目标先发送欢迎信息),需要在处理下一个数据包之前创建虚拟IO
+	val, err := this.requestContext(ctx, this.timeout, this.newID(""), Open, dial, func(v any) (any, error) {
+		if err := json.Unmarshal(conv.Bytes(v), res); err != nil {
+			return nil, err
+		}
+		return this.CreateIO(res.Key, onClose), nil
+	})
+	if err != nil {
 		return nil, err
 	}
-	if res != nil {
+	if res.Dial != nil {
 		*dial = *res.Dial
 	}
-	return this.CreateIO(res.Key, onClose), nil
+	return val.(*IO), nil
 }
 
 // DialBridge 建立连接并进行数据桥接
@@ -151,17 +461,39 @@ func (this *Tunnel) GetIO(key string) *IO {
 
 // CreateIO 创建一个新的虚拟IO并注册到隧道中
 // key 为IO的唯一标识,closer 为关闭时触发的回调
+// 帧协议使用数字ID时,key 需为 newID 分配的数字ID
 func (this *Tunnel) CreateIO(key string, onClose func() error) *IO {
+	window := this.streamWindow()
 	v := NewIO(this.r, func(v *IO) {
+		if window > 0 {
+			// 双方使用相同的窗口,对端的发送额度等于本地的接收窗口
+			v.window = window
+			v.shared = &this.buffered
+			v.credit = newSendWindow(window)
+			v.OnRead = func(n int) { this.release(key, v, n) }
+		}
 		v.OnWrite = func(bs []byte) ([]byte, error) {
-			p := this.f.NewPacket(key, Write, Request, bs)
-			return p, nil
+			// 经由隧道发送,保证帧协议切换时的顺序
+			return nil, this.writeData(v, key, bs)
+		}
+		if this.Negotiated().HasFeature(FeatureHalfClose) {
+			v.OnCloseWrite = func() error {
+				return this.WritePacket(key, HalfClose, Request, nil)
+			}
 		}
 		v.OnClose = func(v *IO, err error) error {
-			this.WritePacket(key, Close, Request, err) //可忽略错误
+			this.WritePacket(key, Close, Request, encodeError(err, this.Negotiated().HasFeature(FeatureErrorCode))) //可忽略错误
 			this.ioMu.Lock()
 			delete(this.ioMap, key)
 			this.ioMu.Unlock()
+			signal(this.ioClosed)
+			if window > 0 {
+				// 丢弃的未读数据可能让隧道低于上限
+				this.flowMu.Lock()
+				delete(this.stalled, key)
+				this.flowMu.Unlock()
+				this.flush()
+			}
 			if onClose != nil {
 				return onClose()
 			}
@@ -174,6 +506,13 @@ func (this *Tunnel) CreateIO(key string, onClose func() error) *IO {
 	return v
 }
 
+// RunContext 启动隧道主循环,同 Run,ctx 结束时关闭隧道并返回 ctx 的错误
+func (this *Tunnel) RunContext(ctx context.Context) error {
+	stop := context.AfterFunc(ctx, func() { this.CloseWithErr(ctx.Err()) })
+	defer stop()
+	return this.Run()
+}
+
 func (this *Tunnel) Running() bool {
 	return this.running.Load()
 }
@@ -193,20 +532,71 @@ func (this *Tunnel) Run() (err error) {
 		this.running.Store(false)
 	}()
 	buf := bufio.NewReader(this.r)
+	this.lastRecv.Store(time.Now().UnixNano())
+	if this.heartbeat > 0 {
+		go this.keepalive()
+	}
 
 	for {
-		msgID, _type, tags, data, err := this.f.ReadPacket(buf)
+		msgID, _type, tags, data, err := this.readPacket(buf)
+		if err == nil || errors.Is(err, ErrChecksum) {
+			this.lastRecv.Store(time.Now().UnixNano())
+		}
+		if errors.Is(err, ErrChecksum) {
+			this.dealCorrupt(msgID, _type, tags)
+			continue
+		}
 		if err != nil {
+			if this.Closed() {
+				// 隧道被关闭(例如心跳超时)导致的读取错误,返回关闭的原因
+				return this.Err()
+			}
 			return err
 		}
+		if _type != Write || !tags.IsRequest() {
+			// 数据引用读取缓存,数据包写入虚拟IO时会复制,其他消息可能被回调或等待者持有,需要复制
+			data = bytes.Clone(data)
+		}
 
 		// 处理响应数据
 		if !tags.IsRequest() {
+			if _type == Register && tags.Success() {
+				// 需要在读取下一个数据包之前切换帧协议
+				res := new(RegisterRes)
+				if json.Unmarshal(data, res) == nil && res.Version > 0 {
+					this.wMu.Lock()
+					this.useNegotiated(res)
+					this.wMu.Unlock()
+				}
+			}
 			if tags.Success() {
 				this.wait.Done(msgID, data)
 			} else {
-				this.wait.Done(msgID, nil, errors.New(string(data)))
+				this.wait.Done(msgID, nil, decodeError(data, this.recvCoded(_type)))
+			}
+			continue
+		}
+
+		// 解压数据,失败时数据已丢失,关闭对应的虚拟IO
+		if tags.Compressed() {
+			if data, err = this.decompress(data); err != nil {
+				logs.Trace("[错误]", err)
+				if i := this.GetIO(msgID); i != nil {
+					i.CloseWithErr(err)
+				}
+				continue
 			}
+		}
+
+		// 远程调用可能耗时较长,在单独的协程中执行和响应
+		if _type == RPC {
+			this.goRPC(msgID, tags.NeedAck(), data)
+			continue
+		}
+
+		// 建立连接可能耗时较长(例如目标不可达),在单独的协程中执行和响应
+		if _type == Open {
+			this.goOpen(msgID, tags.NeedAck(), data)
 			continue
 		}
 
@@ -220,7 +610,11 @@ func (this *Tunnel) Run() (err error) {
 		// 判断是否需要响应
 		if tags.NeedAck() {
 			if err != nil {
-				err = this.WritePacket(msgID, _type, Response|Fail, err)
+				err = this.WritePacket(msgID, _type, Response|Fail, encodeError(err, this.peerCoded(_type, data)))
+				logs.PrintErr(err)
+			} else if res, ok := resp.(*RegisterRes); ok && res != nil && _type == Register {
+				// 响应和切换帧协议需要原子执行,在发送协程编码响应后立即切换
+				err = this.writePacket(msgID, _type, Response|Success, res, func() { this.useNegotiated(res) })
 				logs.PrintErr(err)
 			} else {
 				err = this.WritePacket(msgID, _type, Response|Success, resp)
@@ -230,15 +624,36 @@ func (this *Tunnel) Run() (err error) {
 	}
 }
 
+// dealCorrupt 处理校验失败的数据包,丢弃数据并通知对应的请求或虚拟IO
+// 校验失败时消息ID也可能是错误的,只能尽力通知
+func (this *Tunnel) dealCorrupt(msgID string, _type Type, tags Tag) {
+	this.corrupted.Add(1)
+	logs.Tracef("[%s] 丢弃校验失败的数据包,类型: %d\n", this.Key(), _type)
+	switch {
+	case !tags.IsRequest():
+		this.wait.Done(msgID, nil, ErrChecksum)
+	case _type == Write:
+		// 数据已丢失,虚拟IO不能继续使用
+		if i := this.GetIO(msgID); i != nil {
+			i.CloseWithErr(ErrChecksum)
+		}
+	case tags.NeedAck():
+		logs.PrintErr(this.WritePacket(msgID, _type, Response|Fail, ErrChecksum))
+	}
+}
+
 // dealMessage 处理请求类型的消息
 func (this *Tunnel) dealMessage(msgID string, _type Type, data []byte) (any, error) {
-	// 对于没注册的非注册消息,返回错误
-	if !this.registered.Load() && _type != Register {
+	// 对于没注册的非注册消息,返回错误,心跳不需要注册
+	if !this.registered.Load() && _type != Register && _type != Ping {
 		return nil, ErrNotRegister
 	}
 
 	switch _type {
 
+	case Ping:
+		return data, nil
+
 	case Register:
 		if this.onRegister != nil {
 			res, err := this.onRegister(this, data)
@@ -268,41 +683,155 @@ func (this *Tunnel) dealMessage(msgID string, _type Type, data []byte) (any, err
 		}
 		return nil, ErrRemoteClose
 
+	case Window:
+		if i := this.GetIO(msgID); i != nil && i.credit != nil {
+			i.credit.add(int(conv.Uint32(data)))
+		}
+
+	case HalfClose:
+		if i := this.GetIO(msgID); i != nil {
+			i.readEOF()
+		}
+
 	case Close:
 		i := this.GetIO(msgID)
 		if i != nil {
-			errMsg := string(data)
-			if len(errMsg) == 0 {
-				errMsg = io.EOF.Error()
+			err := io.EOF
+			if len(data) > 0 {
+				err = decodeError(data, this.Negotiated().HasFeature(FeatureErrorCode))
+			}
+			i.remoteClose(err)
+		}
+
+	case Custom:
+		// 自定义消息交给注册的处理函数
+		return this.dealCustom(data)
+
+	case Cancel:
+		// 对端放弃了连接请求,还在建立连接时标记,建立后关闭,否则关闭已经为该请求建立的虚拟IO
+		var i *IO
+		this.openMu.Lock()
+		if _, ok := this.opening[msgID]; ok {
+			this.opening[msgID] = true
+		} else {
+			this.ioMu.RLock()
+			for _, v := range this.ioMap {
+				if v.openID == msgID {
+					i = v
+					break
+				}
 			}
-			i.CloseWithErr(errors.New(errMsg))
+			this.ioMu.RUnlock()
+		}
+		this.openMu.Unlock()
+		if i != nil {
+			i.CloseWithErr(context.Canceled)
 		}
 
-	case Open:
-		return this.dealOpen(data)
+	case GoAway:
+		// 对端正在关闭,不再建立新的虚拟IO,已有的虚拟IO继续使用
+		// 携带原因时(见 Kick)对端会立即关闭,使用对端的原因关闭隧道
+		this.drain()
+		if len(data) > 0 {
+			this.CloseWithErr(decodeError(data, this.Negotiated().HasFeature(FeatureErrorCode)))
+		}
+
+	default:
+		// 保留的类型,本端还不支持
+		return nil, ErrUnsupported
 
 	}
 
 	return nil, nil
 }
 
-// dealOpen 处理 Open 类型的请求,建立到目标地址的连接
-func (this *Tunnel) dealOpen(data []byte) (*DialRes, error) {
-	if this.dial == nil {
-		return nil, ErrDialInvalid
+// peerCoded 对端能否解析错误码,注册请求还没有协商结果,根据请求中通告的功能判断
+func (this *Tunnel) peerCoded(_type Type, data []byte) bool {
+	if this.Negotiated().HasFeature(FeatureErrorCode) {
+		return true
+	}
+	req := new(RegisterReq)
+	return _type == Register && json.Unmarshal(data, req) == nil &&
+		req.Protocol != nil && slices.Contains(req.Features, FeatureErrorCode)
+}
+
+// recvCoded 对端发送的失败响应是否携带错误码,注册响应还没有协商结果,根据本端注册请求中通告的功能判断
+func (this *Tunnel) recvCoded(_type Type) bool {
+	return this.Negotiated().HasFeature(FeatureErrorCode) || (_type == Register && this.codedRegister.Load())
+}
+
+// goOpen 在单独的协程中建立对端请求的连接并响应,不阻塞读取数据包和响应心跳
+// 建立连接期间收到的 Cancel 会记录在 opening 中
+func (this *Tunnel) goOpen(msgID string, needAck bool, data []byte) {
+	this.openMu.Lock()
+	this.opening[msgID] = false
+	this.openMu.Unlock()
+	go this.replyOpen(msgID, needAck, data)
+}
+
+// replyOpen 处理对端建立连接的请求并响应,对端不需要响应时忽略
+// 响应在发送协程中编码后才开始转发数据,否则虚拟IO的数据可能先于响应发送,对端还没有创建虚拟IO会丢弃数据
+func (this *Tunnel) replyOpen(msgID string, needAck bool, data []byte) {
+	res, start, err := this.dealOpen(msgID, data)
+	if err != nil {
+		logs.Trace("[错误]", err)
+		if needAck {
+			logs.PrintErr(this.WritePacket(msgID, Open, Response|Fail, encodeError(err, this.Negotiated().HasFeature(FeatureErrorCode))))
+		}
+		return
+	}
+	if !needAck {
+		start()
+		return
+	}
+	logs.PrintErr(this.writePacket(msgID, Open, Response|Success, res, start))
+}
+
+// dealOpen 处理 Open 类型的请求,建立到目标地址的连接,start 用于开始转发数据
+// msgID 为请求的消息ID,对端放弃请求(Cancel)时用于找到建立的虚拟IO
+func (this *Tunnel) dealOpen(msgID string, data []byte) (res *DialRes, start func(), err error) {
+	defer func() {
+		this.openMu.Lock()
+		delete(this.opening, msgID)
+		this.openMu.Unlock()
+	}()
+	if !this.registered.Load() {
+		return nil, nil, ErrNotRegister
+	}
+	if this.isDraining() {
+		return nil, nil, ErrGoAway
 	}
 	d := new(Dial)
 	if err := json.Unmarshal(data, d); err != nil {
-		return nil, err
+		return nil, nil, err
+	}
+	dial := this.dial
+	if d.Type == Serial {
+		// 本地串口需要明确允许,不交给拨号函数
+		dial = this.openSerial
+	}
+	if dial == nil {
+		return nil, nil, ErrDialInvalid
 	}
-	c, key, err := this.dial(d)
+	c, key, err := dial(d)
 	if err != nil {
-		return nil, err
+		return nil, nil, dialError(d.Address, err)
+	}
+	this.openMu.Lock()
+	if this.opening[msgID] || this.Closed() {
+		// 对端已经放弃了请求,或者隧道已经关闭
+		this.openMu.Unlock()
+		c.Close()
+		return nil, nil, context.Canceled
 	}
+	delete(this.opening, msgID)
+	// 使用帧协议分配的标识,和 ioMap 中的标识一致
+	key = this.newID(key)
+	i := this.CreateIO(key, c.Close)
+	i.openID = msgID
+	this.openMu.Unlock()
 	if this.onDialed != nil {
 		this.onDialed(d, key)
 	}
-	i := this.CreateIO(key, c.Close)
-	go Bridge(i, c)
-	return &DialRes{Key: key, Dial: d}, nil
+	return &DialRes{Key: key, Dial: d}, func() { go Bridge(i, c) }, nil
 }
@@ -0,0 +1,301 @@
+package core
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"math"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// acceptRegister 注册处理函数,和服务端一样根据客户端的注册请求协商协议
+func acceptRegister(tun *Tunnel, data []byte) (any, error) {
+	req := new(RegisterReq)
+	if err := json.Unmarshal(data, req); err != nil {
+		return nil, err
+	}
+	return tun.Negotiate(req), nil
+}
+
+// newTestPair 在 net.Pipe 上运行一对隧道,client 向 server 注册并完成协商
+func newTestPair(t testing.TB, server, client []TunnelOption) (*Tunnel, *Tunnel) {
+	t.Helper()
+	s, c := newTestTunnels(t, server, client)
+	if _, err := c.Register(&RegisterReq{Key: "client"}); err != nil {
+		t.Fatal(err)
+	}
+	return s, c
+}
+
+// TestNewIDParity 使用数字ID时发起注册的一方分配奇数,另一方分配偶数,
+// 序号回绕后跳过0和仍在使用的标识
+func TestNewIDParity(t *testing.T) {
+	s, c := newTestPair(t, []TunnelOption{WithDial(echoDial)}, nil)
+
+	for i := 0; i < 4; i++ {
+		sid, _ := strconv.ParseUint(s.newID(""), 10, 32)
+		cid, _ := strconv.ParseUint(c.newID(""), 10, 32)
+		if sid%2 != 0 || cid%2 != 1 {
+			t.Fatalf("奇偶不符: 服务端%d 客户端%d", sid, cid)
+		}
+	}
+
+	// 对端分配的虚拟IO标识和本端的奇偶一致
+	i, err := c.Dial(&Dial{Type: TCP, Address: "echo"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer i.Close()
+	var key string
+	c.ioMu.RLock()
+	for k := range c.ioMap {
+		key = k
+	}
+	c.ioMu.RUnlock()
+	if id, _ := strconv.ParseUint(key, 10, 32); id%2 != 0 || s.GetIO(key) == nil {
+		t.Fatalf("虚拟IO标识%s不是服务端分配的", key)
+	}
+
+	// 回绕: 0xFFFFFFFE 之后是0(跳过),2(使用中,跳过),4
+	s.CreateIO("2", nil)
+	s.seq.Store(math.MaxUint32/2 - 1)
+	for _, want := range []string{"4294967294", "4", "6"} {
+		if got := s.newID(""); got != want {
+			t.Fatalf("预期%s,得到%s", want, got)
+		}
+	}
+	c.seq.Store(math.MaxUint32 / 2)
+	for _, want := range []string{"4294967295", "1"} {
+		if got := c.newID(""); got != want {
+			t.Fatalf("预期%s,得到%s", want, got)
+		}
+	}
+}
+
+// echoDial 连接函数,目标原样返回写入的数据
+func echoDial(d *Dial) (io.ReadWriteCloser, string, error) {
+	c1, c2 := net.Pipe()
+	go func() {
+		io.Copy(c2, c2)
+		c2.Close()
+	}()
+	return c1, "echo", nil
+}
+
+// testEcho 通过隧道连接目标,发送数据并校验返回的数据
+func testEcho(t *testing.T, tun *Tunnel, msg []byte) {
+	c, err := tun.Dial(&Dial{Type: TCP, Address: "echo"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	go c.Write(msg)
+	done := make(chan error, 1)
+	buf := make([]byte, len(msg))
+	go func() {
+		_, err := io.ReadFull(c, buf)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("等待返回的数据超时")
+	}
+	if !bytes.Equal(buf, msg) {
+		t.Fatal("返回的数据不一致")
+	}
+}
+
+// newTestTunnels 在 net.Pipe 上运行一对还未注册的隧道
+func newTestTunnels(t testing.TB, server, client []TunnelOption) (*Tunnel, *Tunnel) {
+	t.Helper()
+	c1, c2 := net.Pipe()
+	s := NewTunnel(c1, append([]TunnelOption{WithKey("server"), WithRegister(acceptRegister)}, server...)...)
+	c := NewTunnel(c2, append([]TunnelOption{WithKey("client")}, client...)...)
+	t.Cleanup(func() {
+		c.Close()
+		s.Close()
+	})
+	go s.Run()
+	go c.Run()
+	return s, c
+}
+
+// TestNegotiateLegacy 新旧版本互相注册时不切换帧协议,虚拟IO可以正常使用
+func TestNegotiateLegacy(t *testing.T) {
+	t.Run("旧版本客户端", func(t *testing.T) {
+		s, c := newTestTunnels(t, []TunnelOption{WithDial(echoDial)}, nil)
+		// 旧版本客户端的注册请求不携带协议能力
+		if _, err := c.Register(map[string]any{"key": "client"}); err != nil {
+			t.Fatal(err)
+		}
+		if s.Negotiated() != nil || c.Negotiated() != nil {
+			t.Fatal("旧版本客户端不应协商")
+		}
+		testEcho(t, c, []byte("legacy-client"))
+	})
+
+	t.Run("旧版本服务端", func(t *testing.T) {
+		// 旧版本服务端只响应监听配置
+		s, c := newTestTunnels(t, []TunnelOption{WithDial(echoDial), WithRegister(func(tun *Tunnel, data []byte) (any, error) {
+			return nil, nil
+		})}, nil)
+		if _, err := c.Register(&RegisterReq{Key: "client"}); err != nil {
+			t.Fatal(err)
+		}
+		if s.Negotiated() != nil || c.Negotiated() != nil {
+			t.Fatal("旧版本服务端不应协商")
+		}
+		testEcho(t, c, []byte("legacy-server"))
+	})
+
+	t.Run("只支持v1", func(t *testing.T) {
+		v1 := &Protocol{Version: ProtocolVersion, Frames: []string{FrameNameV1}}
+		s, c := newTestPair(t, []TunnelOption{WithDial(echoDial), WithProtocol(v1)}, nil)
+		if res := c.Negotiated(); res == nil || res.Frame != FrameNameV1 || len(res.Features) != 0 {
+			t.Fatalf("协商结果错误: %+v", res)
+		}
+		if s.Negotiated().Frame != FrameNameV1 {
+			t.Fatal("服务端协商结果错误")
+		}
+		testEcho(t, c, []byte("v1-only"))
+	})
+}
+
+// TestNegotiateRejected 注册失败时隧道不使用协商结果,客户端的注册请求不被修改
+func TestNegotiateRejected(t *testing.T) {
+	s, c := newTestTunnels(t, []TunnelOption{WithRegister(func(tun *Tunnel, data []byte) (any, error) {
+		req := new(RegisterReq)
+		json.Unmarshal(data, req)
+		if tun.Negotiate(req) == nil {
+			return nil, errors.New("没有协商")
+		}
+		return nil, ErrAuth
+	})}, nil)
+	req := &RegisterReq{Key: "client"}
+	if _, err := c.Register(req); !errors.Is(err, ErrAuth) {
+		t.Fatalf("预期 ErrAuth,得到 %v", err)
+	}
+	if s.Negotiated() != nil || c.Negotiated() != nil {
+		t.Fatal("注册失败后使用了协商结果")
+	}
+	if req.Protocol != nil {
+		t.Fatal("注册修改了调用方的请求")
+	}
+}
+
+// TestOpenGreeting 目标建立连接后立即发送数据(例如欢迎信息),响应发送之后才开始转发,对端不会丢失数据
+func TestOpenGreeting(t *testing.T) {
+	greeting := []byte("220 ready\r\n")
+	wrote := make(chan struct{}, 1)
+	s, c := newTestPair(t, []TunnelOption{WithDial(func(d *Dial) (io.ReadWriteCloser, string, error) {
+		c1, c2 := net.Pipe()
+		go func() {
+			// net.Pipe 的写入在数据被读取后才返回
+			c2.Write(greeting)
+			wrote <- struct{}{}
+			io.Copy(io.Discard, c2)
+		}()
+		return c1, "", nil
+	})}, nil)
+
+	// 建立连接后不会立即转发,等待响应编码后开始
+	_, start, err := s.dealOpen("open", []byte(`{"type":"tcp","address":"greeting"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-wrote:
+		t.Fatal("响应之前开始转发数据")
+	case <-time.After(50 * time.Millisecond):
+	}
+	start()
+	select {
+	case <-wrote:
+	case <-time.After(5 * time.Second):
+		t.Fatal("没有开始转发数据")
+	}
+
+	for n := 0; n < 20; n++ {
+		i, err := c.Dial(&Dial{Type: TCP, Address: "greeting"}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		<-wrote
+		buf := make([]byte, len(greeting))
+		done := make(chan error, 1)
+		go func() {
+			_, err := io.ReadFull(i, buf)
+			done <- err
+		}()
+		select {
+		case err := <-done:
+			if err != nil || !bytes.Equal(buf, greeting) {
+				t.Fatalf("第%d次连接读取欢迎信息失败: %q %v", n, buf, err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("第%d次连接没有收到欢迎信息", n)
+		}
+		i.Close()
+	}
+}
+
+// TestDialCancel ctx 结束时通知对端(Cancel)放弃请求,对端之后才建立的连接会被关闭,不会残留虚拟IO
+func TestDialCancel(t *testing.T) {
+	dialing := make(chan struct{})
+	release := make(chan struct{})
+	target := make(chan net.Conn, 1)
+	s, c := newTestPair(t, []TunnelOption{WithDial(func(d *Dial) (io.ReadWriteCloser, string, error) {
+		close(dialing)
+		<-release
+		c1, c2 := net.Pipe()
+		target <- c2
+		return c1, "", nil
+	})}, nil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errCh := make(chan error, 1)
+	go func() {
+		_, err := c.DialContext(ctx, &Dial{Type: TCP, Address: "slow"}, nil)
+		errCh <- err
+	}()
+	<-dialing
+	cancel()
+	if err := <-errCh; !errors.Is(err, context.Canceled) {
+		t.Fatalf("预期 context.Canceled,得到 %v", err)
+	}
+
+	// 对端收到 Cancel 后标记正在建立的连接
+	waitFor(t, "对端没有收到 Cancel", func() bool {
+		s.openMu.Lock()
+		defer s.openMu.Unlock()
+		for _, canceled := range s.opening {
+			if canceled {
+				return true
+			}
+		}
+		return false
+	})
+
+	// 连接建立后立即关闭
+	close(release)
+	conn := <-target
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); !errors.Is(err, io.EOF) {
+		t.Fatalf("对端没有关闭放弃的连接: %v", err)
+	}
+	s.ioMu.RLock()
+	n := len(s.ioMap)
+	s.ioMu.RUnlock()
+	if n != 0 {
+		t.Fatalf("放弃的请求残留了%d个虚拟IO", n)
+	}
+}
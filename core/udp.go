@@ -0,0 +1,337 @@
+package core
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/injoyai/base/safe"
+	"github.com/injoyai/conv"
+)
+
+// UDP 相关的自定义参数(Param)名称,用于 Listen
+const (
+	ParamIdle = "idle" // ParamIdle UDP会话的空闲超时时间,例如"30s",纯数字表示秒,0表示不超时
+)
+
+const (
+	DefaultUDPIdle = time.Minute // DefaultUDPIdle 默认的UDP会话空闲超时时间
+	udpMaxDatagram = 0xFFFF      // udpMaxDatagram 单个数据报的最大长度,受长度字段限制
+	udpQueueSize   = 64          // udpQueueSize 每个会话缓存的未读数据报数量,超过后丢弃,和UDP的语义一致
+	udpAcceptSize  = 16          // udpAcceptSize 等待 Accept 的新会话数量,超过后丢弃
+)
+
+// dialUDP 建立 UDP 连接,返回按数据报分帧的字节流连接
+func dialUDP(ctx context.Context, d *Dial) (net.Conn, error) {
+	c, err := (&net.Dialer{Timeout: d.Timeout}).DialContext(ctx, UDP, d.Address)
+	if err != nil {
+		return nil, err
+	}
+	return NewUDPStream(c), nil
+}
+
+// listenUDP 监听 UDP 端口,按来源地址区分会话
+func listenUDP(l *Listen) (net.Listener, error) {
+	c, err := net.ListenPacket(UDP, l.Address)
+	if err != nil {
+		return nil, err
+	}
+	idle := DefaultUDPIdle
+	if v, ok := l.Param[ParamIdle]; ok {
+		idle = parseDuration(v)
+	}
+	return NewUDPListener(c, idle), nil
+}
+
+// parseDuration 解析时间,支持"30s"这种格式,纯数字表示秒
+func parseDuration(v any) time.Duration {
+	switch t := v.(type) {
+	case time.Duration:
+		return t
+	case string:
+		if d, err := time.ParseDuration(strings.TrimSpace(t)); err == nil {
+			return d
+		}
+	}
+	return time.Duration(conv.Int64(v)) * time.Second
+}
+
+// NewUDPListener 创建一个 UDP 监听器,同一来源地址的数据报属于同一个会话
+// 每个会话作为一个连接由 Accept 返回,会话在 idle 时间内没有收发数据时自动关闭,0表示不超时
+// 返回的连接按数据报分帧,见 NewUDPStream
+func NewUDPListener(c net.PacketConn, idle time.Duration) *UDPListener {
+	return newUDPListener(c, idle, NewUDPStream)
+}
+
+// newUDPListener wrap 用于将会话包装成 Accept 返回的连接
+func newUDPListener(c net.PacketConn, idle time.Duration, wrap func(c net.Conn) net.Conn) *UDPListener {
+	l := &UDPListener{
+		wrap:     wrap,
+		Closer:   safe.NewCloser(),
+		conn:     c,
+		idle:     idle,
+		sessions: make(map[string]*udpSession),
+		ch:       make(chan net.Conn, udpAcceptSize),
+	}
+	l.SetCloseFunc(func(error) error {
+		err := c.Close()
+		l.mu.Lock()
+		sessions := make([]*udpSession, 0, len(l.sessions))
+		for _, s := range l.sessions {
+			sessions = append(sessions, s)
+		}
+		l.mu.Unlock()
+		for _, s := range sessions {
+			s.CloseWithErr(io.EOF)
+		}
+		return err
+	})
+	go l.run()
+	return l
+}
+
+// UDPListener UDP 监听器,实现了 net.Listener
+type UDPListener struct {
+	*safe.Closer
+	conn     net.PacketConn
+	idle     time.Duration
+	wrap     func(c net.Conn) net.Conn
+	mu       sync.Mutex
+	sessions map[string]*udpSession
+	ch       chan net.Conn
+}
+
+// run 读取数据报并分发到对应的会话
+func (this *UDPListener) run() {
+	buf := make([]byte, udpMaxDatagram)
+	for {
+		n, addr, err := this.conn.ReadFrom(buf)
+		if err != nil {
+			this.CloseWithErr(err)
+			return
+		}
+		s, ok := this.session(addr)
+		if !ok {
+			continue
+		}
+		s.push(append([]byte(nil), buf[:n]...))
+	}
+}
+
+// session 获取来源地址对应的会话,不存在则新建并交给 Accept
+func (this *UDPListener) session(addr net.Addr) (*udpSession, bool) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	if s, ok := this.sessions[addr.String()]; ok {
+		return s, true
+	}
+	select {
+	case <-this.Done():
+		return nil, false
+	default:
+	}
+	s := newUDPSession(this, addr)
+	select {
+	case this.ch <- this.wrap(s):
+		this.sessions[addr.String()] = s
+		s.active()
+		return s, true
+	default:
+		//来不及处理新会话,丢弃数据报
+		return nil, false
+	}
+}
+
+// remove 会话关闭后从监听器中移除
+func (this *UDPListener) remove(s *udpSession) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	if this.sessions[s.remote.String()] == s {
+		delete(this.sessions, s.remote.String())
+	}
+}
+
+// Accept 等待并返回下一个新的会话
+func (this *UDPListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-this.ch:
+		return c, nil
+	case <-this.Done():
+		return nil, this.Err()
+	}
+}
+
+// Addr 监听地址
+func (this *UDPListener) Addr() net.Addr {
+	return this.conn.LocalAddr()
+}
+
+// Len 当前会话数量
+func (this *UDPListener) Len() int {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	return len(this.sessions)
+}
+
+func newUDPSession(l *UDPListener, remote net.Addr) *udpSession {
+	s := &udpSession{
+		Closer: safe.NewCloser(),
+		l:      l,
+		remote: remote,
+		ch:     make(chan []byte, udpQueueSize),
+	}
+	s.SetCloseFunc(func(error) error {
+		s.timerMu.Lock()
+		if s.timer != nil {
+			s.timer.Stop()
+		}
+		s.timerMu.Unlock()
+		l.remove(s)
+		return nil
+	})
+	return s
+}
+
+// udpSession 监听器上的一个UDP会话,每次读写一个数据报
+type udpSession struct {
+	*safe.Closer
+	l        *UDPListener
+	remote   net.Addr
+	ch       chan []byte
+	timerMu  sync.Mutex
+	timer    *time.Timer  // timer 空闲超时定时器
+	deadline atomic.Int64 // deadline 读超时时间(纳秒时间戳),0表示不超时
+}
+
+// active 收发数据后重新计算空闲超时
+func (this *udpSession) active() {
+	if this.l.idle <= 0 {
+		return
+	}
+	this.timerMu.Lock()
+	defer this.timerMu.Unlock()
+	if this.timer == nil {
+		this.timer = time.AfterFunc(this.l.idle, func() { this.CloseWithErr(os.ErrDeadlineExceeded) })
+		return
+	}
+	this.timer.Reset(this.l.idle)
+}
+
+// push 缓存收到的数据报,缓存满时丢弃
+func (this *udpSession) push(p []byte) {
+	this.active()
+	select {
+	case this.ch <- p:
+	default:
+	}
+}
+
+// Read 读取一个数据报,p 的长度不足时多余的部分会被丢弃,和UDP的语义一致
+func (this *udpSession) Read(p []byte) (int, error) {
+	var timeout <-chan time.Time
+	if t := this.deadline.Load(); t != 0 {
+		timer := time.NewTimer(time.Until(time.Unix(0, t)))
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case bs := <-this.ch:
+		return copy(p, bs), nil
+	case <-this.Done():
+		return 0, this.Err()
+	case <-timeout:
+		return 0, os.ErrDeadlineExceeded
+	}
+}
+
+// Write 发送一个数据报
+func (this *udpSession) Write(p []byte) (int, error) {
+	if this.Closed() {
+		return 0, this.Err()
+	}
+	this.active()
+	return this.l.conn.WriteTo(p, this.remote)
+}
+
+func (this *udpSession) LocalAddr() net.Addr { return this.l.Addr() }
+
+func (this *udpSession) RemoteAddr() net.Addr { return this.remote }
+
+func (this *udpSession) SetDeadline(t time.Time) error { return this.SetReadDeadline(t) }
+
+func (this *udpSession) SetReadDeadline(t time.Time) error {
+	if t.IsZero() {
+		this.deadline.Store(0)
+	} else {
+		this.deadline.Store(t.UnixNano())
+	}
+	return nil
+}
+
+// SetWriteDeadline UDP 写入不会阻塞,忽略写超时
+func (this *udpSession) SetWriteDeadline(t time.Time) error { return nil }
+
+// NewUDPStream 将数据报连接包装成字节流连接,用于经过隧道等字节流传输时保留数据报边界
+// 每个数据报编码为 [长度2字节][数据],和 DNS over TCP 的格式一致
+// c 每次 Read 需要返回一个完整的数据报,例如 net.UDPConn
+func NewUDPStream(c net.Conn) net.Conn {
+	return &udpStream{Conn: c}
+}
+
+type udpStream struct {
+	net.Conn
+	buf  []byte     // buf 读取数据报的缓存
+	rBuf []byte     // rBuf 已编码未读取的数据
+	wBuf []byte     // wBuf 已写入但不足一个数据报的数据
+	wMu  sync.Mutex // wMu 保证写入数据的顺序
+}
+
+// Read 读取一个数据报并编码,不支持并发调用
+func (this *udpStream) Read(p []byte) (int, error) {
+	if len(this.rBuf) == 0 {
+		if this.buf == nil {
+			this.buf = make([]byte, udpMaxDatagram+2)
+		}
+		n, err := this.Conn.Read(this.buf[2:])
+		if err != nil {
+			return 0, err
+		}
+		binary.BigEndian.PutUint16(this.buf, uint16(n))
+		this.rBuf = this.buf[:n+2]
+	}
+	n := copy(p, this.rBuf)
+	this.rBuf = this.rBuf[n:]
+	return n, nil
+}
+
+// Write 解析写入的数据,每凑齐一个数据报就发送
+// 发送失败时丢弃未发送的数据,返回 p 中已经发送的长度
+func (this *udpStream) Write(p []byte) (int, error) {
+	this.wMu.Lock()
+	defer this.wMu.Unlock()
+	prev := len(this.wBuf)
+	this.wBuf = append(this.wBuf, p...)
+	sent := 0
+	for len(this.wBuf)-sent >= 2 {
+		n := int(binary.BigEndian.Uint16(this.wBuf[sent:])) + 2
+		if len(this.wBuf)-sent < n {
+			break
+		}
+		if _, err := this.Conn.Write(this.wBuf[sent+2 : sent+n]); err != nil {
+			this.wBuf = nil
+			return max(sent-prev, 0), err
+		}
+		sent += n
+	}
+	this.wBuf = this.wBuf[sent:]
+	if len(this.wBuf) == 0 {
+		this.wBuf = nil
+	}
+	return len(p), nil
+}
@@ -0,0 +1,184 @@
+package core
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+// listenTestUDP 在本地监听 UDP,返回监听器和连接到监听器的客户端
+func listenTestUDP(t *testing.T, idle time.Duration, clients int) (*UDPListener, []net.Conn) {
+	t.Helper()
+	l := NewListen(UDP, "127.0.0.1:0", WithUDPIdle(idle))
+	if err := l.Listen(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	list := make([]net.Conn, clients)
+	for i := range list {
+		c, err := net.Dial("udp", l.listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { c.Close() })
+		list[i] = c
+	}
+	return l.listener.(*UDPListener), list
+}
+
+// acceptTimeout 等待一个新的会话,返回未经 NewUDPStream 包装的会话,每次读写一个数据报
+func acceptTimeout(t *testing.T, l net.Listener) net.Conn {
+	t.Helper()
+	ch := make(chan net.Conn, 1)
+	go func() {
+		c, err := l.Accept()
+		if err == nil {
+			ch <- c
+		}
+	}()
+	select {
+	case c := <-ch:
+		return c.(*udpStream).Conn
+	case <-time.After(5 * time.Second):
+		t.Fatal("等待会话超时")
+		return nil
+	}
+}
+
+// readDatagram 从会话中读取一个数据报
+func readDatagram(t *testing.T, c net.Conn) string {
+	t.Helper()
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	p := make([]byte, 1024)
+	n, err := c.Read(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(p[:n])
+}
+
+// TestUDPListenerSessions 每个来源地址是一个会话,会话的读写只涉及对应的来源地址
+func TestUDPListenerSessions(t *testing.T) {
+	l, clients := listenTestUDP(t, time.Minute, 2)
+	sessions := map[string]net.Conn{}
+	for i, c := range clients {
+		c.Write([]byte{'a' + byte(i)})
+		s := acceptTimeout(t, l)
+		sessions[s.RemoteAddr().String()] = s
+	}
+	if l.Len() != 2 {
+		t.Fatalf("预期2个会话,得到%d个", l.Len())
+	}
+	for i, c := range clients {
+		s := sessions[c.LocalAddr().String()]
+		// 会话收到的是 Accept 之前的第一个数据报和之后的数据报,读取时不拆分也不合并
+		if got := readDatagram(t, s); got != string(rune('a'+i)) {
+			t.Fatalf("会话%d收到%q", i, got)
+		}
+		c.Write([]byte("hello"))
+		c.Write([]byte("world"))
+		if got := readDatagram(t, s) + "," + readDatagram(t, s); got != "hello,world" {
+			t.Fatalf("会话%d收到%q", i, got)
+		}
+		s.Write([]byte("reply"))
+		if got := readDatagram(t, c); got != "reply" {
+			t.Fatalf("客户端%d收到%q", i, got)
+		}
+	}
+}
+
+// TestUDPListenerIdle 会话在空闲时间内没有收发数据时关闭并从监听器中移除
+func TestUDPListenerIdle(t *testing.T) {
+	l, clients := listenTestUDP(t, 100*time.Millisecond, 1)
+	clients[0].Write([]byte("a"))
+	s := acceptTimeout(t, l)
+	readDatagram(t, s)
+	s.SetReadDeadline(time.Time{})
+	if _, err := s.Read(make([]byte, 16)); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("预期空闲超时,得到 %v", err)
+	}
+	if l.Len() != 0 {
+		t.Fatal("空闲的会话没有移除")
+	}
+	// 同一来源地址再次发送数据时是新的会话
+	clients[0].Write([]byte("b"))
+	if s2 := acceptTimeout(t, l); s2 == s || readDatagram(t, s2) != "b" {
+		t.Fatal("没有建立新的会话")
+	}
+}
+
+// TestUDPStream 字节流和数据报互相转换时保留数据报边界,一个数据报可以拆分在多次写入中
+func TestUDPStream(t *testing.T) {
+	l, _ := listenTestUDP(t, time.Minute, 0)
+	c, err := net.Dial("udp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	stream := NewUDPStream(c)
+	defer stream.Close()
+
+	// 写入: 两个数据报,拆分在多次写入中
+	for _, p := range [][]byte{{0}, {3, 'a'}, {'b', 'c', 0, 2, 'd'}, {'e'}} {
+		if n, err := stream.Write(p); err != nil || n != len(p) {
+			t.Fatal(n, err)
+		}
+	}
+	s := acceptTimeout(t, l)
+	if got := readDatagram(t, s) + "," + readDatagram(t, s); got != "abc,de" {
+		t.Fatalf("数据报边界错误: %q", got)
+	}
+
+	// 读取: 每个数据报编码为 [长度][数据],使用小的缓存分多次读取
+	s.Write([]byte("xyz"))
+	s.Write([]byte("w"))
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var got []byte
+	p := make([]byte, 2)
+	for len(got) < 5+3 {
+		n, err := stream.Read(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, p[:n]...)
+	}
+	if want := []byte{0, 3, 'x', 'y', 'z', 0, 1, 'w'}; !bytes.Equal(got, want) {
+		t.Fatalf("预期%v,得到%v", want, got)
+	}
+}
+
+// failConn 第 n 次写入开始返回错误
+type failConn struct {
+	net.Conn
+	n      int
+	writes [][]byte
+}
+
+func (this *failConn) Write(p []byte) (int, error) {
+	if len(this.writes) >= this.n {
+		return 0, net.ErrClosed
+	}
+	this.writes = append(this.writes, bytes.Clone(p))
+	return len(p), nil
+}
+
+// TestUDPStreamWriteError 发送失败时返回已经发送的长度,并丢弃未发送的数据
+func TestUDPStreamWriteError(t *testing.T) {
+	fc := &failConn{n: 2}
+	stream := NewUDPStream(fc).(*udpStream)
+
+	// 上次写入剩余的半个数据报,本次写入补全后发送,第二个数据报发送失败
+	stream.Write([]byte{0, 2, 'a'})
+	n, err := stream.Write([]byte{'b', 0, 1, 'c', 0, 1, 'd'})
+	if !errors.Is(err, net.ErrClosed) || n != 4 {
+		t.Fatalf("预期发送4字节后失败,得到%d %v", n, err)
+	}
+	if stream.wBuf != nil {
+		t.Fatal("失败后没有丢弃未发送的数据")
+	}
+	if len(fc.writes) != 2 || string(fc.writes[0]) != "ab" || string(fc.writes[1]) != "c" {
+		t.Fatalf("发送的数据报错误: %q", fc.writes)
+	}
+}
@@ -11,7 +11,9 @@ import (
 
 const (
 	TCP       = "tcp"
+	TLS       = "tls"
 	UDP       = "udp"
+	RUDP      = "rudp"
 	Serial    = "serial"
 	Websocket = "websocket"
 )
@@ -21,22 +23,53 @@ func init() {
 	//logs.SetLevel(logs.LevelInfo)
 }
 
+// CloseWriter 支持半关闭的连接,例如 *net.TCPConn、*tls.Conn 和 *IO
+type CloseWriter interface {
+	CloseWrite() error
+}
+
+// Bridge 双向转发 c1 和 c2 的数据,结束后关闭两端
+// 一个方向读取结束时,如果另一端支持半关闭(CloseWriter),只关闭它的写入方向,
+// 等另一个方向也结束后再返回,否则立即关闭两端
 func Bridge(c1, c2 io.ReadWriteCloser) error {
 	defer c1.Close()
 	defer c2.Close()
-	ch := make(chan error, 2)
+	type result struct {
+		half bool
+		err  error
+	}
+	ch := make(chan result, 2)
 	go func() {
-		_, err := io.Copy(c1, c2)
-		ch <- err
+		half, err := copyHalf(c1, c2)
+		ch <- result{half, err}
 	}()
 	go func() {
-		_, err := io.Copy(c2, c1)
-		ch <- err
+		half, err := copyHalf(c2, c1)
+		ch <- result{half, err}
 	}()
-	return <-ch
+	r := <-ch
+	if r.err != nil || !r.half {
+		return r.err
+	}
+	r = <-ch
+	return r.err
 }
 
+// copyHalf 复制 src 的数据到 dst,src 读取结束后半关闭 dst,返回是否半关闭成功
+func copyHalf(dst io.Writer, src io.Reader) (bool, error) {
+	if _, err := io.Copy(dst, src); err != nil {
+		return false, err
+	}
+	c, ok := dst.(CloseWriter)
+	return ok && c.CloseWrite() == nil, nil
+}
+
+// DefaultDial 默认的拨号方式,支持 tcp、udp 和 rudp,其他类型按 tcp 处理
+// 本地串口需要通过 WithDialSerial 允许,不经过拨号函数
 func DefaultDial(d *Dial) (io.ReadWriteCloser, string, error) {
+	if d.Type == UDP || d.Type == RUDP {
+		return d.Dial()
+	}
 	c, err := net.DialTimeout("tcp", d.Address, d.Timeout)
 	if err != nil {
 		return nil, "", err
@@ -0,0 +1,114 @@
+package core
+
+import (
+	"bytes"
+	"io"
+	"testing"
+	"time"
+)
+
+// halfPipe 支持半关闭的内存连接对,一端半关闭后另一端读取到 EOF,仍然可以反向写入
+func halfPipe() (*halfConn, *halfConn) {
+	r1, w1 := io.Pipe()
+	r2, w2 := io.Pipe()
+	return &halfConn{r: r1, w: w2}, &halfConn{r: r2, w: w1}
+}
+
+type halfConn struct {
+	r *io.PipeReader
+	w *io.PipeWriter
+}
+
+func (this *halfConn) Read(p []byte) (int, error) { return this.r.Read(p) }
+
+func (this *halfConn) Write(p []byte) (int, error) { return this.w.Write(p) }
+
+func (this *halfConn) CloseWrite() error { return this.w.Close() }
+
+func (this *halfConn) Close() error {
+	this.w.Close()
+	return this.r.Close()
+}
+
+// readAll 读取到 EOF,超时后失败
+func readAll(t *testing.T, r io.Reader) []byte {
+	t.Helper()
+	ch := make(chan []byte, 1)
+	go func() {
+		bs, _ := io.ReadAll(r)
+		ch <- bs
+	}()
+	select {
+	case bs := <-ch:
+		return bs
+	case <-time.After(5 * time.Second):
+		t.Fatal("等待读取结束超时")
+		return nil
+	}
+}
+
+// TestBridgeHalfClose 经过隧道转发时,一个方向半关闭后另一个方向的数据可以继续发送完
+func TestBridgeHalfClose(t *testing.T) {
+	targets := make(chan *halfConn, 1)
+	_, c := newTestPair(t, []TunnelOption{WithDial(func(d *Dial) (io.ReadWriteCloser, string, error) {
+		a, b := halfPipe()
+		targets <- b
+		return a, "", nil
+	})}, nil)
+	request := []byte("request")
+	response := bytes.Repeat([]byte("response"), 64<<10)
+
+	t.Run("客户端先半关闭", func(t *testing.T) {
+		i, err := c.Dial(&Dial{Type: TCP, Address: "target"}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer i.Close()
+		target := <-targets
+		defer target.Close()
+
+		if _, err := i.Write(request); err != nil {
+			t.Fatal(err)
+		}
+		if err := i.(CloseWriter).CloseWrite(); err != nil {
+			t.Fatal(err)
+		}
+		// 目标读取到 EOF 后再响应,例如 HTTP/1.0 的请求
+		if bs := readAll(t, target); !bytes.Equal(bs, request) {
+			t.Fatalf("目标收到的数据不一致: %q", bs)
+		}
+		go func() {
+			target.Write(response)
+			target.CloseWrite()
+		}()
+		if bs := readAll(t, i); !bytes.Equal(bs, response) {
+			t.Fatalf("客户端收到的数据不一致,长度%d", len(bs))
+		}
+	})
+
+	t.Run("目标先半关闭", func(t *testing.T) {
+		i, err := c.Dial(&Dial{Type: TCP, Address: "target"}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer i.Close()
+		target := <-targets
+		defer target.Close()
+
+		go func() {
+			target.Write(response)
+			target.CloseWrite()
+		}()
+		if bs := readAll(t, i); !bytes.Equal(bs, response) {
+			t.Fatalf("客户端收到的数据不一致,长度%d", len(bs))
+		}
+		// 读取结束后仍然可以写入
+		go func() {
+			i.Write(request)
+			i.(CloseWriter).CloseWrite()
+		}()
+		if bs := readAll(t, target); !bytes.Equal(bs, request) {
+			t.Fatalf("目标收到的数据不一致: %q", bs)
+		}
+	})
+}
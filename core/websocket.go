@@ -0,0 +1,196 @@
+package core
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/injoyai/base/safe"
+	"github.com/injoyai/conv"
+)
+
+// Websocket 相关的自定义参数(Param)名称,用于 Dial 和 Listen
+const (
+	ParamPath   = "path"   // ParamPath 监听的HTTP路径,默认为"/"
+	ParamHeader = "header" // ParamHeader 连接时附带的HTTP请求头,格式为 map[string]any
+)
+
+// websocketHeaderTimeout 监听时读取HTTP请求头的超时时间,防止慢速连接占用资源
+const websocketHeaderTimeout = time.Second * 10
+
+// dialWebsocket 建立 websocket 连接,地址格式为 ws://host:port/path 或 wss://host:port/path
+// wss 的证书参数和 tls 类型一致
+func dialWebsocket(ctx context.Context, d *Dial) (net.Conn, error) {
+	address := d.Address
+	if !strings.Contains(address, "://") {
+		address = "ws://" + address
+	}
+	dialer := &websocket.Dialer{
+		Proxy:            http.ProxyFromEnvironment,
+		HandshakeTimeout: d.Timeout,
+	}
+	if strings.HasPrefix(address, "wss://") {
+		cfg, err := NewTLSConfig(d.Param, d.TLS, false)
+		if err != nil {
+			return nil, err
+		}
+		dialer.TLSClientConfig = cfg
+	}
+	header := http.Header{}
+	if m, ok := d.Param[ParamHeader].(map[string]any); ok {
+		for k, v := range m {
+			header.Set(k, conv.String(v))
+		}
+	}
+	c, _, err := dialer.DialContext(ctx, address, header)
+	if err != nil {
+		//握手时 ctx 结束表现为读写超时,返回 ctx 的错误
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, err
+	}
+	return NewWebsocketConn(c), nil
+}
+
+// listenWebsocket 在地址上启动HTTP服务,将指定路径的 websocket 连接作为监听器的连接
+// 设置了证书参数时使用 HTTPS(wss),HTTP服务退出时监听器以同样的错误关闭
+func listenWebsocket(l *Listen) (net.Listener, error) {
+	listener, err := net.Listen(TCP, l.Address)
+	if err != nil {
+		return nil, err
+	}
+	if l.TLS != nil || conv.String(l.Param[ParamCert]) != "" {
+		cfg, err := NewTLSConfig(l.Param, l.TLS, true)
+		if err != nil {
+			listener.Close()
+			return nil, err
+		}
+		listener = tls.NewListener(listener, cfg)
+	}
+	path := conv.String(l.Param[ParamPath])
+	if path == "" {
+		path = "/"
+	}
+	wl := NewWebsocketListener(listener.Addr())
+	mux := http.NewServeMux()
+	mux.Handle(path, wl)
+	srv := &http.Server{Handler: mux, ReadHeaderTimeout: websocketHeaderTimeout}
+	wl.SetCloseFunc(func(error) error {
+		// 升级后的 websocket 连接已经脱离HTTP服务,不会被关闭
+		return srv.Close()
+	})
+	go func() {
+		wl.CloseWithErr(srv.Serve(listener))
+	}()
+	return wl, nil
+}
+
+// NewWebsocketListener 创建一个 websocket 监听器
+// 监听器实现了 http.Handler,可以挂载到已有的HTTP服务上,再通过 WithNetListener 交给 Listen 使用
+func NewWebsocketListener(addr net.Addr) *WebsocketListener {
+	return &WebsocketListener{
+		Closer: safe.NewCloser(),
+		addr:   addr,
+		ch:     make(chan net.Conn),
+		upgrader: websocket.Upgrader{
+			CheckOrigin: func(r *http.Request) bool { return true },
+		},
+	}
+}
+
+// WebsocketListener websocket 监听器,同时实现 net.Listener 和 http.Handler
+type WebsocketListener struct {
+	*safe.Closer
+	addr     net.Addr
+	ch       chan net.Conn
+	upgrader websocket.Upgrader
+}
+
+// ServeHTTP 升级HTTP请求为 websocket 连接,并交给 Accept
+func (this *WebsocketListener) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if this.Closed() {
+		http.Error(w, this.Err().Error(), http.StatusServiceUnavailable)
+		return
+	}
+	c, err := this.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	select {
+	case this.ch <- NewWebsocketConn(c):
+	case <-this.Done():
+		c.Close()
+	}
+}
+
+// Accept 等待并返回下一个 websocket 连接
+func (this *WebsocketListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-this.ch:
+		return c, nil
+	case <-this.Done():
+		return nil, this.Err()
+	}
+}
+
+// Addr 监听地址
+func (this *WebsocketListener) Addr() net.Addr {
+	return this.addr
+}
+
+// NewWebsocketConn 将 websocket 连接包装成字节流连接
+// 写入的数据作为二进制消息发送,读取时按顺序读取所有消息的数据
+func NewWebsocketConn(c *websocket.Conn) net.Conn {
+	return &websocketConn{Conn: c}
+}
+
+type websocketConn struct {
+	*websocket.Conn
+	r   io.Reader  // r 当前正在读取的消息
+	wMu sync.Mutex // wMu websocket 不支持并发写入
+}
+
+func (this *websocketConn) Read(p []byte) (int, error) {
+	for {
+		if this.r == nil {
+			_, r, err := this.Conn.NextReader()
+			if err != nil {
+				return 0, err
+			}
+			this.r = r
+		}
+		n, err := this.r.Read(p)
+		if err == io.EOF {
+			// 当前消息读取完毕,继续读取下一条消息
+			this.r = nil
+			if n == 0 {
+				continue
+			}
+			err = nil
+		}
+		return n, err
+	}
+}
+
+func (this *websocketConn) Write(p []byte) (int, error) {
+	this.wMu.Lock()
+	defer this.wMu.Unlock()
+	if err := this.Conn.WriteMessage(websocket.BinaryMessage, p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (this *websocketConn) SetDeadline(t time.Time) error {
+	if err := this.Conn.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return this.Conn.SetWriteDeadline(t)
+}
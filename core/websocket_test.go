@@ -0,0 +1,43 @@
+package core
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+// TestWebsocketListenerClose 关闭监听器时 Accept 立即返回,HTTP服务退出并释放端口
+func TestWebsocketListenerClose(t *testing.T) {
+	l := NewListen(Websocket, "127.0.0.1:0")
+	if err := l.Listen(); err != nil {
+		t.Fatal(err)
+	}
+	addr := l.listener.Addr().String()
+	done := make(chan error, 1)
+	go func() {
+		_, err := l.listener.Accept()
+		done <- err
+	}()
+	l.Close()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Fatal("关闭后 Accept 没有返回错误")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("关闭后 Accept 没有返回")
+	}
+	// HTTP服务退出后端口可以重新监听
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		ln, err := net.Listen("tcp", addr)
+		if err == nil {
+			ln.Close()
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("端口没有释放:", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,123 @@
+package core
+
+import (
+	"sync"
+
+	"github.com/injoyai/conv"
+)
+
+const (
+	// DefaultStreamWindow 默认每个虚拟IO的接收窗口,对端最多发送这么多未被读取的数据
+	DefaultStreamWindow = 256 << 10
+	// DefaultTunnelBuffer 默认每条隧道所有虚拟IO未读数据的上限,超过后暂停归还窗口
+	DefaultTunnelBuffer = 16 << 20
+)
+
+// newSendWindow 创建一个发送窗口,n 为初始额度
+func newSendWindow(n int) *sendWindow {
+	return &sendWindow{n: n, signal: make(chan struct{}, 1)}
+}
+
+// sendWindow 虚拟IO的发送窗口
+// 发送数据前需要获取额度,对端读取数据后通过 Window 消息归还
+type sendWindow struct {
+	mu     sync.Mutex
+	n      int
+	signal chan struct{}
+}
+
+// take 获取最多 max 字节的发送额度,没有额度时阻塞,done 关闭时返回false
+func (this *sendWindow) take(max int, done <-chan struct{}) (int, bool) {
+	for {
+		this.mu.Lock()
+		if this.n > 0 {
+			n := min(this.n, max)
+			this.n -= n
+			left := this.n
+			this.mu.Unlock()
+			if left > 0 {
+				// 还有额度时传递通知,可能有其他协程在等待
+				signal(this.signal)
+			}
+			return n, true
+		}
+		this.mu.Unlock()
+		select {
+		case <-this.signal:
+		case <-done:
+			return 0, false
+		}
+	}
+}
+
+// add 归还发送额度
+func (this *sendWindow) add(n int) {
+	this.mu.Lock()
+	this.n += n
+	this.mu.Unlock()
+	signal(this.signal)
+}
+
+// streamWindow 协商后每个虚拟IO的接收窗口,0表示未启用流量控制
+func (this *Tunnel) streamWindow() int {
+	if res := this.Negotiated(); res != nil {
+		return int(res.Window)
+	}
+	return 0
+}
+
+// release 虚拟IO读取了 n 字节数据,累计超过半个窗口时归还对端的发送额度
+// 隧道未读数据超过 WithWindow 设置的上限时暂停归还,等其他虚拟IO读取数据后再归还,
+// 这样对端最终会因为没有额度而停止发送,限制隧道占用的内存
+// 每次读取都会检查暂停的虚拟IO,本次读取不足半个窗口时也会归还,避免其他虚拟IO一直等待
+func (this *Tunnel) release(key string, i *IO, n int) {
+	this.flowMu.Lock()
+	i.unacked += n
+	over := this.budget > 0 && this.buffered.Load() >= this.budget
+	ready := i.unacked >= i.window/2
+	if over && ready {
+		this.stalled[key] = i
+	}
+	stalled := !over && len(this.stalled) > 0
+	this.flowMu.Unlock()
+	if stalled {
+		this.flush()
+	}
+	if ready && !over {
+		this.grant(key, i)
+	}
+}
+
+// flush 隧道未读数据低于上限时,归还之前暂停的发送额度
+func (this *Tunnel) flush() {
+	if this.budget > 0 && this.buffered.Load() >= this.budget {
+		return
+	}
+	this.flowMu.Lock()
+	if len(this.stalled) == 0 {
+		this.flowMu.Unlock()
+		return
+	}
+	list := this.stalled
+	this.stalled = make(map[string]*IO)
+	this.flowMu.Unlock()
+	for key, i := range list {
+		this.grant(key, i)
+	}
+}
+
+// grant 将虚拟IO已读取的数据长度作为发送额度归还给对端
+func (this *Tunnel) grant(key string, i *IO) {
+	this.flowMu.Lock()
+	n := i.unacked
+	i.unacked = 0
+	this.flowMu.Unlock()
+	if n > 0 && !i.Closed() {
+		this.WritePacket(key, Window, Request, conv.Bytes(uint32(n))) //可忽略错误
+	}
+}
+
+// Buffered 获取隧道所有虚拟IO未读数据的总长度
+func (this *Tunnel) Buffered() int64 {
+	return this.buffered.Load()
+}
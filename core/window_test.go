@@ -0,0 +1,128 @@
+package core
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// newWindowPair 启用流量控制的一对隧道,客户端连接服务端后,由服务端的目标向客户端发送数据
+// 返回的通道依次收到每次连接的目标,写入目标的数据由客户端的虚拟IO读取
+func newWindowPair(t *testing.T, window uint32, budget int64) (*Tunnel, *Tunnel, chan net.Conn) {
+	targets := make(chan net.Conn, 4)
+	s, c := newTestPair(t, []TunnelOption{WithWindow(window, 0), WithDial(func(d *Dial) (io.ReadWriteCloser, string, error) {
+		c1, c2 := net.Pipe()
+		targets <- c2
+		return c1, "", nil
+	})}, []TunnelOption{WithWindow(window, budget)})
+	return s, c, targets
+}
+
+// dialWindow 客户端建立连接,返回客户端的虚拟IO、服务端对应的虚拟IO和服务端的目标
+func dialWindow(t *testing.T, s, c *Tunnel, targets chan net.Conn) (*IO, *IO, net.Conn) {
+	t.Helper()
+	rw, err := c.Dial(&Dial{Type: TCP, Address: "target"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	i := rw.(*IO)
+	c.ioMu.RLock()
+	var key string
+	for k, v := range c.ioMap {
+		if v == i {
+			key = k
+		}
+	}
+	c.ioMu.RUnlock()
+	remote := s.GetIO(key)
+	if remote == nil {
+		t.Fatal("服务端没有对应的虚拟IO")
+	}
+	return i, remote, <-targets
+}
+
+// credit 虚拟IO当前的发送额度
+func credit(i *IO) int {
+	i.credit.mu.Lock()
+	defer i.credit.mu.Unlock()
+	return i.credit.n
+}
+
+// waitFor 等待条件成立,超时后失败
+func waitFor(t *testing.T, msg string, f func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !f() {
+		if time.Now().After(deadline) {
+			t.Fatal(msg)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// TestWindowStall 对端没有读取时,发送方在用完窗口后停止发送,对端读取后收到 Window 消息继续发送
+func TestWindowStall(t *testing.T) {
+	const window = 1024
+	s, c, targets := newWindowPair(t, window, 0)
+	i, remote, target := dialWindow(t, s, c, targets)
+
+	go target.Write(make([]byte, 4*window))
+
+	waitFor(t, "接收方没有缓存满一个窗口", func() bool { return c.Buffered() == window })
+	time.Sleep(50 * time.Millisecond)
+	if n := c.Buffered(); n != window || credit(remote) != 0 {
+		t.Fatalf("超出窗口继续发送: 缓存%d 额度%d", n, credit(remote))
+	}
+
+	// 读取半个窗口后归还额度,对端继续发送
+	if _, err := io.ReadFull(i, make([]byte, window/2)); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "读取后没有继续发送", func() bool { return c.Buffered() == window })
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := io.ReadFull(i, make([]byte, 3*window+window/2))
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("读取后没有继续发送")
+	}
+}
+
+// TestWindowBudget 隧道未读数据超过上限时暂停归还额度,
+// 其他虚拟IO读取少量数据(不足半个窗口)使隧道低于上限后,归还暂停的额度
+func TestWindowBudget(t *testing.T) {
+	const window = 1024
+	s, c, targets := newWindowPair(t, window, window+window/2)
+	a, remoteA, targetA := dialWindow(t, s, c, targets)
+	b, remoteB, targetB := dialWindow(t, s, c, targets)
+
+	go targetA.Write(make([]byte, 2*window))
+	go targetB.Write(make([]byte, 2*window))
+	waitFor(t, "接收方没有缓存满两个窗口", func() bool { return c.Buffered() == 2*window })
+
+	// A 读取半个窗口,隧道仍然达到上限,暂停归还
+	if _, err := io.ReadFull(a, make([]byte, window/2)); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if n := credit(remoteA); n != 0 || c.Buffered() != 2*window-window/2 {
+		t.Fatalf("超过上限时归还了额度: 额度%d 缓存%d", n, c.Buffered())
+	}
+
+	// B 读取少量数据后隧道低于上限,归还 A 暂停的额度,B 不足半个窗口不归还
+	if _, err := io.ReadFull(b, make([]byte, 100)); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "低于上限后没有归还暂停的额度", func() bool { return c.Buffered() == 2*window-100 })
+	if n := credit(remoteB); n != 0 {
+		t.Fatalf("不足半个窗口时归还了额度: %d", n)
+	}
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/injoyai/logs"
+	"github.com/injoyai/proxy/core"
+	"github.com/injoyai/proxy/tunnel"
+)
+
+/*
+在本地对比隧道使用 tcp 和 rudp(可靠UDP)时的吞吐量,默认两者都没有丢包
+
+	go run ./example/rudp -size 16
+
+使用 netem 模拟丢包,tcp 和 rudp 在相同的条件下对比:
+
+	tc qdisc add dev lo root netem loss 5% delay 25ms
+	tc qdisc del dev lo root
+
+-loss/-delay 只作用于 rudp(在客户端和服务端之间加一个丢包的UDP中转),
+用于没有 netem 时单独观察 rudp 在丢包线路上的表现,结果不能和 tcp 直接对比,
+相同中转下不同丢包率的吞吐量见 core 包的 BenchmarkRUDP
+*/
+func main() {
+	loss := flag.Float64("loss", 0, "rudp 中转的丢包率(0~1)")
+	delay := flag.Duration("delay", 0, "rudp 中转的单向延迟")
+	size := flag.Int("size", 16, "传输的数据量(MB)")
+	window := flag.Int("window", core.DefaultRUDPWindow, "rudp 窗口大小")
+	interval := flag.Duration("interval", core.DefaultRUDPInterval, "rudp 检查重传间隔")
+	rto := flag.Duration("rto", core.DefaultRUDPMinRTO, "rudp 最小重传超时时间")
+	flag.Parse()
+	logs.SetLevel(logs.LevelError)
+
+	param := map[string]any{
+		core.ParamWindow:   *window,
+		core.ParamInterval: interval.String(),
+		core.ParamRTO:      rto.String(),
+	}
+
+	// tcp
+	d, err := bench(
+		&core.Listen{Type: core.TCP, Address: "127.0.0.1:20101"},
+		&core.Dial{Type: core.TCP, Address: "127.0.0.1:20101"},
+		"127.0.0.1:20102", *size)
+	report("tcp", *size, d, err)
+
+	// rudp,经过丢包的中转
+	relay, err := lossy("127.0.0.1:20103", *loss, *delay)
+	if err != nil {
+		logs.Err(err)
+		return
+	}
+	d, err = bench(
+		&core.Listen{Type: core.RUDP, Address: "127.0.0.1:20103", Param: param},
+		&core.Dial{Type: core.RUDP, Address: relay, Param: param},
+		"127.0.0.1:20104", *size)
+	report(fmt.Sprintf("rudp(丢包%.0f%%,延迟%v)", *loss*100, *delay), *size, d, err)
+}
+
+func report(name string, size int, d time.Duration, err error) {
+	if err != nil {
+		fmt.Printf("%s: %v\n", name, err)
+		return
+	}
+	fmt.Printf("%s: %dMB 用时 %v, %.2f MB/s\n", name, size, d, float64(size)/d.Seconds())
+}
+
+// bench 建立隧道,通过服务端的监听端口发送数据,统计客户端的目标收完数据的时间
+func bench(listen *core.Listen, dial *core.Dial, proxy string, size int) (time.Duration, error) {
+	total := int64(size) << 20
+	done := make(chan struct{})
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return 0, err
+	}
+	defer target.Close()
+	go func() {
+		c, err := target.Accept()
+		if err != nil {
+			return
+		}
+		io.CopyN(io.Discard, c, total)
+		close(done)
+	}()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s := &tunnel.Server{Listen: listen}
+	go s.Run(ctx)
+	time.Sleep(time.Millisecond * 100)
+
+	c := &tunnel.Client{Dialer: dial, Register: &core.RegisterReq{Key: "bench", Listen: core.NewListenTCP(proxy)}}
+	if err := c.Dial(core.WithDialTCP(target.Addr().String())); err != nil {
+		return 0, err
+	}
+	defer c.Close()
+	time.Sleep(time.Millisecond * 100)
+
+	conn, err := net.Dial("tcp", proxy)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+	start := time.Now()
+	go io.CopyN(conn, zero{}, total)
+	select {
+	case <-done:
+		return time.Since(start), nil
+	case <-time.After(time.Minute * 5):
+		return 0, core.ErrTimeout
+	}
+}
+
+// zero 无限的数据源
+type zero struct{}
+
+func (zero) Read(p []byte) (int, error) { return len(p), nil }
+
+// lossy 启动一个按比例丢包并延迟转发的UDP中转,返回中转的地址
+func lossy(target string, loss float64, delay time.Duration) (string, error) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		return "", err
+	}
+	addr, err := net.ResolveUDPAddr("udp", target)
+	if err != nil {
+		return "", err
+	}
+	send := func(f func()) {
+		if rand.Float64() < loss {
+			return
+		}
+		time.AfterFunc(delay, f)
+	}
+	var mu sync.Mutex
+	upstream := map[string]*net.UDPConn{}
+	go func() {
+		buf := make([]byte, 0xFFFF)
+		for {
+			n, from, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			mu.Lock()
+			c, ok := upstream[from.String()]
+			if !ok {
+				if c, err = net.DialUDP("udp", nil, addr); err != nil {
+					mu.Unlock()
+					continue
+				}
+				upstream[from.String()] = c
+				go func() {
+					b := make([]byte, 0xFFFF)
+					for {
+						n, err := c.Read(b)
+						if err != nil {
+							return
+						}
+						bs := append([]byte(nil), b[:n]...)
+						send(func() { pc.WriteTo(bs, from) })
+					}
+				}()
+			}
+			mu.Unlock()
+			bs := append([]byte(nil), buf[:n]...)
+			send(func() { c.Write(bs) })
+		}
+	}()
+	return pc.LocalAddr().String(), nil
+}
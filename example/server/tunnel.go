@@ -1,7 +1,7 @@
 package main
 
 import (
-	"errors"
+	"fmt"
 
 	"github.com/injoyai/logs"
 	"github.com/injoyai/proxy/core"
@@ -17,10 +17,16 @@ func RunTunnel(port int) error {
 	Tunnel = &tunnel.Server{
 		Listen: core.NewListenTCP(port),
 		OnRegister: func(tun *core.Tunnel, reg *core.RegisterReq) error {
+			//使用TLS双向认证时,客户端身份已由证书校验,不再校验密码
+			//需使用 core.NewListenTLS 监听并设置 ca 参数,同时开启 VerifyKey
+			if reg.Identity != nil {
+				logs.Debugf("[%s] 新的客户端连接, 证书: %s\n", tun.Key(), reg.Identity.Subject)
+				return nil
+			}
 			switch reg.Param["version"] {
 			default:
 				if reg.Password != "password" {
-					return errors.New("账号或者密码错误")
+					return fmt.Errorf("账号或者密码错误: %w", core.ErrAuth)
 				}
 			}
 			logs.Debugf("[%s] 新的客户端连接\n", tun.Key())
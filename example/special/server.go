@@ -39,10 +39,10 @@ func main() {
 		special.WithAddress(address), //内网穿透地址
 		special.WithRegister(func(tun *core.Tunnel, register *core.RegisterReq) error {
 			if len(username) > 0 && register.Username != username {
-				return fmt.Errorf("账号或密码错误")
+				return fmt.Errorf("账号或密码错误: %w", core.ErrAuth)
 			}
 			if len(password) > 0 && register.Password != password {
-				return fmt.Errorf("账号或密码错误")
+				return fmt.Errorf("账号或密码错误: %w", core.ErrAuth)
 			}
 			logs.Debugf("[%s] 注册成功...\n", tun.Key())
 			return nil
@@ -44,10 +44,16 @@ func main() {
 				Password: password,
 			},
 		}
+		var err error
 		if len(forward) > 0 {
-			logs.Err(t.Run(core.WithDialTCP(forward)))
+			err = t.Run(core.WithDialTCP(forward))
 		} else {
-			logs.Err(t.Run())
+			err = t.Run()
+		}
+		logs.Err(err)
+		if !core.Temporary(err) {
+			//认证失败或被踢下线,重连也不会成功
+			return
 		}
 		<-time.After(time.Second * 5)
 	}
@@ -25,11 +25,17 @@ func main() {
 				Username: "username",
 				Password: "password",
 			},
+			Resume: time.Minute, //断开后自动重连并恢复会话,超过宽限时间才重新注册
 		}
-		logs.Err(t.Run(
+		err := t.Run(
 			//core.WithDialTCP("baidu.com:80"),
 			core.WithKey(key),
-		))
+		)
+		logs.Err(err)
+		if !core.Temporary(err) {
+			//认证失败或被踢下线,重连也不会成功
+			return
+		}
 		<-time.After(time.Second * 5)
 	}
 }
@@ -2,6 +2,7 @@ package main
 
 import (
 	"io"
+	"time"
 
 	"github.com/injoyai/logs"
 	"github.com/injoyai/proxy/core"
@@ -12,6 +13,7 @@ func main() {
 
 	t := tunnel.Server{
 		Listen: core.NewListenTCP(7000),
+		Resume: time.Minute,
 		OnRegister: func(tun *core.Tunnel, reg *core.RegisterReq) error {
 			reg.OnProxy = func(r io.ReadWriteCloser) (*core.Dial, []byte, error) {
 				return &core.Dial{Address: "baidu.com:80"}, nil, nil
@@ -2,7 +2,9 @@ package forward
 
 import (
 	"context"
+	"io"
 	"net"
+	"sync"
 
 	"github.com/injoyai/logs"
 	"github.com/injoyai/proxy/core"
@@ -11,6 +13,12 @@ import (
 type Forward struct {
 	Listen  *core.Listen //监听配置
 	Forward *core.Dial   //转发配置
+
+	mu     sync.Mutex           //保护 conns、seq 和 closed
+	conns  map[uint64]io.Closer //正在转发的连接,包括监听和转发的两端,连接不一定可以作为map的key,使用自增的编号
+	seq    uint64               //连接的自增编号
+	closed bool                 //是否已调用 Shutdown,之后不再处理新的连接
+	wg     sync.WaitGroup       //等待正在转发的连接结束
 }
 
 func (this *Forward) Run(ctx ...context.Context) error {
@@ -18,9 +26,41 @@ func (this *Forward) Run(ctx ...context.Context) error {
 	return this.Listen.ListenAndRun(ctx...)
 }
 
+// Shutdown 优雅关闭转发,停止监听,等待正在转发的连接结束,
+// ctx 结束时立即关闭剩余的连接并返回 ctx 的错误
+func (this *Forward) Shutdown(ctx context.Context) error {
+	this.mu.Lock()
+	this.closed = true
+	this.mu.Unlock()
+	this.Listen.Close()
+	done := make(chan struct{})
+	go func() {
+		this.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		this.mu.Lock()
+		for _, c := range this.conns {
+			c.Close()
+		}
+		this.mu.Unlock()
+		<-done
+		return ctx.Err()
+	}
+}
+
 func (this *Forward) Handler(l net.Listener, c net.Conn) {
-	logs.Infof("[%s] 转发至 [%s]\n", c.RemoteAddr().String(), this.Forward.Address)
 	defer c.Close()
+	id, ok := this.track(c)
+	if !ok {
+		return
+	}
+	defer this.untrack(id)
+
+	logs.Infof("[%s] 转发至 [%s]\n", c.RemoteAddr().String(), this.Forward.Address)
 
 	newConn, _, err := this.Forward.Dial()
 	if err != nil {
@@ -28,9 +68,38 @@ func (this *Forward) Handler(l net.Listener, c net.Conn) {
 		return
 	}
 	defer newConn.Close()
+	newID, ok := this.track(newConn)
+	if !ok {
+		return
+	}
+	defer this.untrack(newID)
 
 	err = core.Bridge(c, newConn)
 	if err != nil {
 		logs.Trace("[错误]", err)
 	}
 }
+
+// track 记录正在转发的连接,返回连接的编号,已经调用 Shutdown 时返回false
+func (this *Forward) track(c io.Closer) (uint64, bool) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	if this.closed {
+		return 0, false
+	}
+	if this.conns == nil {
+		this.conns = make(map[uint64]io.Closer)
+	}
+	this.seq++
+	this.conns[this.seq] = c
+	this.wg.Add(1)
+	return this.seq, true
+}
+
+// untrack 连接转发结束
+func (this *Forward) untrack(id uint64) {
+	this.mu.Lock()
+	delete(this.conns, id)
+	this.mu.Unlock()
+	this.wg.Done()
+}
@@ -0,0 +1,121 @@
+package forward
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/injoyai/proxy/core"
+)
+
+// echoServer 启动一个原样返回数据的 TCP 服务,返回监听地址
+func echoServer(t *testing.T) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(c, c)
+				c.Close()
+			}()
+		}
+	}()
+	return l.Addr().String()
+}
+
+// runForward 启动转发,返回已经建立转发的连接
+func runForward(t *testing.T) (*Forward, net.Conn) {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+	f := &Forward{Listen: core.NewListenTCP(addr), Forward: core.NewDialTCP(echoServer(t))}
+	go f.Run()
+	t.Cleanup(func() { f.Listen.Close() })
+
+	var c net.Conn
+	for i := 0; i < 50; i++ {
+		if c, err = net.Dial("tcp", addr); err == nil {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	echo(t, c)
+	return f, c
+}
+
+// echo 发送数据并校验返回的数据
+func echo(t *testing.T, c net.Conn) {
+	t.Helper()
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	defer c.SetDeadline(time.Time{})
+	if _, err := c.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(c, buf); err != nil || string(buf) != "ping" {
+		t.Fatalf("返回的数据不一致: %q %v", buf, err)
+	}
+}
+
+// TestShutdown 优雅关闭时停止监听,已有的连接继续转发,连接结束后返回
+func TestShutdown(t *testing.T) {
+	f, c := runForward(t)
+
+	done := make(chan error, 1)
+	go func() { done <- f.Shutdown(context.Background()) }()
+	time.Sleep(50 * time.Millisecond)
+	select {
+	case err := <-done:
+		t.Fatalf("连接还在转发时返回: %v", err)
+	default:
+	}
+	if _, err := net.DialTimeout("tcp", f.Listen.Address, time.Second); err == nil {
+		t.Fatal("关闭后仍然接受新的连接")
+	}
+	echo(t, c)
+
+	c.Close()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("连接结束后没有返回")
+	}
+}
+
+// TestShutdownTimeout ctx 结束时关闭剩余的连接并返回 ctx 的错误
+func TestShutdownTimeout(t *testing.T) {
+	f, c := runForward(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := f.Shutdown(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("预期 context.DeadlineExceeded,得到 %v", err)
+	}
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := c.Read(make([]byte, 1)); err == nil || errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("连接没有被关闭: %v", err)
+	}
+}
@@ -4,12 +4,15 @@ go 1.25.0
 
 require (
 	github.com/google/uuid v1.6.0
+	github.com/gorilla/websocket v1.5.3
 	github.com/injoyai/base v1.2.23
 	github.com/injoyai/conv v1.2.6
 	github.com/injoyai/logs v1.0.12
+	go.bug.st/serial v1.6.4
 )
 
 require (
+	github.com/creack/goselect v0.1.2 // indirect
 	github.com/fatih/color v1.18.0 // indirect
 	github.com/json-iterator/go v1.1.12 // indirect
 	github.com/kr/pretty v0.3.1 // indirect
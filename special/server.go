@@ -90,7 +90,7 @@ func (this *Server) Run() error {
 func (this *Server) handler(c net.Conn) error {
 	defer c.Close()
 
-	//读取前2字节是否是默认协议的帧头
+	//读取前2字节是否是隧道协议的帧头
 	prefix := make([]byte, 2)
 	n, err := io.ReadAtLeast(c, prefix, 2)
 	if err != nil {
@@ -105,8 +105,8 @@ func (this *Server) handler(c net.Conn) error {
 		c,
 	}
 
-	//说明是隧道连接
-	if n == 2 && prefix[0] == 0x89 && prefix[1] == 0x89 {
+	//说明是隧道连接,0x8989为默认协议,0x898A为V2协议
+	if n == 2 && prefix[0] == 0x89 && (prefix[1] == 0x89 || prefix[1] == 0x8A) {
 		this.tunnelMu.Lock()
 		if this.tunnel != nil && !this.tunnel.Closed() {
 			this.tunnel.Close()
@@ -120,14 +120,24 @@ func (this *Server) handler(c net.Conn) error {
 				if err != nil {
 					return nil, err
 				}
+				register.Negotiated = tun.Negotiate(register)
 				if this.OnRegister != nil {
 					if err := this.OnRegister(tun, register); err != nil {
 						return nil, err
 					}
 				}
-				return nil, nil
+				res := register.Negotiated
+				if res == nil {
+					//旧版本客户端
+					return nil, nil
+				}
+				res.Key = tun.Key()
+				return res, nil
 			}),
 		)
+		if prefix[1] == 0x8A {
+			this.tunnel.SetOption(core.WithFrame(core.FrameV2))
+		}
 		this.tunnel.SetOption(this.TunnelOption...)
 		this.tunnelMu.Unlock()
 		return this.tunnel.Run()
@@ -1,7 +1,11 @@
 package tunnel
 
 import (
+	"context"
 	"encoding/json"
+	"io"
+	"sync/atomic"
+	"time"
 
 	"github.com/injoyai/conv"
 	"github.com/injoyai/logs"
@@ -11,6 +15,9 @@ import (
 type Client struct {
 	Dialer   core.Dialer       //连接配置
 	Register *core.RegisterReq //注册配置
+	PSK      *core.PSK         //预共享密钥,设置后隧道连接会加密,需和服务端一致
+	Resume   time.Duration     //会话恢复的宽限时间,设置后连接断开会自动重连并恢复隧道,需和服务端一起启用,会话标识需要 PSK 或 TLS 保护
+	Bond     []core.Dialer     //额外的隧道连接,设置后和 Dialer 的连接绑定成一条隧道,可以使用不同的传输方式或网卡,需和服务端一起启用,会话密钥需要 PSK 或 TLS 保护
 	tunnel   *core.Tunnel      //隧道实例
 }
 
@@ -26,18 +33,82 @@ func (this *Client) Close() error {
 }
 
 func (this *Client) Run(op ...core.TunnelOption) error {
-	err := this.Dial(op...)
+	return this.RunContext(context.Background(), op...)
+}
+
+// RunContext 连接并注册到服务端,阻塞直到隧道关闭,ctx 结束时关闭隧道并返回 ctx 的错误
+func (this *Client) RunContext(ctx context.Context, op ...core.TunnelOption) error {
+	err := this.DialContext(ctx, op...)
 	if err != nil {
 		return err
 	}
-	<-this.Tunnel().Done()
-	return this.Tunnel().Err()
+	select {
+	case <-this.Tunnel().Done():
+		return this.Tunnel().Err()
+	case <-ctx.Done():
+		this.Tunnel().CloseWithErr(ctx.Err())
+		return ctx.Err()
+	}
 }
 
 func (this *Client) Dial(op ...core.TunnelOption) error {
+	return this.DialContext(context.Background(), op...)
+}
+
+// DialContext 连接并注册到服务端,ctx 只作用于连接和注册的过程,结束时放弃连接或注册并返回 ctx 的错误
+// 会话恢复和绑定连接的后台重连不受 ctx 影响
+func (this *Client) DialContext(ctx context.Context, op ...core.TunnelOption) error {
+
+	//连接到服务端,只有第一次连接使用 ctx
+	var k string
+	var dialed atomic.Bool
+	var stop func() bool
+	connect := this.dialer(this.Dialer, &k)
+	dial := func() (io.ReadWriteCloser, error) {
+		if !dialed.CompareAndSwap(false, true) {
+			return connect(context.Background())
+		}
+		c, err := connect(ctx)
+		if err == nil {
+			//会话恢复和绑定的握手时 ctx 结束会关闭连接
+			stop = context.AfterFunc(ctx, func() { c.Close() })
+		}
+		return c, err
+	}
+
+	//绑定多条连接,任意一条断开不影响隧道
+	if len(this.Bond) > 0 {
+		dials := []func() (io.ReadWriteCloser, error){dial}
+		for _, d := range this.Bond {
+			connect := this.dialer(d, nil)
+			dials = append(dials, func() (io.ReadWriteCloser, error) {
+				return connect(context.Background())
+			})
+		}
+		dial = func() (io.ReadWriteCloser, error) {
+			c, err := core.DialBond(dials...)
+			if err != nil {
+				return nil, err
+			}
+			return c, nil
+		}
+	}
 
-	//连接到服务端
-	c, k, err := this.Dialer.Dial()
+	var c io.ReadWriteCloser
+	var err error
+	if this.Resume > 0 {
+		//可恢复的会话,断开后自动重连
+		c, err = core.DialResume(dial, this.Resume)
+	} else {
+		c, err = dial()
+	}
+	if stop != nil && !stop() {
+		//ctx 结束时连接已经被关闭
+		if err == nil {
+			c.Close()
+		}
+		return ctx.Err()
+	}
 	if err != nil {
 		return err
 	}
@@ -59,14 +130,19 @@ func (this *Client) Dial(op ...core.TunnelOption) error {
 	go this.tunnel.Run()
 
 	//注册到服务
-	resp, err := this.tunnel.Register(this.Register)
+	resp, err := this.tunnel.RegisterContext(ctx, this.Register)
 	if err != nil {
 		//注册失败则关闭虚拟通道
 		logs.Trace("[错误]", err)
 		this.tunnel.CloseWithErr(err)
 		return err
 	}
-	if err := json.Unmarshal(conv.Bytes(resp), &this.Register.Listen); err != nil {
+	if res := this.tunnel.Negotiated(); res != nil {
+		//新版本服务端返回协商结果
+		if res.Listen != nil {
+			this.Register.Listen = res.Listen
+		}
+	} else if err := json.Unmarshal(conv.Bytes(resp), &this.Register.Listen); err != nil {
 		logs.Trace("[错误]", err)
 		//可能返回空字符,则解析失败
 		//return err
@@ -75,3 +151,41 @@ func (this *Client) Dial(op ...core.TunnelOption) error {
 
 	return nil
 }
+
+// dialer 建立一条隧道连接,设置了预共享密钥时进行加密握手
+// key 不为nil时记录第一次连接的标识,重连时保持不变
+// ctx 结束时放弃连接,拨号器实现了 core.ContextDialer 时可以中断正在进行的连接
+func (this *Client) dialer(d core.Dialer, key *string) func(ctx context.Context) (io.ReadWriteCloser, error) {
+	return func(ctx context.Context) (io.ReadWriteCloser, error) {
+		var c io.ReadWriteCloser
+		var k string
+		var err error
+		if cd, ok := d.(core.ContextDialer); ok {
+			c, k, err = cd.DialContext(ctx)
+		} else {
+			c, k, err = d.Dial()
+		}
+		if err != nil {
+			return nil, err
+		}
+		if key != nil && *key == "" {
+			*key = k
+		}
+
+		//加密隧道连接,握手时 ctx 结束会关闭连接
+		if this.PSK != nil {
+			stop := context.AfterFunc(ctx, func() { c.Close() })
+			conn, err := this.PSK.Client(c)
+			if !stop() {
+				//ctx 结束时连接已经被关闭
+				err = ctx.Err()
+			}
+			if err != nil {
+				c.Close()
+				return nil, err
+			}
+			c = conn
+		}
+		return c, nil
+	}
+}
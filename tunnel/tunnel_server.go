@@ -3,47 +3,141 @@ package tunnel
 import (
 	"bytes"
 	"context"
+	"crypto/tls"
 	"encoding/json"
 	"io"
 	"net"
+	"slices"
+	"sync"
+	"time"
 
 	"github.com/injoyai/base/maps"
 	"github.com/injoyai/logs"
 	"github.com/injoyai/proxy/core"
 )
 
+// DefaultListenTypes 默认允许客户端注册时请求监听的类型
+var DefaultListenTypes = []string{core.TCP, core.UDP}
+
 type Server struct {
 	clients     *maps.Generic[string, *core.Tunnel]                 //客户端
 	Listen      *core.Listen                                        //监听配置
 	OnRegister  func(tun *core.Tunnel, reg *core.RegisterReq) error //注册事件
 	OnConnected func(conn io.ReadWriteCloser, tun *core.Tunnel)     //连接事件
 	OnClosed    func(key *core.Tunnel, err error)                   //关闭事件
+	Option      []core.TunnelOption                                 //隧道选项,例如 core.WithFrame(core.FrameV2)
+	PSK         *core.PSK                                           //预共享密钥,设置后隧道连接会加密,需和客户端一致
+	VerifyKey   bool                                                //TLS双向认证时,要求注册的Key和客户端证书的身份(通用名称或备用名称)一致
+	Resume      time.Duration                                       //会话恢复的宽限时间,设置后客户端断开在此时间内重连可以恢复隧道,需和客户端一起启用
+	Bond        bool                                                //绑定客户端的多条连接为一条隧道,需和客户端一起启用
+	ListenTypes []string                                            //允许客户端注册时请求监听的类型,默认为 DefaultListenTypes,串口等需要明确允许
+	ListenFile  bool                                                //允许客户端通过 Param 指定服务端的证书文件(tls、websocket 的 cert、key、ca),默认不允许
+	ListenTLS   *tls.Config                                         //客户端请求 tls 监听时使用的证书配置
+
+	clientsOnce sync.Once
+	resume      *core.ResumeServer
+	resumeOnce  sync.Once
+	bond        *core.BondServer
+	bondOnce    sync.Once
+	ctx         context.Context
+}
+
+// getClients 获取客户端集合,首次使用时初始化,注册、调用等会并发访问
+func (this *Server) getClients() *maps.Generic[string, *core.Tunnel] {
+	this.clientsOnce.Do(func() {
+		if this.clients == nil {
+			this.clients = maps.NewGeneric[string, *core.Tunnel]()
+		}
+	})
+	return this.clients
 }
 
 func (this *Server) GetTunnel(key string) *core.Tunnel {
-	if this.clients == nil {
-		this.clients = maps.NewGeneric[string, *core.Tunnel]()
-	}
-	return this.clients.MustGet(key)
+	return this.getClients().MustGet(key)
 }
 
 func (this *Server) SetTunnel(key string, tun *core.Tunnel) {
-	if this.clients == nil {
-		this.clients = maps.NewGeneric[string, *core.Tunnel]()
-	}
-	this.clients.Set(key, tun)
+	this.getClients().Set(key, tun)
 }
 
 func (this *Server) DelTunnel(key string) {
-	if this.clients == nil {
-		this.clients = maps.NewGeneric[string, *core.Tunnel]()
+	this.getClients().Del(key)
+}
+
+// Shutdown 优雅关闭服务,不再接受新的客户端,
+// 通知所有客户端的隧道不再建立新的连接,等待已有的连接结束后关闭隧道(见 core.Tunnel.Shutdown),
+// ctx 结束时立即关闭剩余的隧道并返回 ctx 的错误
+func (this *Server) Shutdown(ctx context.Context) error {
+	this.Listen.Close()
+	wg := sync.WaitGroup{}
+	this.getClients().Range(func(key string, tun *core.Tunnel) bool {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			tun.Shutdown(ctx)
+		}()
+		return true
+	})
+	wg.Wait()
+	return ctx.Err()
+}
+
+// Call 调用客户端注册的方法,key 为客户端隧道的标识,结果解码到 reply,见 core.Tunnel.Call
+func (this *Server) Call(key, method string, args, reply any) error {
+	return this.CallContext(context.Background(), key, method, args, reply)
+}
+
+// CallContext 调用客户端注册的方法,ctx 可以设置本次调用的超时时间,客户端不在线时返回 core.ErrOffline
+func (this *Server) CallContext(ctx context.Context, key, method string, args, reply any) error {
+	tun := this.GetTunnel(key)
+	if tun == nil || tun.Closed() {
+		return &core.Error{Code: core.CodeOffline, Target: key}
 	}
-	this.clients.Del(key)
+	return tun.CallContext(ctx, method, args, reply)
 }
 
+// Run 启动服务,ctx 可选,结束时停止监听并关闭所有客户端的隧道,返回 ctx 的错误
 func (this *Server) Run(ctx ...context.Context) error {
+	this.ctx = context.Background()
+	if len(ctx) > 0 && ctx[0] != nil {
+		this.ctx = ctx[0]
+	}
 	this.Listen.OnConnected(this.Handler)
-	return this.Listen.ListenAndRun(ctx...)
+	err := this.Listen.ListenAndRun(this.ctx)
+	if this.ctx.Err() != nil {
+		return this.ctx.Err()
+	}
+	return err
+}
+
+// checkListen 校验客户端请求的监听配置,
+// 监听类型需要在 ListenTypes 中,证书等文件路径会读取服务端的文件,需要设置 ListenFile
+func (this *Server) checkListen(l *core.Listen) error {
+	types := this.ListenTypes
+	if types == nil {
+		types = DefaultListenTypes
+	}
+	//未知的类型按 tcp 监听
+	_type := l.Type
+	switch _type {
+	case core.TCP, core.TLS, core.UDP, core.RUDP, core.Serial, core.Websocket:
+	default:
+		_type = core.TCP
+	}
+	if !slices.Contains(types, _type) {
+		return &core.Error{Code: core.CodeListen, Reason: "不允许的监听类型: " + _type, Target: l.Address}
+	}
+	if !this.ListenFile {
+		for _, k := range []string{core.ParamCert, core.ParamKey, core.ParamCA} {
+			if _, ok := l.Param[k]; ok {
+				return &core.Error{Code: core.CodeListen, Reason: "不允许指定服务端的文件: " + k, Target: l.Address}
+			}
+		}
+	}
+	if _type == core.TLS {
+		l.TLS = this.ListenTLS
+	}
+	return nil
 }
 
 // Handler 对客户端进行注册验证操作
@@ -51,7 +145,54 @@ func (this *Server) Handler(_ net.Listener, tunConn net.Conn) {
 
 	var listener *core.Listen
 
-	tun := core.NewTunnel(tunConn, core.WithKey(tunConn.RemoteAddr().String()))
+	//TLS双向认证,获取客户端证书的身份
+	identity, err := core.PeerIdentity(tunConn)
+	if err != nil {
+		logs.Errf("[%s] TLS握手失败: %v\n", tunConn.RemoteAddr().String(), err)
+		return
+	}
+
+	//加密隧道连接
+	var conn io.ReadWriteCloser = tunConn
+	if this.PSK != nil {
+		c, err := this.PSK.Server(tunConn)
+		if err != nil {
+			logs.Errf("[%s] 加密握手失败: %v\n", tunConn.RemoteAddr().String(), err)
+			return
+		}
+		conn = c
+	}
+
+	//绑定多条连接,加入已有隧道的连接阻塞直到断开
+	if this.Bond {
+		this.bondOnce.Do(func() { this.bond = core.NewBondServer() })
+		c, err := this.bond.Accept(conn)
+		if err != nil {
+			logs.Errf("[%s] 绑定连接失败: %v\n", tunConn.RemoteAddr().String(), err)
+			return
+		}
+		if c == nil {
+			return
+		}
+		conn = c
+	}
+
+	//可恢复的会话,客户端重连时接入已有的会话,阻塞直到断开
+	if this.Resume > 0 {
+		this.resumeOnce.Do(func() { this.resume = core.NewResumeServer(this.Resume) })
+		c, err := this.resume.Accept(conn)
+		if err != nil {
+			logs.Errf("[%s] 会话恢复失败: %v\n", tunConn.RemoteAddr().String(), err)
+			return
+		}
+		if c == nil {
+			return
+		}
+		conn = c
+	}
+
+	tun := core.NewTunnel(conn, core.WithKey(tunConn.RemoteAddr().String()))
+	tun.SetOption(this.Option...)
 	tun.SetOption(core.WithRegister(func(tun *core.Tunnel, data []byte) (any, error) {
 		//解析注册数据
 		register := new(core.RegisterReq)
@@ -60,19 +201,51 @@ func (this *Server) Handler(_ net.Listener, tunConn net.Conn) {
 			return nil, err
 		}
 
-		//注册事件
+		//校验客户端证书的身份,防止设备冒充
+		register.Identity = identity
+		if this.VerifyKey && !identity.Match(register.Key) {
+			return nil, core.ErrIdentity
+		}
+
+		//校验客户端请求的监听配置,防止打开服务端的串口或读取服务端的文件
+		if register.Listen != nil && register.Listen.Address != "" {
+			if err := this.checkListen(register.Listen); err != nil {
+				logs.Errf("[%s] 监听[%s]失败: %v\n", tun.Key(), register.Listen.Address, err)
+				return nil, err
+			}
+		}
+
+		//协商协议参数,旧版本客户端返回nil,注册成功并响应后才生效
+		register.Negotiated = tun.Negotiate(register)
+
+		//注册事件,可以通过 register.Negotiated 修改下发给客户端的配置
 		if this.OnRegister != nil {
 			if err := this.OnRegister(tun, register); err != nil {
 				return nil, err
 			}
 		}
-		//如果存在老的连接的话,会被覆盖,变成野连接,能收到数据,不能发数据,还是说关闭老连接?
+		//注册事件可以设置隧道的标识(例如 tun.SetKey(reg.Key)),存在相同标识的老连接时踢下线,客户端会收到 core.ErrKicked
+		if old := this.GetTunnel(tun.Key()); old != nil && old != tun {
+			logs.Infof("[%s] 重新注册,关闭老的隧道...\n", tun.Key())
+			go old.Kick(core.ErrKicked) //老的连接可能已经断开,发送会阻塞
+		}
 		this.SetTunnel(tun.Key(), tun)
 
+		//旧版本客户端直接响应监听配置
+		response := func() any {
+			res := register.Negotiated
+			if res == nil {
+				return register.Listen
+			}
+			res.Key = tun.Key()
+			res.Listen = register.Listen
+			return res
+		}
+
 		//判断客户端是否需要监听端口
 		//客户端可以选择不监听端口,而由服务端进行安排
 		if register.Listen == nil || register.Listen.Address == "" {
-			return register.Listen, nil
+			return response(), nil
 		}
 
 		//监听端口
@@ -116,12 +289,9 @@ func (this *Server) Handler(_ net.Listener, tunConn net.Conn) {
 			logs.Infof("监听[%s] -> 隧道[%s] -> 请求[%s]\n", register.Listen.Address, tun.Key(), proxy.Address)
 
 			//真实io
-			realIO := struct {
-				io.Reader
-				io.WriteCloser
-			}{
-				Reader:      io.MultiReader(bytes.NewReader(prefix), c),
-				WriteCloser: c,
+			realIO := &prefixConn{
+				r:    io.MultiReader(bytes.NewReader(prefix), c),
+				Conn: c,
 			}
 
 			err = core.Bridge(virtualIO, realIO)
@@ -129,20 +299,36 @@ func (this *Server) Handler(_ net.Listener, tunConn net.Conn) {
 		})
 
 		go register.Listen.Run()
+
+		//隧道正在关闭时停止监听,不再接受新的连接,已有的连接继续转发
+		go func() {
+			select {
+			case <-tun.Draining():
+				register.Listen.Close()
+			case <-tun.Done():
+			}
+		}()
 		logs.Infof("[%s] 监听[%s]成功...\n", tun.Key(), register.Listen.Address)
 
-		return register.Listen, nil
+		return response(), nil
 	}))
 
 	if this.OnConnected != nil {
 		this.OnConnected(tunConn, tun)
 	}
 
-	err := tun.Run()
+	if this.ctx != nil {
+		err = tun.RunContext(this.ctx)
+	} else {
+		err = tun.Run()
+	}
 	logs.Err(err)
 
 	{
-		this.DelTunnel(tun.Key())
+		//被踢下线时已经被新的隧道覆盖
+		if this.GetTunnel(tun.Key()) == tun {
+			this.DelTunnel(tun.Key())
+		}
 		tunConn.Close()
 		tun.Close()
 		if this.OnClosed != nil {
@@ -155,3 +341,21 @@ func (this *Server) Handler(_ net.Listener, tunConn net.Conn) {
 	}
 
 }
+
+// prefixConn 先读取代理回调预读的数据,再读取连接的数据,写入和关闭直接使用连接
+type prefixConn struct {
+	r io.Reader
+	net.Conn
+}
+
+func (this *prefixConn) Read(p []byte) (int, error) {
+	return this.r.Read(p)
+}
+
+// CloseWrite 连接支持半关闭时(例如tcp)关闭写入方向
+func (this *prefixConn) CloseWrite() error {
+	if c, ok := this.Conn.(core.CloseWriter); ok {
+		return c.CloseWrite()
+	}
+	return core.ErrHalfClose
+}
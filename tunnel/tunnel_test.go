@@ -0,0 +1,169 @@
+package tunnel
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/injoyai/proxy/core"
+)
+
+// freeAddr 获取一个空闲的本地地址
+func freeAddr(t *testing.T) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return l.Addr().String()
+}
+
+// runServer 在后台运行服务端,返回注册成功的客户端隧道
+func runServer(t *testing.T, s *Server) <-chan *core.Tunnel {
+	t.Helper()
+	registered := make(chan *core.Tunnel, 1)
+	s.OnRegister = func(tun *core.Tunnel, reg *core.RegisterReq) error {
+		registered <- tun
+		return nil
+	}
+	go s.Run()
+	t.Cleanup(func() { s.Listen.Close() })
+	return registered
+}
+
+// dialClient 连接服务端,服务端可能还没有开始监听,失败时重试
+func dialClient(t *testing.T, c *Client, op ...core.TunnelOption) {
+	t.Helper()
+	var err error
+	for i := 0; i < 50; i++ {
+		if err = c.Dial(op...); err == nil {
+			t.Cleanup(func() { c.Close() })
+			return
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Fatal(err)
+}
+
+// TestWebsocketRegister 客户端通过 websocket 连接并注册到服务端,双方可以互相调用
+func TestWebsocketRegister(t *testing.T) {
+	addr := freeAddr(t)
+	s := &Server{Listen: core.NewListen(core.Websocket, addr)}
+	s.Listen.Param = map[string]any{core.ParamPath: "/tunnel"}
+	registered := runServer(t, s)
+
+	c := &Client{
+		Dialer:   &core.Dial{Type: core.Websocket, Address: "ws://" + addr + "/tunnel", Timeout: 5 * time.Second},
+		Register: &core.RegisterReq{Key: "ws"},
+	}
+	dialClient(t, c, core.WithMethod("ping", func(tun *core.Tunnel, args []byte) (any, error) {
+		return "pong:" + string(args), nil
+	}))
+
+	var tun *core.Tunnel
+	select {
+	case tun = <-registered:
+	case <-time.After(5 * time.Second):
+		t.Fatal("服务端没有收到注册")
+	}
+	var reply string
+	if err := s.Call(tun.Key(), "ping", "ws", &reply); err != nil || reply != "pong:ws" {
+		t.Fatalf("调用失败: %q %v", reply, err)
+	}
+	if c.Tunnel().Negotiated() == nil {
+		t.Fatal("没有协商协议")
+	}
+}
+
+// TestListenDenied 客户端注册时只能请求服务端允许的监听类型,不能指定服务端的证书文件
+func TestListenDenied(t *testing.T) {
+	addr := freeAddr(t)
+	s := &Server{
+		Listen:      core.NewListenTCP(addr),
+		ListenTypes: []string{core.TCP, core.TLS, core.Websocket},
+	}
+	registered := runServer(t, s)
+
+	c := &Client{
+		Dialer:   &core.Dial{Address: addr, Timeout: 5 * time.Second},
+		Register: &core.RegisterReq{Key: "tcp", Listen: core.NewListenTCP(freeAddr(t))},
+	}
+	dialClient(t, c)
+	select {
+	case <-registered:
+	case <-time.After(5 * time.Second):
+		t.Fatal("服务端没有收到注册")
+	}
+
+	for _, v := range []struct {
+		name   string
+		listen *core.Listen
+	}{
+		{"串口", core.NewListenSerial("/dev/ttyS0", 115200)},
+		{"tls证书文件", &core.Listen{Type: core.TLS, Address: freeAddr(t), Param: map[string]any{core.ParamCert: "/etc/passwd", core.ParamKey: "/etc/passwd"}}},
+		{"websocket证书文件", &core.Listen{Type: core.Websocket, Address: freeAddr(t), Param: map[string]any{core.ParamCA: "/etc/passwd"}}},
+	} {
+		t.Run(v.name, func(t *testing.T) {
+			c := &Client{
+				Dialer:   &core.Dial{Address: addr, Timeout: 5 * time.Second},
+				Register: &core.RegisterReq{Key: v.name, Listen: v.listen},
+			}
+			err := c.Dial()
+			if err == nil {
+				c.Close()
+				t.Fatal("预期注册失败")
+			}
+			if !errors.Is(err, core.ErrListenDenied) || core.Temporary(err) {
+				t.Fatalf("预期 ErrListenDenied,得到 %v", err)
+			}
+		})
+	}
+}
+
+// TestReRegisterKick 注册事件按注册标识设置隧道的标识,相同标识的客户端重新注册时,
+// 老的隧道被踢下线并收到 core.ErrKicked,新的隧道继续使用
+func TestReRegisterKick(t *testing.T) {
+	addr := freeAddr(t)
+	s := &Server{Listen: core.NewListenTCP(addr)}
+	registered := make(chan *core.Tunnel, 1)
+	s.OnRegister = func(tun *core.Tunnel, reg *core.RegisterReq) error {
+		tun.SetKey(reg.Key)
+		registered <- tun
+		return nil
+	}
+	go s.Run()
+	t.Cleanup(func() { s.Listen.Close() })
+
+	dial := func() (*Client, *core.Tunnel) {
+		c := &Client{
+			Dialer:   &core.Dial{Address: addr, Timeout: 5 * time.Second},
+			Register: &core.RegisterReq{Key: "same"},
+		}
+		dialClient(t, c)
+		select {
+		case tun := <-registered:
+			return c, tun
+		case <-time.After(5 * time.Second):
+			t.Fatal("服务端没有收到注册")
+			return nil, nil
+		}
+	}
+	old, _ := dial()
+	_, tun := dial()
+
+	select {
+	case <-old.Tunnel().Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("老的隧道没有被踢下线")
+	}
+	if err := old.Tunnel().Err(); !errors.Is(err, core.ErrKicked) || core.Temporary(err) {
+		t.Fatalf("预期 ErrKicked,得到 %v", err)
+	}
+	// 老的隧道关闭时不会移除新的隧道
+	time.Sleep(50 * time.Millisecond)
+	if s.GetTunnel("same") != tun || tun.Closed() {
+		t.Fatal("新的隧道被移除")
+	}
+}